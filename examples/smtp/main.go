@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -23,22 +22,15 @@ func main() {
 	}
 	defer conn.Close()
 
-	// Perform STARTTLS handshake
-	if err := starttls.StartTLS(ctx, conn, "587"); err != nil {
-		log.Fatalf("STARTTLS failed: %v", err)
-	}
-
 	// Configure TLS
-	tlsConfig := &tls.Config{
-		ServerName: "smtp.gmail.com",
-		MinVersion: tls.VersionTLS12,
-	}
+	tlsConfig := starttls.RecommendedTLSConfig("smtp", "smtp.gmail.com")
 
-	// Upgrade connection to TLS
-	tlsConn := tls.Client(conn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		log.Fatalf("TLS handshake failed: %v", err)
+	// Perform the STARTTLS negotiation and the TLS handshake
+	tlsConn, err := starttls.UpgradeTLS(ctx, conn, "587", tlsConfig)
+	if err != nil {
+		log.Fatalf("STARTTLS upgrade failed: %v", err)
 	}
+	defer tlsConn.Close()
 
 	fmt.Println("Successfully established TLS connection!")
 
@@ -0,0 +1,180 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BaseProtocol is the plumbing shared by text protocols: the greeting, a
+// command and its possibly multiline reply, and the upgrade command. Embed
+// it to implement a protocol in a few lines; its methods honor the options
+// of the negotiation, such as WithStepTimeout, the matchers, WithTranscript
+// and WithMaxLineBytes, and record the Banner, UpgradeCommand and Timings of
+// the result:
+//
+//	type appliance struct{ starttls.BaseProtocol }
+//
+//	func (p *appliance) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+//		_, err := p.ReadGreeting(ctx, rw, func(line string) bool {
+//			return strings.HasPrefix(line, "+READY")
+//		})
+//		if err != nil {
+//			return err
+//		}
+//
+//		return p.StartTLS(ctx, rw, func(line string) bool {
+//			return strings.HasPrefix(line, "+GO")
+//		})
+//	}
+//
+//	starttls.Register("appliance", []string{"7000"}, func() starttls.StartTLSProtocol {
+//		return &appliance{starttls.NewBaseProtocol("appliance", "UPGRADE")}
+//	})
+//
+// Outside a negotiation, such as when Handshake is called directly, the
+// methods use the default options.
+type BaseProtocol struct {
+	name    string
+	authMsg string
+}
+
+// NewBaseProtocol returns a BaseProtocol for the protocol name whose upgrade
+// command is command, such as "STARTTLS". StartTLS appends CRLF to command
+// when it has no line terminator.
+func NewBaseProtocol(name ProtocolID, command string) BaseProtocol {
+	return BaseProtocol{
+		name:    string(name),
+		authMsg: command,
+	}
+}
+
+// Name returns the name of the protocol.
+func (p *BaseProtocol) Name() string {
+	return p.name
+}
+
+// ReadGreeting waits for the server greeting as StepGreeting, skipping lines
+// until match accepts one, and returns that line without its terminator. A
+// nil match accepts the first line. WithGreetingMatcher replaces match, and
+// with WithStrictMatching the first line must match.
+func (p *BaseProtocol) ReadGreeting(ctx context.Context, rw *bufio.ReadWriter, match func(line string) bool) (string, error) {
+	s := sessionFromContext(ctx)
+
+	if s.cfg.greetingMatcher != nil {
+		match = s.cfg.greetingMatcher
+	} else if match == nil {
+		match = func(string) bool { return true }
+	}
+
+	start := now(ctx)
+
+	stepCtx, cancel := stepContext(ctx, StepGreeting)
+	greeting, err := expectGreeting(stepCtx, rw, match)
+	cancel()
+
+	if err != nil {
+		return "", fmt.Errorf("%s: greeting failed: %w", p.name, err)
+	}
+
+	s.result.Banner = greeting
+	s.result.addTiming(StepGreeting, start, now(ctx))
+
+	return greeting, nil
+}
+
+// Exchange sends command as step, one of the Step* constants, and reads the
+// reply with ReadReply. CRLF is appended to command when it has no line
+// terminator.
+func (p *BaseProtocol) Exchange(ctx context.Context, rw *bufio.ReadWriter, step, command string,
+	done func(line string) bool,
+) ([]string, error) {
+	if !strings.HasSuffix(command, "\n") {
+		command += "\r\n"
+	}
+
+	verb, _, _ := strings.Cut(strings.TrimSpace(command), " ")
+	start := now(ctx)
+
+	stepCtx, cancel := stepContext(ctx, step)
+	defer cancel()
+
+	_, err := rw.WriteString(command)
+	if err == nil {
+		err = rw.Flush()
+	}
+
+	var lines []string
+	if err == nil {
+		lines, err = p.ReadReply(stepCtx, rw, done)
+	}
+
+	if err != nil {
+		return lines, fmt.Errorf("%s: %s failed: %w", p.name, verb, err)
+	}
+
+	sessionFromContext(ctx).result.addTiming(step, start, now(ctx))
+
+	return lines, nil
+}
+
+// ReadReply reads the lines of a reply until done accepts one, and returns
+// them without their terminators, including the last. For replies with
+// three-digit codes, FinalReplyLine is such a done function; for replies
+// ending with a lone dot, use func(line string) bool { return line == "." }.
+func (p *BaseProtocol) ReadReply(ctx context.Context, rw *bufio.ReadWriter, done func(line string) bool) ([]string, error) {
+	var lines []string
+
+	for {
+		line, err := readLine(ctx, rw.Reader)
+		if err != nil {
+			return lines, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+
+		if done(line) {
+			return lines, nil
+		}
+	}
+}
+
+// StartTLS sends the upgrade command as StepUpgrade and returns
+// ErrStartTLSNotSupported unless match accepts the first line of the reply.
+// WithResponseMatcher replaces match.
+func (p *BaseProtocol) StartTLS(ctx context.Context, rw *bufio.ReadWriter, match func(line string) bool) error {
+	s := sessionFromContext(ctx)
+
+	if s.cfg.responseMatcher != nil {
+		match = s.cfg.responseMatcher
+	}
+
+	command := p.authMsg
+	if !strings.HasSuffix(command, "\n") {
+		command += "\r\n"
+	}
+
+	s.result.UpgradeCommand = strings.TrimSpace(command)
+	start := now(ctx)
+
+	stepCtx, cancel := stepContext(ctx, StepUpgrade)
+	err := sendStartTLS(stepCtx, rw, command, match)
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("%s: STARTTLS failed: %w", p.name, err)
+	}
+
+	s.result.addTiming(StepUpgrade, start, now(ctx))
+
+	return nil
+}
+
+// FinalReplyLine reports whether line is the last line of a reply with
+// three-digit codes, as used by SMTP and FTP: the code followed by a space
+// or nothing, rather than by a hyphen.
+func FinalReplyLine(line string) bool {
+	return len(line) >= 3 && strings.Trim(line[:3], "0123456789") == "" && (len(line) == 3 || line[3] == ' ')
+}
@@ -0,0 +1,97 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// applianceProtocol is a third-party protocol built on BaseProtocol.
+type applianceProtocol struct {
+	BaseProtocol
+	features []string
+}
+
+func (p *applianceProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	_, err := p.ReadGreeting(ctx, rw, func(line string) bool { return strings.HasPrefix(line, "+READY") })
+	if err != nil {
+		return err
+	}
+
+	p.features, err = p.Exchange(ctx, rw, StepCapabilities, "FEATURES", FinalReplyLine)
+	if err != nil {
+		return err
+	}
+
+	return p.StartTLS(ctx, rw, func(line string) bool { return strings.HasPrefix(line, "+GO") })
+}
+
+func TestBaseProtocol(t *testing.T) {
+	tests := []struct {
+		name          string
+		upgradeReply  string
+		expectedError error
+	}{
+		{name: "upgrade", upgradeReply: "+GO\r\n"},
+		{name: "rejected", upgradeReply: "-NO tls\r\n", expectedError: ErrStartTLSNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &dryRunConn{respond: func(command string) string {
+				if command == "FEATURES" {
+					return "250-one\r\n250-two\r\n250 end\r\n"
+				}
+
+				return tt.upgradeReply
+			}}
+			conn.replies.WriteString("* noise\r\n+READY appliance\r\n")
+
+			p := &applianceProtocol{BaseProtocol: NewBaseProtocol("appliance", "UPGRADE")}
+
+			result, err := NegotiateWithProtocol(context.Background(), conn, p)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, got %v", tt.expectedError, err)
+			}
+
+			if tt.expectedError != nil {
+				return
+			}
+
+			if result.Protocol != "appliance" || result.Banner != "+READY appliance" || result.UpgradeCommand != "UPGRADE" {
+				t.Errorf("Unexpected result: %+v", result)
+			}
+
+			if strings.Join(p.features, "|") != "250-one|250-two|250 end" {
+				t.Errorf("Expected the multiline reply, got %q", p.features)
+			}
+
+			if len(result.Timings) != 3 || result.Timings[1].Step != StepCapabilities {
+				t.Errorf("Expected three timings, got %+v", result.Timings)
+			}
+
+			if string(conn.sent[0]) != "FEATURES\r\n" || string(conn.sent[1]) != "UPGRADE\r\n" {
+				t.Errorf("Expected CRLF-terminated commands, got %q", conn.sent)
+			}
+		})
+	}
+}
+
+func TestFinalReplyLine(t *testing.T) {
+	tests := map[string]bool{
+		"250 ok":   true,
+		"250":      true,
+		"250-more": false,
+		"abc def":  false,
+		"25":       false,
+		"":         false,
+	}
+
+	for line, expected := range tests {
+		if got := FinalReplyLine(line); got != expected {
+			t.Errorf("FinalReplyLine(%q) = %v, expected %v", line, got, expected)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package starttls
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+)
+
+// RegisterCandidates assigns several protocols to port, to be tried in order
+// by NegotiateCandidates and Client for ports where more than one protocol is
+// common, such as SMTP and then LMTP. The first protocol is the one StartTLS
+// and Negotiate use for port, as if assigned with Register. Calling it
+// without names removes port, which is then treated like any unknown port.
+// The names need not be registered yet; an unregistered name is skipped
+// without dialing, and fails with ErrUnknownProtocol only as the last
+// candidate.
+func RegisterCandidates(port string, names ...ProtocolID) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if len(names) == 0 {
+		delete(registry.byPort, port)
+		delete(registry.candidates, port)
+
+		return
+	}
+
+	lower := make([]ProtocolID, len(names))
+	for i, name := range names {
+		lower[i] = ProtocolID(strings.ToLower(string(name)))
+	}
+
+	registry.byPort[port] = lower[0]
+	registry.candidates[port] = lower
+}
+
+// candidates returns the protocols registered with RegisterCandidates for
+// port, or nil when Negotiate alone decides, because port has a single
+// protocol, is mapped by cfg or is a direct TLS port.
+func candidates(cfg *config, port string) []ProtocolID {
+	if _, mapped := cfg.portMap[port]; mapped || isDirectTLS(cfg, port) {
+		return nil
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if len(registry.candidates[port]) < 2 {
+		return nil
+	}
+
+	return slices.Clone(registry.candidates[port])
+}
+
+// NegotiateCandidates connects with dial and negotiates the protocol
+// registered for port, trying the candidates of RegisterCandidates in order.
+// A failed attempt leaves the session in an unknown state, so its connection
+// is closed and the next candidate is tried on a new one. The next candidate
+// is not tried when the server rejected STARTTLS, as the protocol then
+// matched, or when ctx is done.
+//
+// On success it returns the connection, ready for the TLS handshake as after
+// Negotiate, and the result. On failure the connection is closed, and the
+// result and error are those of the last attempt. For ports without
+// candidates it is Negotiate on a connection from dial.
+func NegotiateCandidates[P Port](ctx context.Context, dial func(context.Context) (net.Conn, error), p P, opts ...Option) (net.Conn, *StartTLSResult, error) {
+	cfg := newConfig(opts)
+	result := &StartTLSResult{}
+
+	port, err := servicePort(cfg, portString(p))
+	if err != nil {
+		return nil, result, err
+	}
+
+	names := candidates(cfg, port)
+	if names == nil {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, result, err
+		}
+
+		result, err = Negotiate(ctx, conn, port, opts...)
+		if err != nil {
+			conn.Close()
+
+			return nil, result, err
+		}
+
+		return conn, result, nil
+	}
+
+	for _, name := range names {
+		var protocol StartTLSProtocol
+
+		protocol, err = Protocol(name)
+		if err != nil {
+			continue
+		}
+
+		var conn net.Conn
+
+		conn, err = dial(ctx)
+		if err != nil {
+			return nil, result, err
+		}
+
+		result, err = NegotiateWithProtocol(ctx, conn, protocol, opts...)
+		if err == nil {
+			return conn, result, nil
+		}
+
+		conn.Close()
+
+		if errors.Is(err, ErrStartTLSNotSupported) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, result, err
+}
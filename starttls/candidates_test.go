@@ -0,0 +1,220 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveSessions answers the connections to a localhost listener in turn,
+// each with the greeting and then the replies of the next session, one per
+// command line. It returns the dial function and the commands received per
+// session.
+func serveSessions(t *testing.T, greeting string, sessions [][]string) (func(context.Context) (net.Conn, error), func() [][]string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+
+	received := make([][]string, len(sessions))
+
+	go func() {
+		for i, replies := range sessions {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte(greeting))
+
+			r := bufio.NewReader(conn)
+			for _, reply := range replies {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+
+				mu.Lock()
+				received[i] = append(received[i], strings.TrimSpace(line))
+				mu.Unlock()
+
+				_, _ = conn.Write([]byte(reply))
+			}
+
+			_, _ = io.Copy(io.Discard, r)
+			conn.Close()
+		}
+	}()
+
+	dialer := &net.Dialer{}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	}
+
+	return dial, func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return received
+	}
+}
+
+func TestNegotiateCandidates(t *testing.T) {
+	RegisterCandidates("10024", ProtocolSMTP, ProtocolLMTP)
+	t.Cleanup(func() { RegisterCandidates("10024") })
+
+	tests := []struct {
+		name      string
+		sessions  [][]string
+		expectErr error
+		expected  ProtocolID
+		dials     int
+	}{
+		{
+			name: "falls back to lmtp",
+			sessions: [][]string{
+				{"500 5.5.1 unrecognized command\r\n"},
+				{"250-lmtp.test\r\n250 STARTTLS\r\n", "220 ready for TLS\r\n"},
+			},
+			expected: ProtocolLMTP,
+			dials:    2,
+		},
+		{
+			name:     "first candidate",
+			sessions: [][]string{{serverMessagesSMTP, "220 ready for TLS\r\n"}},
+			expected: ProtocolSMTP,
+			dials:    1,
+		},
+		{
+			name:      "no fallback after rejection",
+			sessions:  [][]string{{serverMessagesSMTP, "454 4.7.0 TLS not available\r\n"}},
+			expectErr: ErrStartTLSNotSupported,
+			expected:  ProtocolSMTP,
+			dials:     1,
+		},
+		{
+			name: "all candidates fail",
+			sessions: [][]string{
+				{"500 5.5.1 unrecognized command\r\n"},
+				{"500 5.5.1 unrecognized command\r\n"},
+			},
+			expectErr: ErrInvalidResponse,
+			expected:  ProtocolLMTP,
+			dials:     2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			dial, received := serveSessions(t, serverMessagesStart, tt.sessions)
+
+			conn, result, err := NegotiateCandidates(ctx, dial, 10024)
+			if tt.expectErr != nil {
+				if !errors.Is(err, tt.expectErr) || conn != nil {
+					t.Fatalf("Expected %v and no connection, got %v, %v", tt.expectErr, conn, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				conn.Close()
+			}
+
+			if result.Protocol != tt.expected {
+				t.Errorf("Expected protocol %q, got %q", tt.expected, result.Protocol)
+			}
+
+			dials := 0
+			for _, commands := range received() {
+				if len(commands) > 0 {
+					dials++
+				}
+			}
+
+			if dials != tt.dials {
+				t.Errorf("Expected %d connections, got %d: %q", tt.dials, dials, received())
+			}
+		})
+	}
+}
+
+func TestNegotiateCandidatesUnregistered(t *testing.T) {
+	RegisterCandidates("10026", "unregistered", ProtocolSMTP)
+	t.Cleanup(func() { RegisterCandidates("10026") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	dial, received := serveSessions(t, serverMessagesStart, [][]string{{serverMessagesSMTP, "220 ready for TLS\r\n"}})
+
+	conn, result, err := NegotiateCandidates(ctx, dial, 10026)
+	if err != nil {
+		t.Fatalf("Expected the unregistered candidate to be skipped, got %v", err)
+	}
+
+	conn.Close()
+
+	if result.Protocol != ProtocolSMTP || len(received()) != 1 {
+		t.Errorf("Expected smtp on a single connection, got %q on %q", result.Protocol, received())
+	}
+
+	RegisterCandidates("10026", ProtocolSMTP, "unregistered")
+
+	dial, _ = serveSessions(t, serverMessagesStart, [][]string{{"500 5.5.1 unrecognized command\r\n"}})
+
+	_, _, err = NegotiateCandidates(ctx, dial, 10026)
+	if !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol from the last candidate, got %v", err)
+	}
+}
+
+func TestRegisterCandidates(t *testing.T) {
+	RegisterCandidates("10025", "SMTP", ProtocolLMTP)
+	t.Cleanup(func() { RegisterCandidates("10025") })
+
+	p, mode, err := LookupProtocol("10025")
+	if err != nil || mode != TLSModeSTARTTLS || p.Name() != "smtp" {
+		t.Fatalf("Expected the first candidate for plain lookups, got %v, %v, %v", p, mode, err)
+	}
+
+	if names := candidates(newConfig(nil), "10025"); len(names) != 2 || names[1] != ProtocolLMTP {
+		t.Errorf("Expected smtp and lmtp, got %q", names)
+	}
+
+	if candidates(newConfig([]Option{WithPortMap(map[string]ProtocolID{"10025": ProtocolIMAP})}), "10025") != nil {
+		t.Error("Expected the port map to override the candidates")
+	}
+
+	// Unregistering the first candidate hands the port to the next.
+	Register("smtp-alt", nil, func() StartTLSProtocol { return newSMTPProtocol() })
+	RegisterCandidates("10025", "smtp-alt", ProtocolLMTP)
+	Unregister("smtp-alt")
+
+	p, _, _ = LookupProtocol("10025")
+	if p == nil || p.Name() != "lmtp" {
+		t.Errorf("Expected lmtp after unregistering the first candidate, got %v", p)
+	}
+
+	RegisterCandidates("10025")
+
+	_, mode, _ = LookupProtocol("10025")
+	if mode != TLSModeUnknown {
+		t.Errorf("Expected the port to be removed, got %v", mode)
+	}
+}
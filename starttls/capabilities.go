@@ -0,0 +1,58 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// capabilityRequester is implemented by protocols that can list their
+// capabilities again once TLS is established.
+type capabilityRequester interface {
+	requestPostTLSCapabilities(ctx context.Context, rw *bufio.ReadWriter) error
+}
+
+// PostTLSCapabilities re-issues the capability command of the protocol
+// negotiated (EHLO or LHLO, CAPABILITY, CAPA or FEAT) on conn, which must be
+// the connection after the TLS handshake, typically the *tls.Conn wrapping
+// the connection passed to Negotiate. RFC 3207 and RFC 3501 require clients
+// to discard what was learned before TLS, and servers often advertise more,
+// such as AUTH mechanisms, once the session is protected.
+//
+// negotiated is the result of Negotiate on the same connection. IMAP tags
+// continue its numbering, as they must be unique within the session; pass
+// the options given to Negotiate so that WithIMAPTagPrefix applies too.
+//
+// The returned result has Protocol, Capabilities and Details set in the same
+// form Negotiate reports them before TLS, so the two can be compared.
+func PostTLSCapabilities(ctx context.Context, conn io.ReadWriter, negotiated *StartTLSResult, opts ...Option) (*StartTLSResult, error) {
+	if negotiated == nil || negotiated.Protocol == "" {
+		return nil, errors.New("no STARTTLS protocol was negotiated")
+	}
+
+	protocol, err := Protocol(negotiated.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	requester, ok := protocol.(capabilityRequester)
+	if !ok {
+		return nil, fmt.Errorf("%s: listing capabilities after TLS is not supported", protocol.Name())
+	}
+
+	result := &StartTLSResult{Protocol: ProtocolID(protocol.Name()), imapTags: negotiated.imapTags}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	err = requester.requestPostTLSCapabilities(withSession(ctx, &session{cfg: newConfig(opts), result: result}), rw)
+
+	// Later commands on the connection continue from the tags used here.
+	negotiated.imapTags = result.imapTags
+
+	if err != nil {
+		return result, fmt.Errorf("%s: post-TLS capabilities failed: %w", protocol.Name(), err)
+	}
+
+	return result, nil
+}
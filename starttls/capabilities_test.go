@@ -0,0 +1,161 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostTLSCapabilities(t *testing.T) {
+	tests := []struct {
+		name                 string
+		negotiated           *StartTLSResult
+		opts                 []Option
+		reply                string
+		expectedCommand      string
+		expectedCapabilities []string
+	}{
+		{
+			name:                 "smtp",
+			negotiated:           &StartTLSResult{Protocol: ProtocolSMTP},
+			reply:                "250-mail.test\r\n250-AUTH PLAIN LOGIN\r\n250 SIZE 35882577\r\n",
+			expectedCommand:      "EHLO tlstools.com",
+			expectedCapabilities: []string{"AUTH PLAIN LOGIN", "SIZE 35882577"},
+		},
+		{
+			name:                 "imap",
+			negotiated:           &StartTLSResult{Protocol: ProtocolIMAP, imapTags: 2},
+			reply:                "* CAPABILITY IMAP4rev1 AUTH=PLAIN\r\na003 OK done\r\n",
+			expectedCommand:      "a003 CAPABILITY",
+			expectedCapabilities: []string{"IMAP4rev1", "AUTH=PLAIN"},
+		},
+		{
+			name:                 "imap tag prefix",
+			negotiated:           &StartTLSResult{Protocol: ProtocolIMAP, imapTags: 1},
+			opts:                 []Option{WithIMAPTagPrefix("scan")},
+			reply:                "* CAPABILITY IMAP4rev1\r\nscan002 OK done\r\n",
+			expectedCommand:      "scan002 CAPABILITY",
+			expectedCapabilities: []string{"IMAP4rev1"},
+		},
+		{
+			name:                 "pop3",
+			negotiated:           &StartTLSResult{Protocol: ProtocolPOP3},
+			reply:                "+OK\r\nUSER\r\nSASL PLAIN\r\n.\r\n",
+			expectedCommand:      "CAPA",
+			expectedCapabilities: []string{"USER", "SASL PLAIN"},
+		},
+		{
+			name:                 "ftp",
+			negotiated:           &StartTLSResult{Protocol: ProtocolFTP},
+			reply:                "211-Features:\r\n PBSZ\r\n PROT\r\n211 End\r\n",
+			expectedCommand:      "FEAT",
+			expectedCapabilities: []string{"PBSZ", "PROT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, result, err := postTLSCapabilitiesWithServer(t, func(string) string { return tt.reply }, tt.negotiated, tt.opts...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if command != tt.expectedCommand {
+				t.Errorf("Expected command %q, got %q", tt.expectedCommand, command)
+			}
+
+			if strings.Join(result.Capabilities, ",") != strings.Join(tt.expectedCapabilities, ",") {
+				t.Errorf("Expected capabilities %q, got %q", tt.expectedCapabilities, result.Capabilities)
+			}
+
+			if result.Details == nil {
+				t.Error("Expected details to be set")
+			}
+		})
+	}
+}
+
+// postTLSCapabilitiesWithServer runs PostTLSCapabilities over TLS against a
+// server answering the command with reply and returns the command received.
+func postTLSCapabilitiesWithServer(t *testing.T, reply func(command string) string, negotiated *StartTLSResult, opts ...Option) (string, *StartTLSResult, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var command string
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer server.Close()
+
+		conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		command = strings.TrimSpace(line)
+		_, _ = conn.Write([]byte(reply(command)))
+	}()
+
+	conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+
+	result, err := PostTLSCapabilities(ctx, conn, negotiated, opts...)
+
+	client.Close()
+	<-done
+
+	return command, result, err
+}
+
+func TestPostTLSCapabilitiesUnsupported(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	for _, negotiated := range []*StartTLSResult{nil, {}, {Protocol: ProtocolMySQL}, {Protocol: "unregistered"}} {
+		_, err := PostTLSCapabilities(context.Background(), client, negotiated)
+		if err == nil {
+			t.Errorf("Expected an error for %+v", negotiated)
+		}
+	}
+}
+
+func TestPostTLSCapabilitiesContinuesIMAPTags(t *testing.T) {
+	negotiated, err := negotiateWithServer(t, "143", []string{
+		"* OK ready\r\n",
+		"* CAPABILITY IMAP4rev1 STARTTLS\r\na001 OK done\r\n",
+		"a002 OK Begin TLS negotiation now\r\n",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{"a003 CAPABILITY", "a004 CAPABILITY"} {
+		var command string
+
+		command, _, err = postTLSCapabilitiesWithServer(t, func(command string) string {
+			tag, _, _ := strings.Cut(command, " ")
+
+			return "* CAPABILITY IMAP4rev1 AUTH=PLAIN\r\n" + tag + " OK done\r\n"
+		}, negotiated)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if command != expected {
+			t.Errorf("Expected %q after TLS, got %q", expected, command)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package starttls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// ErrClientConnected is returned by Client.Connect when the client already
+// holds a connection.
+var ErrClientConnected = errors.New("client already connected")
+
+// Client dials a server, negotiates STARTTLS for the protocol registered
+// for the port and runs the TLS handshake, for applications that just need
+// a secured connection. A Client holds one connection at a time and is not
+// safe for concurrent use.
+type Client struct {
+	config *tls.Config
+	opts   []Option
+
+	result  *StartTLSResult
+	tlsConn *tls.Conn
+}
+
+// NewClient returns a Client that upgrades with config and passes opts to
+// Negotiate. A nil config uses RecommendedTLSConfig for the negotiated
+// protocol; a config without ServerName verifies the host of the address
+// given to Connect.
+func NewClient(config *tls.Config, opts ...Option) *Client {
+	return &Client{
+		config: config,
+		opts:   opts,
+	}
+}
+
+// Connect dials addr ("host:port") over TCP and upgrades the connection to
+// TLS as UpgradeTLS would. For a port with candidates from
+// RegisterCandidates, each is tried on a new connection as by
+// NegotiateCandidates. On failure the connection is closed and Result still
+// reports how far the negotiation got.
+func (c *Client) Connect(ctx context.Context, addr string) error {
+	if c.tlsConn != nil {
+		return ErrClientConnected
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{}
+
+	conn, result, err := NegotiateCandidates(ctx, func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}, port, c.opts...)
+	c.result = result
+
+	if err != nil {
+		return err
+	}
+
+	tlsConn, err := handshakeTLS(ctx, conn, c.result, c.tlsConfig(host))
+	if err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	c.tlsConn = tlsConn
+
+	return nil
+}
+
+// tlsConfig returns the config for the handshake with host.
+func (c *Client) tlsConfig(host string) *tls.Config {
+	if c.config == nil {
+		return RecommendedTLSConfig(c.result.Protocol, host)
+	}
+
+	if c.config.ServerName != "" || c.config.InsecureSkipVerify {
+		return c.config
+	}
+
+	config := c.config.Clone()
+	config.ServerName = host
+
+	return config
+}
+
+// Result returns the result of the last negotiation, or nil before Connect.
+func (c *Client) Result() *StartTLSResult {
+	return c.result
+}
+
+// TLSConn returns the TLS connection, or nil when the client is not
+// connected.
+func (c *Client) TLSConn() *tls.Conn {
+	return c.tlsConn
+}
+
+// Close ends the session with the quit command of the protocol over TLS, as
+// CloseGracefully does with the options of the client, then shuts the TLS
+// session down with a close_notify alert and closes the connection. The
+// client can then Connect again. Closing a client that is not connected does
+// nothing.
+func (c *Client) Close() error {
+	if c.tlsConn == nil {
+		return nil
+	}
+
+	err := CloseGracefully(context.Background(), c.tlsConn, c.result, c.opts...)
+	c.tlsConn = nil
+
+	return err
+}
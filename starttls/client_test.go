@@ -0,0 +1,180 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startClientTestServer serves one SMTP session on localhost answering
+// STARTTLS with upgradeReply, then echoes lines over TLS with cert until
+// QUIT, which it answers with 221. It returns the address, the port map for
+// it and a channel closed when QUIT is received over TLS.
+func startClientTestServer(t *testing.T, cert tls.Certificate, upgradeReply string) (string, Option, <-chan struct{}) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	quit := make(chan struct{})
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+
+		for i, reply := range []string{serverMessagesStart, serverMessagesSMTP, upgradeReply} {
+			if i > 0 {
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+
+			_, _ = conn.Write([]byte(reply))
+		}
+
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		tlsReader := bufio.NewReader(tlsConn)
+
+		for {
+			line, err := tlsReader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if line == "QUIT\r\n" {
+				close(quit)
+				_, _ = tlsConn.Write([]byte("221 2.0.0 Bye\r\n"))
+
+				return
+			}
+
+			_, _ = tlsConn.Write([]byte(line))
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	return net.JoinHostPort("localhost", port), WithPortMap(map[string]ProtocolID{port: "smtp"}), quit
+}
+
+func TestClient(t *testing.T) {
+	cert := newTestCertificate(t)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	addr, portMap, quit := startClientTestServer(t, cert, "220 ready for TLS\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// Without ServerName the certificate is verified for the dialed host.
+	client := NewClient(&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}, portMap)
+
+	if client.Result() != nil || client.TLSConn() != nil {
+		t.Error("Expected no result and connection before Connect")
+	}
+
+	err = client.Connect(ctx, addr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if client.Result().Protocol != "smtp" || !client.Result().TLSEstablished {
+		t.Errorf("Unexpected result: %+v", client.Result())
+	}
+
+	_, err = client.TLSConn().Write([]byte("ping\r\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	echo, err := bufio.NewReader(client.TLSConn()).ReadString('\n')
+	if err != nil || echo != "ping\r\n" {
+		t.Errorf("Expected the echo, got %q, %v", echo, err)
+	}
+
+	err = client.Connect(ctx, addr)
+	if !errors.Is(err, ErrClientConnected) {
+		t.Errorf("Expected ErrClientConnected, got %v", err)
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if client.TLSConn() != nil {
+		t.Error("Expected no connection after Close")
+	}
+
+	select {
+	case <-quit:
+	default:
+		t.Error("Expected Close to send QUIT over TLS")
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Errorf("Expected a second Close to do nothing, got %v", err)
+	}
+}
+
+func TestClientRejected(t *testing.T) {
+	addr, portMap, _ := startClientTestServer(t, newTestCertificate(t), "454 4.7.0 TLS not available\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client := NewClient(nil, portMap)
+
+	err := client.Connect(ctx, addr)
+	if !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Fatalf("Expected ErrStartTLSNotSupported, got %v", err)
+	}
+
+	if client.TLSConn() != nil {
+		t.Error("Expected no connection after a failure")
+	}
+
+	if client.Result() == nil || client.Result().Protocol != "smtp" {
+		t.Errorf("Expected the result of the failed negotiation, got %+v", client.Result())
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	client := NewClient(nil)
+	client.result = &StartTLSResult{Protocol: "imap"}
+
+	config := client.tlsConfig("mail.example.com")
+	if config.ServerName != "mail.example.com" || len(config.NextProtos) != 1 || config.NextProtos[0] != "imap" {
+		t.Errorf("Expected the recommended IMAP config, got %+v", config)
+	}
+
+	custom := &tls.Config{ServerName: "other.example.com", MinVersion: tls.VersionTLS13}
+	client = NewClient(custom)
+	client.result = &StartTLSResult{Protocol: "smtp"}
+
+	if client.tlsConfig("mail.example.com") != custom {
+		t.Error("Expected a config with ServerName to be used as is")
+	}
+}
@@ -0,0 +1,72 @@
+package starttls
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Clock is the source of time for a negotiation: the step timeouts of
+// WithStepTimeout, the waits of WithRejectionObservation and
+// WithGracefulQuit, and the durations reported in StartTLSResult. Tests can
+// pass a fake Clock with WithClock to exercise timeouts deterministically
+// instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed, unless
+	// the returned timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing, reporting whether it did so.
+	Stop() bool
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// now returns the current time of the clock of the session in ctx.
+func now(ctx context.Context) time.Time {
+	return sessionFromContext(ctx).cfg.clock.Now()
+}
+
+// withTimeout is context.WithTimeout on clock.
+func withTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok {
+		return context.WithTimeout(ctx, d)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := clock.AfterFunc(d, func() { cancel(context.DeadlineExceeded) })
+
+	return clockContext{ctx}, func() {
+		timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// clockContext is a context canceled by a Clock timer. Like a context from
+// context.WithTimeout, its Err is context.DeadlineExceeded once the timer
+// fired.
+type clockContext struct {
+	context.Context
+}
+
+func (c clockContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && errors.Is(context.Cause(c.Context), context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
@@ -0,0 +1,154 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves with advance. Each AfterFunc
+// call is announced on started.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	started chan struct{}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), started: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	c.started <- struct{}{}
+
+	return t
+}
+
+// advance moves the time forward by d and fires the timers that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+
+	var due []*fakeTimer
+
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+
+	c.timers = pending
+	c.mu.Unlock()
+
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestClockStepTimeout(t *testing.T) {
+	clock := newFakeClock()
+
+	go func() {
+		<-clock.started
+		clock.advance(time.Minute)
+	}()
+
+	// The server never greets; only the fake clock ends the wait.
+	result, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	}, WithClock(clock), WithStepTimeout(StepGreeting, time.Minute))
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	var negErr *NegotiationError
+	if !errors.As(err, &negErr) || negErr.Step != StepGreeting {
+		t.Errorf("Expected a NegotiationError at the greeting, got %v", err)
+	}
+
+	if result.Duration != time.Minute {
+		t.Errorf("Expected a duration of one minute on the fake clock, got %v", result.Duration)
+	}
+}
+
+func TestClockRejectionObservation(t *testing.T) {
+	clock := newFakeClock()
+
+	go func() {
+		<-clock.started
+		clock.advance(time.Hour)
+	}()
+
+	// The server rejects STARTTLS, then ignores the NOOP without closing.
+	result, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+		_, _ = conn.Write([]byte(serverMessagesStart))
+
+		r := bufio.NewReader(conn)
+		for _, reply := range []string{serverMessagesSMTP, "454 4.7.0 TLS not available\r\n"} {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte(reply))
+		}
+
+		_, _ = io.Copy(io.Discard, r)
+	}, WithClock(clock), WithRejectionObservation(time.Hour))
+
+	if !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Fatalf("Expected ErrStartTLSNotSupported, got %v", err)
+	}
+
+	if result.RejectionBehavior != RejectionHang {
+		t.Errorf("Expected RejectionHang, got %v", result.RejectionBehavior)
+	}
+
+	for _, timing := range result.Timings {
+		if timing.Duration != 0 {
+			t.Errorf("Expected no time to pass in step %s on the fake clock, got %v", timing.Step, timing.Duration)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+)
+
+// CloseGracefully ends the session described by result before closing conn,
+// so that servers log a clean disconnect instead of a dropped connection,
+// which matters during large scans. It sends the quit command of the
+// protocol (QUIT for SMTP, LMTP, POP3 and FTP, LOGOUT for IMAP) and waits up
+// to a second, or until ctx is done, for the server's goodbye.
+//
+// conn is the connection the session continues on: the *tls.Conn (or
+// upgraded *Conn) after a successful upgrade, or the plaintext connection
+// when STARTTLS was not established. When result reports an upgrade but conn
+// has not completed a TLS handshake, the server expects one, so conn is
+// closed without a quit command, as it is for protocols without one.
+// Errors of the quit exchange are ignored; the error of closing conn is
+// returned.
+func CloseGracefully(ctx context.Context, conn io.ReadWriteCloser, result *StartTLSResult, opts ...Option) error {
+	if result == nil || result.Protocol == "" || (result.TLSEstablished && !tlsHandshakeComplete(conn)) {
+		return conn.Close()
+	}
+
+	protocol, err := Protocol(result.Protocol)
+	if err != nil {
+		return conn.Close()
+	}
+
+	if q, ok := protocol.(quitCommander); ok {
+		cfg := newConfig(opts)
+		sendQuit(ctx, cfg.clock, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), q.quitCommand())
+	}
+
+	return conn.Close()
+}
+
+// tlsHandshakeComplete reports whether conn is a TLS connection whose
+// handshake has completed.
+func tlsHandshakeComplete(conn io.ReadWriteCloser) bool {
+	c, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+
+	return ok && c.ConnectionState().HandshakeComplete
+}
@@ -0,0 +1,80 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseGracefully(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   *StartTLSResult
+		reply    string
+		expected string
+	}{
+		{name: "smtp", result: &StartTLSResult{Protocol: ProtocolSMTP}, reply: "221 bye\r\n", expected: "QUIT\r\n"},
+		{name: "imap", result: &StartTLSResult{Protocol: ProtocolIMAP}, reply: "* BYE logging out\r\n", expected: "a001 LOGOUT\r\n"},
+		{name: "ftp without reply", result: &StartTLSResult{Protocol: ProtocolFTP}, expected: "QUIT\r\n"},
+		{name: "awaiting tls handshake", result: &StartTLSResult{Protocol: ProtocolSMTP, TLSEstablished: true}},
+		{name: "no quit command", result: &StartTLSResult{Protocol: ProtocolLDAP}},
+		{name: "unknown port", result: &StartTLSResult{}},
+		{name: "nil result"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			client, server := net.Pipe()
+			received := make(chan string, 1)
+
+			go func() {
+				defer server.Close()
+
+				r := bufio.NewReader(server)
+
+				line, err := r.ReadString('\n')
+				if err != nil {
+					received <- ""
+
+					return
+				}
+
+				_, _ = server.Write([]byte(tt.reply))
+				_, _ = io.Copy(io.Discard, r)
+				received <- line
+			}()
+
+			// The wait for a goodbye that never comes ends on the fake clock.
+			clock := newFakeClock()
+
+			go func() {
+				select {
+				case <-clock.started:
+					clock.advance(time.Second)
+				case <-ctx.Done():
+				}
+			}()
+
+			err := CloseGracefully(ctx, client, tt.result, WithClock(clock))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if line := <-received; line != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, line)
+			}
+
+			_, err = client.Write([]byte("x"))
+			if err == nil || !strings.Contains(err.Error(), "closed") {
+				t.Errorf("Expected the connection to be closed, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package starttls
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is a net.Conn that negotiates STARTTLS and runs the TLS client
+// handshake on its first Read or Write, so it can be handed to libraries
+// that only accept an established connection. Deadlines set on the Conn
+// also bound the negotiation; call Handshake to run it with a context
+// instead. A failed upgrade is returned by every later Read and Write.
+type Conn struct {
+	conn   net.Conn
+	port   string
+	config *tls.Config
+	opts   []Option
+
+	// mu serializes the upgrade. tlsConn is set once it succeeded and can
+	// be read without mu, so that Close does not wait for a stuck upgrade.
+	mu      sync.Mutex
+	err     error
+	tlsConn atomic.Pointer[tls.Conn]
+}
+
+// NewConn returns a Conn that upgrades conn as UpgradeTLS would, for the
+// protocol registered for port, with config and opts.
+func NewConn[P Port](conn net.Conn, port P, config *tls.Config, opts ...Option) *Conn {
+	return &Conn{
+		conn:   conn,
+		port:   portString(port),
+		config: config,
+		opts:   opts,
+	}
+}
+
+// Handshake upgrades the connection unless that has already been done or
+// attempted, and returns the outcome of the upgrade.
+func (c *Conn) Handshake(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tlsConn.Load() == nil && c.err == nil {
+		var tlsConn *tls.Conn
+
+		tlsConn, c.err = UpgradeTLS(ctx, c.conn, c.port, c.config, c.opts...)
+		c.tlsConn.Store(tlsConn)
+	}
+
+	return c.err
+}
+
+// Read upgrades the connection if needed and reads from the TLS session.
+func (c *Conn) Read(b []byte) (int, error) {
+	err := c.Handshake(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	return c.tlsConn.Load().Read(b)
+}
+
+// Write upgrades the connection if needed and writes to the TLS session.
+func (c *Conn) Write(b []byte) (int, error) {
+	err := c.Handshake(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	return c.tlsConn.Load().Write(b)
+}
+
+// Close closes the TLS session, sending a close_notify alert, or the
+// underlying connection when it was not upgraded. Closing during the
+// upgrade makes it fail.
+func (c *Conn) Close() error {
+	if tlsConn := c.tlsConn.Load(); tlsConn != nil {
+		return tlsConn.Close()
+	}
+
+	return c.conn.Close()
+}
+
+// ConnectionState returns the state of the TLS session, which is the zero
+// value before the upgrade.
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	tlsConn := c.tlsConn.Load()
+	if tlsConn == nil {
+		return tls.ConnectionState{}
+	}
+
+	return tlsConn.ConnectionState()
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the underlying
+// connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,92 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+
+		r := bufio.NewReader(server)
+
+		for i, reply := range []string{serverMessagesStart, serverMessagesSMTP, "220 ready for TLS\r\n"} {
+			if i > 0 {
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+
+			_, _ = server.Write([]byte(reply))
+		}
+
+		// Echo over TLS.
+		conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn := NewConn(client, "25", &tls.Config{InsecureSkipVerify: true})
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if conn.ConnectionState().HandshakeComplete {
+		t.Error("Expected no TLS session before the first write")
+	}
+
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	buf := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the echo, got %q, %v", buf, err)
+	}
+
+	if !conn.ConnectionState().HandshakeComplete {
+		t.Error("Expected a completed TLS handshake")
+	}
+}
+
+func TestConnUpgradeFailure(t *testing.T) {
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+
+		_, _ = server.Write([]byte(serverMessagesStart))
+		_, _ = bufio.NewReader(server).ReadString('\n')
+		_, _ = server.Write([]byte(serverMessagesSMTPNoTLS))
+	}()
+
+	conn := NewConn(client, "25", &tls.Config{InsecureSkipVerify: true})
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := conn.Handshake(ctx)
+	if !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Errorf("Expected the upgrade error from Read, got: %v", err)
+	}
+
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Errorf("Expected the upgrade error from Write, got: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package starttls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrProtocolNotDetected is returned in auto-detect mode when the server sent
+// a greeting that does not match any known protocol.
+var ErrProtocolNotDetected = errors.New("protocol not detected from server greeting")
+
+// maxDetectBytes bounds how much of the greeting is inspected.
+const maxDetectBytes = 512
+
+// readDeadliner is implemented by connections whose reads can be bounded
+// by a deadline, such as net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// detectProtocol peeks at the server greeting without consuming it and returns
+// the factory of the protocol it belongs to. It returns nil without error
+// when the server stays silent for wait, which is what direct TLS servers and
+// client-first protocols do.
+func detectProtocol(ctx context.Context, conn io.ReadWriter, r *bufio.Reader, wait time.Duration) (func() StartTLSProtocol, error) {
+	deadliner, ok := conn.(readDeadliner)
+	if !ok {
+		return nil, errors.New("auto-detect requires a connection that supports SetReadDeadline")
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	// A read deadline rather than an abandoned goroutine bounds the wait, so
+	// no reader is left behind to steal bytes from the TLS handshake.
+	err := deadliner.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
+	banner, err := peekGreeting(r)
+
+	resetErr := deadliner.SetReadDeadline(time.Time{})
+	if resetErr != nil {
+		return nil, fmt.Errorf("failed to reset read deadline: %w", resetErr)
+	}
+
+	var netErr net.Error
+	if len(banner) == 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, ctx.Err()
+	}
+
+	if len(banner) == 0 && err != nil {
+		return nil, err
+	}
+
+	factory := protocolForGreeting(banner)
+	if factory == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProtocolNotDetected, sanitizeResponse(string(banner)))
+	}
+
+	return factory, nil
+}
+
+// peekGreeting returns the buffered greeting up to the first line ending, or
+// the first bytes of a binary greeting, without consuming them.
+func peekGreeting(r *bufio.Reader) ([]byte, error) {
+	n := 1
+
+	for {
+		banner, err := r.Peek(n)
+		if err != nil {
+			return banner, err
+		}
+
+		if isMySQLGreeting(banner) || bytes.IndexByte(banner, '\n') >= 0 || n >= maxDetectBytes {
+			return banner, nil
+		}
+
+		n = min(max(r.Buffered(), n+1), maxDetectBytes)
+	}
+}
+
+// isMySQLGreeting reports whether banner starts with a MySQL packet header
+// carrying sequence number 0 and protocol version 10.
+func isMySQLGreeting(banner []byte) bool {
+	return len(banner) >= 5 && banner[3] == 0 && banner[4] == mysqlProtocolVersion
+}
+
+// protocolForGreeting infers the protocol from the start of its greeting.
+func protocolForGreeting(banner []byte) func() StartTLSProtocol {
+	upper := bytes.ToUpper(banner)
+
+	switch {
+	case isMySQLGreeting(banner):
+		return func() StartTLSProtocol { return newMySQLProtocol() }
+	case bytes.HasPrefix(upper, []byte("* OK")), bytes.HasPrefix(upper, []byte("* PREAUTH")):
+		return func() StartTLSProtocol { return newIMAPProtocol() }
+	case bytes.HasPrefix(upper, []byte("+OK")):
+		return func() StartTLSProtocol { return newPOP3Protocol() }
+	case bytes.HasPrefix(upper, []byte("INFO {")):
+		return func() StartTLSProtocol { return newNATSProtocol() }
+	case bytes.HasPrefix(upper, []byte("220")) && bytes.Contains(upper, []byte("SMTP")):
+		return func() StartTLSProtocol { return newSMTPProtocol() }
+	case bytes.HasPrefix(upper, []byte("220")) && bytes.Contains(upper, []byte("FTP")):
+		return func() StartTLSProtocol { return newFTPProtocol() }
+	case bytes.HasPrefix(upper, []byte("220")):
+		// SMTP and FTP share the 220 greeting; SMTP is far more common on
+		// non-standard ports.
+		return func() StartTLSProtocol { return newSMTPProtocol() }
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,93 @@
+package starttls
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProtocolForGreeting(t *testing.T) {
+	tests := []struct {
+		banner   string
+		expected string
+	}{
+		{banner: "220 mail.test ESMTP Postfix\r\n", expected: "smtp"},
+		{banner: "220-mail.test ESMTP\r\n", expected: "smtp"},
+		{banner: "220 ProFTPD Server ready\r\n", expected: "ftp"},
+		{banner: "220 ready\r\n", expected: "smtp"},
+		{banner: "* OK [CAPABILITY IMAP4rev1] ready\r\n", expected: "imap"},
+		{banner: "* PREAUTH ready\r\n", expected: "imap"},
+		{banner: "+OK POP3 ready\r\n", expected: "pop3"},
+		{banner: "INFO {\"server_id\":\"x\"}\r\n", expected: "nats"},
+		{banner: "SSH-2.0-OpenSSH_9.6\r\n", expected: ""},
+	}
+
+	for _, tt := range tests {
+		factory := protocolForGreeting([]byte(tt.banner))
+
+		name := ""
+		if factory != nil {
+			name = factory().Name()
+		}
+
+		if name != tt.expected {
+			t.Errorf("Banner %q: expected %q, got %q", tt.banner, tt.expected, name)
+		}
+	}
+
+	mysql := append([]byte{0x4a, 0x00, 0x00, 0x00}, mysqlHandshakeBody("8.0.36", clientSSL, 0)...)
+	if factory := protocolForGreeting(mysql); factory == nil || factory().Name() != "mysql" {
+		t.Error("Expected MySQL handshake to be detected")
+	}
+}
+
+func TestAutoDetect(t *testing.T) {
+	t.Run("ftp on unknown port", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "12121", []string{
+			"220 ProFTPD Server ready\r\n",
+			serverMessagesFTP,
+		}, WithAutoDetect(time.Second))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if result.Protocol != "ftp" || !result.TLSEstablished {
+			t.Errorf("Expected ftp negotiation, got %+v", result)
+		}
+	})
+
+	t.Run("unrecognized greeting", func(t *testing.T) {
+		_, err := negotiateWithServer(t, "12222", []string{"SSH-2.0-OpenSSH_9.6\r\n"}, WithAutoDetect(time.Second))
+		if !errors.Is(err, ErrProtocolNotDetected) {
+			t.Fatalf("Expected ErrProtocolNotDetected, got: %v", err)
+		}
+	})
+
+	t.Run("silent server", func(t *testing.T) {
+		start := time.Now()
+
+		result, err := negotiateWithHandler(t, "12323", func(conn net.Conn) {
+			io.Copy(io.Discard, conn)
+		}, WithAutoDetect(100*time.Millisecond))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if result.Protocol != "" {
+			t.Errorf("Expected no protocol, got %q", result.Protocol)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Detection waited too long: %v", elapsed)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "12121", []string{"220 ProFTPD Server ready\r\n"})
+		if err != nil || result.Protocol != "" {
+			t.Errorf("Expected no negotiation, got %+v, %v", result, err)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package starttls
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DryRun returns the bytes the client sends when negotiating the protocol
+// registered under name, one element per write, without touching the
+// network. The handshake runs against a simulated server that advertises and
+// accepts the upgrade, so opts such as WithSMTPMailAuditPipelining or
+// WithIMAPTagPrefix are reflected. SMTP, LMTP, IMAP, POP3, FTP and MySQL
+// servers are simulated; for other protocols the writes up to the first
+// reply are returned, which is the whole exchange for those where the client
+// speaks first, such as LDAP. It is meant for documentation tooling, IDS
+// signatures and debugging interop problems.
+func DryRun(name ProtocolID, opts ...Option) ([][]byte, error) {
+	factory, err := lookupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := factory()
+	conn := &dryRunConn{}
+
+	switch ProtocolID(protocol.Name()) {
+	case ProtocolSMTP, ProtocolLMTP:
+		conn.replies.WriteString("220 dry-run ESMTP\r\n")
+		conn.respond = dryRunSMTPReply
+	case ProtocolIMAP:
+		conn.replies.WriteString("* OK dry-run ready\r\n")
+		conn.respond = dryRunIMAPReply
+	case ProtocolPOP3:
+		conn.replies.WriteString("+OK dry-run ready\r\n")
+		conn.respond = dryRunPOP3Reply
+	case ProtocolFTP:
+		conn.replies.WriteString("220 dry-run ready\r\n")
+		conn.respond = dryRunFTPReply
+	case ProtocolMySQL:
+		conn.replies.Write(dryRunMySQLHandshake())
+	}
+
+	s := &session{cfg: newConfig(opts), result: &StartTLSResult{}}
+
+	_, err = negotiate(context.Background(), s.readWriter(conn), protocol, s)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return conn.sent, fmt.Errorf("dry run: %w", err)
+	}
+
+	return conn.sent, nil
+}
+
+// dryRunConn records the writes of the client and answers each with the
+// replies of respond. Reads fail with io.EOF once the replies are used up.
+type dryRunConn struct {
+	respond func(command string) string
+	replies bytes.Buffer
+	sent    [][]byte
+}
+
+func (c *dryRunConn) Read(b []byte) (int, error) {
+	return c.replies.Read(b)
+}
+
+func (c *dryRunConn) Write(b []byte) (int, error) {
+	c.sent = append(c.sent, bytes.Clone(b))
+
+	if c.respond != nil {
+		// A write may hold several pipelined commands.
+		for command := range strings.Lines(string(b)) {
+			c.replies.WriteString(c.respond(strings.TrimRight(command, "\r\n")))
+		}
+	}
+
+	return len(b), nil
+}
+
+func dryRunSMTPReply(command string) string {
+	verb, _, _ := strings.Cut(strings.ToUpper(command), " ")
+
+	switch verb {
+	case "EHLO", "LHLO":
+		return "250-dry-run\r\n250-PIPELINING\r\n250 STARTTLS\r\n"
+	case "MAIL":
+		return "530 5.7.0 Must issue a STARTTLS command first\r\n"
+	case "STARTTLS", "X-ANONYMOUSTLS":
+		return "220 Ready to start TLS\r\n"
+	default:
+		return "250 OK\r\n"
+	}
+}
+
+func dryRunIMAPReply(command string) string {
+	tag, rest, _ := strings.Cut(command, " ")
+	verb, _, _ := strings.Cut(strings.ToUpper(rest), " ")
+
+	switch verb {
+	case "CAPABILITY":
+		return "* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED\r\n" + tag + " OK CAPABILITY completed\r\n"
+	case "LOGIN":
+		return tag + " NO [PRIVACYREQUIRED] LOGIN requires TLS\r\n"
+	default:
+		return tag + " OK " + verb + " completed\r\n"
+	}
+}
+
+func dryRunPOP3Reply(command string) string {
+	if strings.EqualFold(command, "CAPA") {
+		return "+OK\r\nSTLS\r\n.\r\n"
+	}
+
+	return "+OK\r\n"
+}
+
+func dryRunFTPReply(command string) string {
+	verb, _, _ := strings.Cut(strings.ToUpper(command), " ")
+
+	switch verb {
+	case "FEAT":
+		return "211-Features:\r\n AUTH TLS\r\n211 End\r\n"
+	case "AUTH":
+		return "234 AUTH TLS successful\r\n"
+	default:
+		return "200 OK\r\n"
+	}
+}
+
+// dryRunMySQLHandshake returns a minimal protocol 10 handshake packet from
+// a server that supports SSL.
+func dryRunMySQLHandshake() []byte {
+	body := []byte{mysqlProtocolVersion}
+	body = append(body, "dry-run\x00"...)
+	body = append(body, 0, 0, 0, 0)        // Thread ID
+	body = append(body, "12345678\x00"...) // Auth plugin data part 1 and filler
+	body = binary.LittleEndian.AppendUint16(body, clientMySQL|clientProtocol41|clientSSL)
+
+	header := []byte{byte(len(body)), byte(len(body) >> 8), byte(len(body) >> 16), 0}
+
+	return append(header, body...)
+}
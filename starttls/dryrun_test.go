@@ -0,0 +1,81 @@
+package starttls
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol ProtocolID
+		opts     []Option
+		expected []string
+	}{
+		{name: "smtp", protocol: "smtp", expected: []string{"EHLO tlstools.com\r\n", "STARTTLS\r\n"}},
+		{
+			name:     "smtp pipelining",
+			protocol: "smtp",
+			opts:     []Option{WithSMTPMailAuditPipelining(), WithSMTPMailAudit()},
+			expected: []string{"EHLO tlstools.com\r\n", "MAIL FROM:<>\r\nRSET\r\nSTARTTLS\r\n"},
+		},
+		{name: "lmtp", protocol: "lmtp", expected: []string{"LHLO tlstools.com\r\n", "STARTTLS\r\n"}},
+		{name: "imap", protocol: "IMAP", expected: []string{"a001 CAPABILITY\r\n", "a002 STARTTLS\r\n"}},
+		{
+			name:     "imap tag prefix",
+			protocol: "imap",
+			opts:     []Option{WithIMAPTagPrefix("scan")},
+			expected: []string{"scan001 CAPABILITY\r\n", "scan002 STARTTLS\r\n"},
+		},
+		{name: "pop3", protocol: "pop3", expected: []string{"CAPA\r\n", "STLS\r\n"}},
+		{name: "ftp", protocol: "ftp", expected: []string{"AUTH TLS\r\n"}},
+		{name: "ftp features", protocol: "ftp", opts: []Option{WithFTPFeatures()}, expected: []string{"FEAT\r\n", "AUTH TLS\r\n"}},
+		{name: "nats", protocol: "nats"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, err := DryRun(tt.protocol, tt.opts...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, b := range sent {
+				got = append(got, string(b))
+			}
+
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("Expected writes %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDryRunBinary(t *testing.T) {
+	sent, err := DryRun("mysql")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The SSL request is the second packet of the exchange.
+	if len(sent) != 1 || len(sent[0]) < 4 || sent[0][3] != 1 {
+		t.Errorf("Expected one SSL request packet, got %x", sent)
+	}
+
+	sent, err = DryRun("ldap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// An LDAPMessage is a BER SEQUENCE.
+	if len(sent) != 1 || len(sent[0]) == 0 || sent[0][0] != 0x30 {
+		t.Errorf("Expected one StartTLS extended request, got %x", sent)
+	}
+
+	_, err = DryRun("gopher")
+	if !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package starttls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NegotiationError is returned by Negotiate and StartTLS when the protocol
+// handshake fails. It records where the negotiation stopped and what the
+// server last said, so that retry and reporting logic can branch on them
+// with errors.As instead of parsing the error text. It wraps the underlying
+// error, so errors.Is still matches ErrStartTLSNotSupported and the other
+// sentinels, and errors.As still finds *SMTPError and *MySQLServerError.
+type NegotiationError struct {
+	// Protocol is the name of the protocol being negotiated, e.g. "smtp".
+	Protocol ProtocolID
+	// Step is the step that failed: StepGreeting, StepCapabilities or
+	// StepUpgrade. It is empty for protocols that do not report steps, such
+	// as LDAP and HTTP.
+	Step string
+	// Response is what the server last sent before the failure, without
+	// line terminators: the whole reply for SMTP, LMTP and FTP, with the
+	// lines of a multiline reply joined by "\n", and the last line read for
+	// the other text protocols. It is empty when nothing was read or the
+	// protocol is binary. It is not sanitized.
+	Response string
+	// Transcript lists the lines exchanged up to the failure. It is only
+	// recorded with WithTranscript.
+	Transcript []TranscriptLine
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the message of the underlying error, followed by the
+// transcript, one line each, when one was recorded.
+func (e *NegotiationError) Error() string {
+	if len(e.Transcript) == 0 {
+		return e.Err.Error()
+	}
+
+	var b strings.Builder
+
+	b.WriteString(e.Err.Error())
+	b.WriteString("\ntranscript:")
+
+	for _, line := range e.Transcript {
+		b.WriteString("\n")
+		b.WriteString(line.String())
+	}
+
+	return b.String()
+}
+
+func (e *NegotiationError) Unwrap() error {
+	return e.Err
+}
+
+// LimitError is returned when the server sends more than a limit set with
+// WithMaxLineBytes or WithMaxResponseBytes allows. It matches
+// ErrInvalidResponse.
+type LimitError struct {
+	// Limit names the limit that was exceeded: "line" for WithMaxLineBytes
+	// or "response" for WithMaxResponseBytes.
+	Limit string
+	// Max is the limit in bytes.
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: server %s exceeds %d bytes", ErrInvalidResponse, e.Limit, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrInvalidResponse
+}
+
+// ProtocolError is implemented by the errors that carry a server's refusal
+// in the terms of its protocol: *SMTPError, *IMAPError, *POP3Error,
+// *FTPError, *LDAPError and *MySQLServerError. Use errors.As to find one in
+// the chain of a NegotiationError and decide whether to retry:
+//
+//	var protoErr starttls.ProtocolError
+//	if errors.As(err, &protoErr) && protoErr.Temporary() {
+//		// Retry later
+//	}
+type ProtocolError interface {
+	error
+	// Protocol returns the protocol whose server sent the reply.
+	Protocol() ProtocolID
+	// Temporary reports whether the server signaled a transient condition,
+	// such as an SMTP or FTP 4yz reply, so that retrying later may succeed.
+	Temporary() bool
+}
+
+// IMAPError is returned when an IMAP server refuses the connection with a
+// BYE greeting, which matches ErrInvalidResponse, or answers STARTTLS with NO
+// or BAD, which matches ErrStartTLSNotSupported.
+type IMAPError struct {
+	// Status is NO, BAD or BYE.
+	Status string
+	// ResponseCode is the atom of the bracketed response code, such as
+	// PRIVACYREQUIRED or UNAVAILABLE (RFC 5530), or empty when the server
+	// sent none.
+	ResponseCode string
+	// Message is the human-readable text after the status and the response
+	// code, sanitized.
+	Message string
+
+	line string
+	err  error
+}
+
+// newIMAPError builds an IMAPError from a tagged or untagged status line.
+// err is the sentinel the error matches.
+func newIMAPError(line string, err error) *IMAPError {
+	imapErr := &IMAPError{line: sanitizeResponse(line), err: err}
+
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(fields) > 1 {
+		imapErr.Status = strings.ToUpper(fields[1])
+	}
+
+	if len(fields) > 2 {
+		imapErr.ResponseCode, imapErr.Message = cutResponseCode(fields[2])
+	}
+
+	return imapErr
+}
+
+func (e *IMAPError) Error() string {
+	return fmt.Sprintf("%s: imap: %s", e.err, e.line)
+}
+
+func (e *IMAPError) Unwrap() error {
+	return e.err
+}
+
+// Protocol returns ProtocolIMAP.
+func (e *IMAPError) Protocol() ProtocolID {
+	return ProtocolIMAP
+}
+
+// Temporary reports whether the response code is UNAVAILABLE, INUSE or
+// LIMIT, which RFC 5530 defines for conditions expected to clear.
+func (e *IMAPError) Temporary() bool {
+	switch e.ResponseCode {
+	case "UNAVAILABLE", "INUSE", "LIMIT":
+		return true
+	default:
+		return false
+	}
+}
+
+// POP3Error is returned when a POP3 server answers with -ERR: in its
+// greeting, which matches ErrInvalidResponse, or to STLS, which matches
+// ErrStartTLSNotSupported.
+type POP3Error struct {
+	// ResponseCode is the bracketed extended response code, such as
+	// SYS/TEMP or IN-USE (RFC 2449, RFC 3206), or empty when the server
+	// sent none.
+	ResponseCode string
+	// Message is the text after -ERR and the response code, sanitized.
+	Message string
+
+	line string
+	err  error
+}
+
+// newPOP3Error builds a POP3Error from a -ERR status line. err is the
+// sentinel the error matches.
+func newPOP3Error(line string, err error) *POP3Error {
+	pop3Err := &POP3Error{line: sanitizeResponse(line), err: err}
+
+	_, text, _ := strings.Cut(strings.TrimSpace(line), " ")
+	pop3Err.ResponseCode, pop3Err.Message = cutResponseCode(text)
+
+	return pop3Err
+}
+
+func (e *POP3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.err, e.line)
+}
+
+func (e *POP3Error) Unwrap() error {
+	return e.err
+}
+
+// Protocol returns ProtocolPOP3.
+func (e *POP3Error) Protocol() ProtocolID {
+	return ProtocolPOP3
+}
+
+// Temporary reports whether the response code is SYS/TEMP, IN-USE or
+// LOGIN-DELAY, the codes RFC 2449 and RFC 3206 define for transient
+// conditions.
+func (e *POP3Error) Temporary() bool {
+	switch e.ResponseCode {
+	case "SYS/TEMP", "IN-USE", "LOGIN-DELAY":
+		return true
+	default:
+		return false
+	}
+}
+
+// FTPError is returned when an FTP server sends an unexpected greeting,
+// which matches ErrInvalidResponse, or refuses AUTH TLS, which matches
+// ErrStartTLSNotSupported and, for 530 and 534, ErrFTPNotLoggedIn and
+// ErrFTPPolicyDenied.
+type FTPError struct {
+	// Code is the three-digit reply code, e.g. 534.
+	Code int
+	// Message is the reply text without the code, sanitized. The lines of
+	// a multiline reply are joined with spaces.
+	Message string
+
+	err error
+}
+
+// newFTPError builds an FTPError from a reply. err is the error the
+// FTPError wraps.
+func newFTPError(reply *codeReply, err error) *FTPError {
+	ftpErr := &FTPError{Message: sanitizeResponse(strings.Join(reply.lines, " ")), err: err}
+	ftpErr.Code, _ = strconv.Atoi(reply.code)
+
+	return ftpErr
+}
+
+func (e *FTPError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.err, e.Code, e.Message)
+}
+
+func (e *FTPError) Unwrap() error {
+	return e.err
+}
+
+// Protocol returns ProtocolFTP.
+func (e *FTPError) Protocol() ProtocolID {
+	return ProtocolFTP
+}
+
+// Temporary reports whether the reply was a 4yz transient negative
+// completion.
+func (e *FTPError) Temporary() bool {
+	return e.Code/100 == 4
+}
+
+// LDAPError is returned when an LDAP server answers the StartTLS extended
+// operation with a result code other than success. It matches
+// ErrStartTLSNotSupported.
+type LDAPError struct {
+	// ResultCode is the LDAP result code (RFC 4511 section 4.1.9), e.g. 2
+	// (protocolError) or 52 (unavailable).
+	ResultCode int
+	// Message is the diagnostic message, sanitized.
+	Message string
+}
+
+func (e *LDAPError) Error() string {
+	return fmt.Sprintf("%s: ldap: result code %d: %s", ErrStartTLSNotSupported, e.ResultCode, e.Message)
+}
+
+func (e *LDAPError) Unwrap() error {
+	return ErrStartTLSNotSupported
+}
+
+// Protocol returns ProtocolLDAP.
+func (e *LDAPError) Protocol() ProtocolID {
+	return ProtocolLDAP
+}
+
+// Temporary reports whether the result code is busy (51) or unavailable
+// (52).
+func (e *LDAPError) Temporary() bool {
+	return e.ResultCode == 51 || e.ResultCode == 52
+}
+
+// cutResponseCode splits a leading bracketed response code, such as
+// "[SYS/TEMP]" or "[PRIVACYREQUIRED]", off text and returns its upper-cased
+// atom and the remaining text, sanitized.
+func cutResponseCode(text string) (string, string) {
+	rest, ok := strings.CutPrefix(text, "[")
+	if !ok {
+		return "", sanitizeResponse(text)
+	}
+
+	code, rest, ok := strings.Cut(rest, "]")
+	if !ok {
+		return "", sanitizeResponse(text)
+	}
+
+	atom, _, _ := strings.Cut(code, " ")
+
+	return strings.ToUpper(atom), sanitizeResponse(strings.TrimSpace(rest))
+}
@@ -0,0 +1,311 @@
+package starttls
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNegotiationError(t *testing.T) {
+	tests := []struct {
+		name             string
+		port             string
+		messages         []string
+		expectedProtocol ProtocolID
+		expectedStep     string
+		expectedResponse string
+		expectedErr      error
+	}{
+		{
+			name:             "smtp greeting refused",
+			port:             "25",
+			messages:         []string{"554 5.7.1 go away\r\n"},
+			expectedProtocol: "smtp",
+			expectedStep:     StepGreeting,
+			expectedResponse: "554 5.7.1 go away",
+			expectedErr:      ErrInvalidResponse,
+		},
+		{
+			name:             "smtp starttls rejected",
+			port:             "25",
+			messages:         []string{serverMessagesStart, serverMessagesSMTP, "454-TLS not available\r\n454 4.7.0 try later\r\n"},
+			expectedProtocol: "smtp",
+			expectedStep:     StepUpgrade,
+			expectedResponse: "454-TLS not available\n454 4.7.0 try later",
+			expectedErr:      ErrStartTLSNotSupported,
+		},
+		{
+			name:             "pop3 not advertised",
+			port:             "110",
+			messages:         []string{serverMessagesPOP3, "+OK\r\nUSER\r\n.\r\n"},
+			expectedProtocol: "pop3",
+			expectedStep:     StepCapabilities,
+			expectedResponse: ".",
+			expectedErr:      ErrStartTLSNotAdvertised,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, tt.port, tt.messages)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Expected %v, got: %v", tt.expectedErr, err)
+			}
+
+			var negErr *NegotiationError
+			if !errors.As(err, &negErr) {
+				t.Fatalf("Expected a *NegotiationError, got %T", err)
+			}
+
+			if negErr.Protocol != tt.expectedProtocol || negErr.Step != tt.expectedStep || negErr.Response != tt.expectedResponse {
+				t.Errorf("Expected %s step %q and response %q, got %+v",
+					tt.expectedProtocol, tt.expectedStep, tt.expectedResponse, negErr)
+			}
+		})
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	messages := []string{serverMessagesStart, "250-test.test.test\r\n250 STARTTLS\r\n", "454 4.7.0 TLS not available\r\n"}
+
+	_, err := negotiateWithServer(t, "25", messages, WithTranscript())
+
+	var negErr *NegotiationError
+	if !errors.As(err, &negErr) {
+		t.Fatalf("Expected a *NegotiationError, got: %v", err)
+	}
+
+	expected := []TranscriptLine{
+		{Text: "220 test.test.test server"},
+		{Sent: true, Text: "EHLO tlstools.com"},
+		{Text: "250-test.test.test"},
+		{Text: "250 STARTTLS"},
+		{Sent: true, Text: "STARTTLS"},
+		{Text: "454 4.7.0 TLS not available"},
+	}
+
+	if !slices.Equal(negErr.Transcript, expected) {
+		t.Errorf("Expected transcript %v, got %v", expected, negErr.Transcript)
+	}
+
+	if !strings.Contains(err.Error(), "\nC: STARTTLS\nS: 454 4.7.0 TLS not available") {
+		t.Errorf("Expected the transcript in the message, got: %v", err)
+	}
+
+	t.Run("off by default", func(t *testing.T) {
+		_, err := negotiateWithServer(t, "587", messages)
+
+		var negErr *NegotiationError
+		if !errors.As(err, &negErr) || negErr.Transcript != nil {
+			t.Errorf("Expected no transcript by default, got: %v", err)
+		}
+	})
+}
+
+func TestLimits(t *testing.T) {
+	longEHLO := "250-test\r\n" + strings.Repeat("250-X-FILLER\r\n", 100) + "250 STARTTLS\r\n"
+
+	tests := []struct {
+		name          string
+		port          string
+		messages      []string
+		opts          []Option
+		expectedLimit *LimitError
+	}{
+		{
+			name:     "within limits",
+			port:     "25",
+			messages: []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart},
+			opts:     []Option{WithMaxLineBytes(64), WithMaxResponseBytes(256)},
+		},
+		{
+			name:          "long line",
+			port:          "587",
+			messages:      []string{"220 " + strings.Repeat("x", 100) + "\r\n"},
+			opts:          []Option{WithMaxLineBytes(64)},
+			expectedLimit: &LimitError{Limit: "line", Max: 64},
+		},
+		{
+			name:          "unterminated line",
+			port:          "26",
+			messages:      []string{"220 " + strings.Repeat("x", 8192)},
+			opts:          []Option{WithMaxLineBytes(512)},
+			expectedLimit: &LimitError{Limit: "line", Max: 512},
+		},
+		{
+			name:          "long response",
+			port:          "2525",
+			messages:      []string{serverMessagesStart, longEHLO},
+			opts:          []Option{WithMaxLineBytes(64), WithMaxResponseBytes(512)},
+			expectedLimit: &LimitError{Limit: "response", Max: 512},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, tt.port, tt.messages, tt.opts...)
+
+			if tt.expectedLimit == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("Expected a *LimitError, got: %v", err)
+			}
+
+			if *limitErr != *tt.expectedLimit {
+				t.Errorf("Expected %+v, got %+v", *tt.expectedLimit, *limitErr)
+			}
+
+			if !errors.Is(err, ErrInvalidResponse) {
+				t.Errorf("Expected the error to match ErrInvalidResponse, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name              string
+		port              string
+		messages          []string
+		expectedProtocol  ProtocolID
+		expectedTemporary bool
+		expectedErr       error
+	}{
+		{
+			name:              "smtp transient",
+			port:              "25",
+			messages:          []string{serverMessagesStart, serverMessagesSMTP, "454 4.7.0 TLS not available\r\n"},
+			expectedProtocol:  ProtocolSMTP,
+			expectedTemporary: true,
+			expectedErr:       ErrStartTLSNotSupported,
+		},
+		{
+			name:             "lmtp permanent",
+			port:             "24",
+			messages:         []string{serverMessagesStart, serverMessagesSMTP, "554 5.7.0 no TLS\r\n"},
+			expectedProtocol: ProtocolLMTP,
+			expectedErr:      ErrStartTLSNotSupported,
+		},
+		{
+			name:              "imap unavailable",
+			port:              "143",
+			messages:          []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n", "a001 NO [UNAVAILABLE] try later\r\n"},
+			expectedProtocol:  ProtocolIMAP,
+			expectedTemporary: true,
+			expectedErr:       ErrStartTLSNotSupported,
+		},
+		{
+			name:             "imap bye",
+			port:             "10143",
+			messages:         []string{"* BYE [ALERT] go away\r\n"},
+			expectedProtocol: ProtocolIMAP,
+			expectedErr:      ErrInvalidResponse,
+		},
+		{
+			name:              "pop3 sys temp",
+			port:              "110",
+			messages:          []string{serverMessagesPOP3, "+OK\r\nSTLS\r\n.\r\n", "-ERR [SYS/TEMP] busy\r\n"},
+			expectedProtocol:  ProtocolPOP3,
+			expectedTemporary: true,
+			expectedErr:       ErrStartTLSNotSupported,
+		},
+		{
+			name:              "ftp transient",
+			port:              "21",
+			messages:          []string{"220 ready\r\n", "421 too many users\r\n"},
+			expectedProtocol:  ProtocolFTP,
+			expectedTemporary: true,
+			expectedErr:       ErrStartTLSNotSupported,
+		},
+		{
+			name:             "ftp policy",
+			port:             "2121",
+			messages:         []string{"220 ready\r\n", "534 denied\r\n"},
+			expectedProtocol: ProtocolFTP,
+			expectedErr:      ErrFTPPolicyDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithPortMap(map[string]ProtocolID{"10143": ProtocolIMAP, "2121": ProtocolFTP})}
+
+			_, err := negotiateWithServer(t, tt.port, tt.messages, opts...)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Expected %v, got: %v", tt.expectedErr, err)
+			}
+
+			var protoErr ProtocolError
+			if !errors.As(err, &protoErr) {
+				t.Fatalf("Expected a ProtocolError, got: %v", err)
+			}
+
+			if protoErr.Protocol() != tt.expectedProtocol || protoErr.Temporary() != tt.expectedTemporary {
+				t.Errorf("Expected %s temporary %v, got %s temporary %v",
+					tt.expectedProtocol, tt.expectedTemporary, protoErr.Protocol(), protoErr.Temporary())
+			}
+		})
+	}
+}
+
+func TestProtocolErrorFields(t *testing.T) {
+	imapErr := newIMAPError("a001 NO [PRIVACYREQUIRED] Connection is not private", ErrStartTLSNotSupported)
+	if imapErr.Status != "NO" || imapErr.ResponseCode != "PRIVACYREQUIRED" || imapErr.Message != "Connection is not private" {
+		t.Errorf("Unexpected IMAP error fields: %+v", imapErr)
+	}
+
+	if imapErr.Error() != "STARTTLS not supported by server: imap: a001 NO [PRIVACYREQUIRED] Connection is not private" {
+		t.Errorf("Unexpected IMAP error message: %v", imapErr)
+	}
+
+	pop3Err := newPOP3Error("-ERR [IN-USE] mailbox locked", ErrStartTLSNotSupported)
+	if pop3Err.ResponseCode != "IN-USE" || pop3Err.Message != "mailbox locked" || !pop3Err.Temporary() {
+		t.Errorf("Unexpected POP3 error fields: %+v", pop3Err)
+	}
+
+	pop3Err = newPOP3Error("-ERR not now", ErrStartTLSNotSupported)
+	if pop3Err.ResponseCode != "" || pop3Err.Message != "not now" || pop3Err.Temporary() {
+		t.Errorf("Unexpected POP3 error fields: %+v", pop3Err)
+	}
+
+	ldapErr := &LDAPError{ResultCode: 52, Message: "unavailable"}
+	if !errors.Is(ldapErr, ErrStartTLSNotSupported) || !ldapErr.Temporary() || ldapErr.Protocol() != ProtocolLDAP {
+		t.Errorf("Unexpected LDAP error: %v", ldapErr)
+	}
+
+	mysqlErr := &MySQLServerError{Code: 1040, Message: "Too many connections"}
+	if !mysqlErr.Temporary() || mysqlErr.Protocol() != ProtocolMySQL {
+		t.Errorf("Expected MySQL error 1040 to be temporary")
+	}
+
+	if (&MySQLServerError{Code: 1130}).Temporary() {
+		t.Errorf("Expected MySQL error 1130 to be permanent")
+	}
+}
+
+func TestLimitReadsAfterExceeded(t *testing.T) {
+	var conn bytes.Buffer
+
+	conn.WriteString("220-first line\r\n220-second line\r\n220 last line\r\n")
+
+	s := &session{cfg: newConfig([]Option{WithMaxResponseBytes(20), WithTranscript()})}
+	rw := s.readWriter(&conn)
+
+	for i := range 3 {
+		_, err := rw.ReadString('\n')
+
+		var limitErr *LimitError
+		if i > 0 && !errors.As(err, &limitErr) {
+			t.Fatalf("Read %d: expected a *LimitError, got: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package starttls
+
+import (
+	"context"
+	"io"
+	"slices"
+)
+
+// EventType identifies an Event.
+type EventType int
+
+// Event types sent by NegotiateAsync.
+const (
+	// EventConnected is sent first, when the negotiation starts.
+	EventConnected EventType = iota
+	// EventGreeting is sent when the server greeting has been read.
+	EventGreeting
+	// EventCapability is sent for each extension or capability the server
+	// advertised.
+	EventCapability
+	// EventStartTLSSent is sent when the upgrade step starts.
+	EventStartTLSSent
+	// EventUpgraded is sent last when the server accepted the upgrade.
+	EventUpgraded
+	// EventError is sent last when the negotiation failed.
+	EventError
+	// EventDone is sent last when the negotiation ended without an upgrade
+	// or an error, such as on a direct TLS port or with WithOpportunistic.
+	EventDone
+)
+
+// String returns the lowercase name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventGreeting:
+		return "greeting"
+	case EventCapability:
+		return "capability"
+	case EventStartTLSSent:
+		return "starttls-sent"
+	case EventUpgraded:
+		return "upgraded"
+	case EventError:
+		return "error"
+	case EventDone:
+		return "done"
+	default:
+		return "invalid"
+	}
+}
+
+// Event reports the progress of a negotiation started with NegotiateAsync.
+type Event struct {
+	Type EventType
+	// Protocol is the name of the protocol being negotiated. It is empty
+	// for EventConnected and for ports that are not negotiated.
+	Protocol ProtocolID
+	// Text is the greeting for EventGreeting, the capability for
+	// EventCapability and the upgrade command for EventStartTLSSent, which
+	// is empty for MySQL, whose SSL request is binary. It is not sanitized.
+	Text string
+	// Result is the result of the negotiation for the last event.
+	Result *StartTLSResult
+	// Err is the error for EventError.
+	Err error
+}
+
+// NegotiateAsync runs Negotiate in a new goroutine and sends its progress on
+// the returned channel, for user interfaces that display live progress of
+// many probes. The channel is closed after the last event, EventUpgraded,
+// EventError or EventDone, which carries the result. Events are sent as the
+// negotiation proceeds, so a receiver that stops reading stalls it until ctx
+// is done, after which the remaining events are dropped. Events are sent for
+// the steps a protocol reports in StartTLSResult.Timings; protocols that
+// report none, such as LDAP and HTTP, send only the first and last events.
+func NegotiateAsync[P Port](ctx context.Context, conn io.ReadWriter, port P, opts ...Option) <-chan Event {
+	events := make(chan Event, 8)
+
+	emit := func(event Event) {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	}
+
+	go func() {
+		defer close(events)
+
+		emit(Event{Type: EventConnected})
+
+		result, err := Negotiate(ctx, conn, port, append(slices.Clip(opts), withEvents(emit))...)
+
+		last := Event{Type: EventDone, Protocol: result.Protocol, Result: result, Err: err}
+
+		switch {
+		case err != nil:
+			last.Type = EventError
+		case result.TLSEstablished:
+			last.Type = EventUpgraded
+		}
+
+		emit(last)
+	}()
+
+	return events
+}
+
+// withEvents passes the events of a negotiation to emit.
+func withEvents(emit func(Event)) Option {
+	return func(c *config) {
+		c.events = emit
+	}
+}
@@ -0,0 +1,204 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNegotiateAsync(t *testing.T) {
+	tests := []struct {
+		name           string
+		port           string
+		messages       []string
+		expectedEvents []string
+		expectedLast   EventType
+	}{
+		{
+			name:     "upgraded",
+			port:     "25",
+			messages: []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart},
+			expectedEvents: []string{
+				"connected::",
+				"greeting:smtp:220 test.test.test server",
+				"capability:smtp:STARTTLS",
+				"starttls-sent:smtp:STARTTLS",
+				"upgraded:smtp:",
+			},
+			expectedLast: EventUpgraded,
+		},
+		{
+			name:     "imap capabilities in greeting",
+			port:     "143",
+			messages: []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n", serverMessagesIMAPSuccess},
+			expectedEvents: []string{
+				"connected::",
+				"greeting:imap:* OK [CAPABILITY IMAP4rev1 STARTTLS] ready",
+				"capability:imap:IMAP4rev1",
+				"capability:imap:STARTTLS",
+				"starttls-sent:imap:STARTTLS",
+				"upgraded:imap:",
+			},
+			expectedLast: EventUpgraded,
+		},
+		{
+			name:     "rejected",
+			port:     "587",
+			messages: []string{serverMessagesStart, serverMessagesSMTP, "454 TLS not available\r\n"},
+			expectedEvents: []string{
+				"connected::",
+				"greeting:smtp:220 test.test.test server",
+				"capability:smtp:STARTTLS",
+				"starttls-sent:smtp:STARTTLS",
+				"error:smtp:",
+			},
+			expectedLast: EventError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			server, err := newTestServer(ctx, tt.port, tt.messages)
+			if err != nil {
+				t.Fatalf("Failed to create test server: %v", err)
+			}
+			defer server.stop()
+
+			server.start(ctx)
+
+			dialer := &net.Dialer{}
+
+			conn, err := dialer.DialContext(ctx, "tcp", server.addr())
+			if err != nil {
+				t.Fatalf("Failed to connect to test server: %v", err)
+			}
+			defer conn.Close()
+
+			var (
+				events []string
+				last   Event
+			)
+
+			for event := range NegotiateAsync(ctx, conn, tt.port) {
+				events = append(events, fmt.Sprintf("%s:%s:%s", event.Type, event.Protocol, event.Text))
+				last = event
+			}
+
+			if !slices.Equal(events, tt.expectedEvents) {
+				t.Errorf("Expected events %q, got %q", tt.expectedEvents, events)
+			}
+
+			if last.Type != tt.expectedLast || last.Result == nil {
+				t.Fatalf("Expected a last %s event with a result, got %+v", tt.expectedLast, last)
+			}
+
+			if tt.expectedLast == EventError && !errors.Is(last.Err, ErrStartTLSNotSupported) {
+				t.Errorf("Expected ErrStartTLSNotSupported, got %v", last.Err)
+			}
+		})
+	}
+}
+
+func TestNegotiateAsyncProtocols(t *testing.T) {
+	line, err := NewLineProtocol("appliance", "^\\+READY", "UPGRADE", "^\\+GO")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	Register("appliance", []string{"7100"}, func() StartTLSProtocol { return line })
+	t.Cleanup(func() { Unregister("appliance") })
+
+	tests := []struct {
+		name           string
+		port           string
+		greeting       []byte
+		reply          string
+		expectedEvents []string
+	}{
+		{
+			name:     "line protocol",
+			port:     "7100",
+			greeting: []byte("+READY appliance\r\n"),
+			reply:    "+GO\r\n",
+			expectedEvents: []string{
+				"connected::",
+				"greeting:appliance:+READY appliance",
+				"starttls-sent:appliance:UPGRADE",
+				"upgraded:appliance:",
+			},
+		},
+		{
+			name:     "mysql",
+			port:     "3306",
+			greeting: dryRunMySQLHandshake(),
+			expectedEvents: []string{
+				"connected::",
+				"greeting:mysql:dry-run",
+				"starttls-sent:mysql:",
+				"upgraded:mysql:",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			client, server := net.Pipe()
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				defer server.Close()
+
+				_, _ = server.Write(tt.greeting)
+
+				if tt.reply != "" {
+					_, _ = bufio.NewReader(server).ReadString('\n')
+					_, _ = server.Write([]byte(tt.reply))
+				}
+
+				_, _ = io.Copy(io.Discard, server)
+			}()
+
+			var events []string
+
+			for event := range NegotiateAsync(ctx, client, tt.port) {
+				events = append(events, fmt.Sprintf("%s:%s:%s", event.Type, event.Protocol, event.Text))
+			}
+
+			client.Close()
+			<-done
+
+			if !slices.Equal(events, tt.expectedEvents) {
+				t.Errorf("Expected events %q, got %q", tt.expectedEvents, events)
+			}
+		})
+	}
+}
+
+func TestNegotiateAsyncDirectTLS(t *testing.T) {
+	var types []EventType
+
+	for event := range NegotiateAsync(context.Background(), nil, "993") {
+		types = append(types, event.Type)
+
+		if event.Type == EventDone && !event.Result.ImplicitTLS {
+			t.Errorf("Expected an implicit TLS result, got %+v", event.Result)
+		}
+	}
+
+	if expected := []EventType{EventConnected, EventDone}; !slices.Equal(types, expected) {
+		t.Errorf("Expected events %v, got %v", expected, types)
+	}
+}
@@ -0,0 +1,40 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+)
+
+// ProtectFTPDataChannel completes the FTPS setup after AUTH TLS and the TLS
+// handshake by sending "PBSZ 0" and "PROT P" (RFC 4217 section 9), so that
+// data connections are protected by TLS as well. conn must be the upgraded
+// control connection, typically the *tls.Conn wrapping the connection
+// passed to StartTLS.
+func ProtectFTPDataChannel(ctx context.Context, conn io.ReadWriter) error {
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for _, command := range []string{"PBSZ 0", "PROT P"} {
+		_, err := rw.WriteString(command + "\r\n")
+		if err != nil {
+			return fmt.Errorf("ftp: %s failed: %w", command, err)
+		}
+
+		err = rw.Flush()
+		if err != nil {
+			return fmt.Errorf("ftp: %s failed: %w", command, err)
+		}
+
+		reply, err := readFTPReply(ctx, rw.Reader)
+		if err != nil {
+			return fmt.Errorf("ftp: %s failed: %w", command, err)
+		}
+
+		if reply.code != "200" {
+			return fmt.Errorf("%w: ftp: %s: %s", ErrInvalidResponse, command, reply)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtectFTPDataChannel(t *testing.T) {
+	tests := []struct {
+		name          string
+		replies       []string
+		expectedError error
+	}{
+		{
+			name:    "protected",
+			replies: []string{"200 PBSZ=0\r\n", "200 Protection level set to P\r\n"},
+		},
+		{
+			name:          "prot refused",
+			replies:       []string{"200 PBSZ=0\r\n", "536 Requested PROT level not supported\r\n"},
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			client, server := net.Pipe()
+			defer client.Close()
+
+			var commands []string
+
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				defer server.Close()
+
+				conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+				r := bufio.NewReader(conn)
+
+				for _, reply := range tt.replies {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+			}()
+
+			conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+
+			err := ProtectFTPDataChannel(ctx, conn)
+
+			client.Close()
+			<-done
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if strings.Join(commands, ",") != "PBSZ 0,PROT P" {
+				t.Errorf("Unexpected commands %q", commands)
+			}
+		})
+	}
+}
+
+func TestFTPFeatures(t *testing.T) {
+	tests := []struct {
+		name             string
+		feat             string
+		expectedFeatures []string
+	}{
+		{
+			name:             "features listed",
+			feat:             "211-Features:\r\n AUTH TLS;SSL\r\n PBSZ\r\n PROT\r\n UTF8\r\n211 End\r\n",
+			expectedFeatures: []string{"AUTH TLS;SSL", "PBSZ", "PROT", "UTF8"},
+		},
+		{
+			name: "feat not implemented",
+			feat: "502 Command not implemented\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "21", []string{
+				"220 ready\r\n",
+				tt.feat,
+				serverMessagesFTP,
+			}, WithFTPFeatures())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			info, ok := ResultDetails[*FTPInfo](result)
+			if !ok {
+				t.Fatalf("Expected FTP details, got %T", result.Details)
+			}
+
+			if strings.Join(info.Features, ",") != strings.Join(tt.expectedFeatures, ",") {
+				t.Errorf("Expected features %q, got %q", tt.expectedFeatures, info.Features)
+			}
+
+			if info.Has("AUTH TLS") != (tt.expectedFeatures != nil) {
+				t.Errorf("Unexpected AUTH TLS match for %q", info.Features)
+			}
+		})
+	}
+}
+
+func TestFTPInfoHas(t *testing.T) {
+	info := &FTPInfo{Features: []string{"AUTH TLS;SSL", "PBSZ", "REST STREAM"}}
+
+	for feature, expected := range map[string]bool{
+		"AUTH TLS":   true,
+		"auth ssl":   true,
+		"AUTH":       true,
+		"AUTH TLS-C": false,
+		"PBSZ":       true,
+		"PROT":       false,
+		"REST":       true,
+	} {
+		if got := info.Has(feature); got != expected {
+			t.Errorf("Has(%q) = %v, expected %v", feature, got, expected)
+		}
+	}
+}
+
+func TestFTPAuthTLSErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		reply         string
+		expectedError error
+		unexpected    []error
+	}{
+		{
+			name:          "not logged in",
+			reply:         "530 Please login with USER and PASS\r\n",
+			expectedError: ErrFTPNotLoggedIn,
+			unexpected:    []error{ErrFTPPolicyDenied},
+		},
+		{
+			name:          "policy denied",
+			reply:         "534 Request denied for policy reasons\r\n",
+			expectedError: ErrFTPPolicyDenied,
+			unexpected:    []error{ErrFTPNotLoggedIn},
+		},
+		{
+			name:          "not implemented",
+			reply:         "502 Command not implemented\r\n",
+			expectedError: ErrStartTLSNotSupported,
+			unexpected:    []error{ErrFTPNotLoggedIn, ErrFTPPolicyDenied},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, "21", []string{"220 ready\r\n", tt.reply})
+
+			if !errors.Is(err, tt.expectedError) || !errors.Is(err, ErrStartTLSNotSupported) {
+				t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+			}
+
+			for _, e := range tt.unexpected {
+				if errors.Is(err, e) {
+					t.Errorf("Error %v unexpectedly matches %v", err, e)
+				}
+			}
+		})
+	}
+}
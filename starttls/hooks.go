@@ -0,0 +1,20 @@
+package starttls
+
+// Hooks observes a negotiation. Any field may be nil. OnSend and OnReceive
+// are called one at a time, but not necessarily from the goroutine that
+// called Negotiate, and must not block.
+type Hooks struct {
+	// OnSend is called with each line sent to the server, without its
+	// terminator.
+	OnSend func(line string)
+	// OnReceive is called with each line received from the server, without
+	// its terminator, as it is read from the connection. Lines the server
+	// sends ahead of a reply may therefore be reported before the
+	// negotiation acts on them.
+	OnReceive func(line string)
+	// OnStep is called when a step, StepGreeting, StepCapabilities or
+	// StepUpgrade, ends, with the error that ended the negotiation for the
+	// step that failed and nil otherwise. Only the protocols that report
+	// StartTLSResult.Timings report steps.
+	OnStep func(step string, err error)
+}
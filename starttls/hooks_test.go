@@ -0,0 +1,154 @@
+package starttls
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	tests := []struct {
+		name           string
+		messages       []string
+		expectedEvents []string
+	}{
+		{
+			name:     "established",
+			messages: []string{serverMessagesStart, serverMessagesSMTP, "220 ready for TLS\r\n"},
+			expectedEvents: []string{
+				"S: 220 test.test.test server",
+				"step greeting: <nil>",
+				"C: EHLO tlstools.com",
+				"S: 250-test.test.test",
+				"S: 250 STARTTLS",
+				"step capabilities: <nil>",
+				"C: STARTTLS",
+				"S: 220 ready for TLS",
+				"step upgrade: <nil>",
+			},
+		},
+		{
+			name:     "not advertised",
+			messages: []string{serverMessagesStart, "250 test.test.test\r\n"},
+			expectedEvents: []string{
+				"S: 220 test.test.test server",
+				"step greeting: <nil>",
+				"C: EHLO tlstools.com",
+				"S: 250 test.test.test",
+				"step capabilities: failed",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				events []string
+			)
+
+			record := func(event string) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				events = append(events, event)
+			}
+
+			hooks := &Hooks{
+				OnSend:    func(line string) { record("C: " + line) },
+				OnReceive: func(line string) { record("S: " + line) },
+				OnStep: func(step string, err error) {
+					if errors.Is(err, ErrStartTLSNotSupported) {
+						record(fmt.Sprintf("step %s: failed", step))
+
+						return
+					}
+
+					record(fmt.Sprintf("step %s: %v", step, err))
+				},
+			}
+
+			_, _ = negotiateWithServer(t, "25", tt.messages, WithHooks(hooks))
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !slices.Equal(events, tt.expectedEvents) {
+				t.Errorf("Expected events %q, got %q", tt.expectedEvents, events)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	messages := []string{serverMessagesStart, serverMessagesSMTP, "454 TLS not available\r\n"}
+
+	_, err := negotiateWithServer(t, "25", messages, WithLogger(logger))
+	if !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Fatalf("Expected ErrStartTLSNotSupported, got %v", err)
+	}
+
+	var steps []string
+
+	for line := range strings.Lines(buf.String()) {
+		var record map[string]any
+
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("Failed to decode log record %q: %v", line, err)
+		}
+
+		if record["level"] != "DEBUG" || record["protocol"] != "smtp" || record["remote_addr"] == "" {
+			t.Errorf("Unexpected log record %q", line)
+		}
+
+		if _, ok := record["duration"]; !ok {
+			t.Errorf("Expected a duration in %q", line)
+		}
+
+		steps = append(steps, fmt.Sprintf("%v %v %v %v", record["step"], record["command"], record["reply_code"], record["error"] != nil))
+	}
+
+	expectedSteps := []string{
+		"greeting <nil> 220 false",
+		"capabilities EHLO tlstools.com 250 false",
+		"upgrade STARTTLS 454 true",
+	}
+
+	if !slices.Equal(steps, expectedSteps) {
+		t.Errorf("Expected steps %q, got %q", expectedSteps, steps)
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		response string
+		expected string
+	}{
+		{"220 mail.example.com ESMTP", "220"},
+		{"250-mail.example.com\n250 STARTTLS", "250"},
+		{"+OK POP3 ready", "+OK"},
+		{"-ERR unknown command", "-ERR"},
+		{"a001 NO [ALERT] TLS unavailable", "NO"},
+		{"* OK [CAPABILITY IMAP4rev1] ready", "OK"},
+		{"* CAPABILITY IMAP4rev1 STARTTLS", ""},
+		{"INFO {}", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		code := replyCode(tt.response)
+		if code != tt.expected {
+			t.Errorf("replyCode(%q) = %q, expected %q", tt.response, code, tt.expected)
+		}
+	}
+}
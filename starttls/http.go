@@ -0,0 +1,95 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// HTTP protocol implementation of the RFC 2817 upgrade to TLS.
+type httpProtocol struct {
+	name string
+	host string
+}
+
+// NewHTTPProtocol returns a protocol that upgrades an HTTP/1.1 connection to
+// TLS with an RFC 2817 "Upgrade: TLS" request. host is sent in the Host
+// header; a host containing control characters, which could inject headers,
+// fails the handshake. It is not registered on any port because few HTTP
+// servers support the upgrade; callers run its Handshake directly.
+func NewHTTPProtocol(host string) StartTLSProtocol {
+	return &httpProtocol{
+		name: string(ProtocolHTTP),
+		host: host,
+	}
+}
+
+func (p *httpProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	if strings.ContainsFunc(p.host, unicode.IsControl) {
+		return fmt.Errorf("http: invalid host %q: contains control characters", p.host)
+	}
+
+	_, err := fmt.Fprintf(rw, "OPTIONS * HTTP/1.1\r\nHost: %s\r\nUpgrade: TLS/1.2, HTTP/1.1\r\nConnection: Upgrade\r\n\r\n", p.host)
+	if err != nil {
+		return fmt.Errorf("http: failed to write upgrade request: %w", err)
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return fmt.Errorf("http: failed to flush upgrade request: %w", err)
+	}
+
+	status, err := readLine(ctx, rw.Reader)
+	if err != nil {
+		return fmt.Errorf("http: failed to read status line: %w", err)
+	}
+
+	upgrade, err := p.readUpgradeHeader(ctx, rw)
+	if err != nil {
+		return fmt.Errorf("http: failed to read headers: %w", err)
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return fmt.Errorf("%w: http: malformed status line: %s", ErrInvalidResponse, sanitizeResponse(status))
+	}
+
+	if fields[1] != "101" {
+		return fmt.Errorf("%w: http: %s", ErrStartTLSNotSupported, sanitizeResponse(status))
+	}
+
+	if !strings.Contains(strings.ToUpper(upgrade), "TLS/") {
+		return fmt.Errorf("%w: http: 101 response upgrades to %q, not TLS", ErrInvalidResponse, sanitizeResponse(upgrade))
+	}
+
+	return nil
+}
+
+func (p *httpProtocol) Name() string {
+	return p.name
+}
+
+// readUpgradeHeader consumes the response headers up to the blank line and
+// returns the value of the Upgrade header.
+func (p *httpProtocol) readUpgradeHeader(ctx context.Context, rw *bufio.ReadWriter) (string, error) {
+	var upgrade string
+
+	for {
+		line, err := readLine(ctx, rw.Reader)
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return upgrade, nil
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Upgrade") {
+			upgrade = strings.TrimSpace(value)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPUpgrade(t *testing.T) {
+	tests := []struct {
+		name          string
+		response      string
+		expectedError error
+	}{
+		{
+			name:     "switching protocols",
+			response: "HTTP/1.1 101 Switching Protocols\r\nUpgrade: TLS/1.2, HTTP/1.1\r\nConnection: Upgrade\r\n\r\n",
+		},
+		{
+			name:          "upgrade not supported",
+			response:      "HTTP/1.1 200 OK\r\nAllow: GET, OPTIONS\r\nContent-Length: 0\r\n\r\n",
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "upgrade to something else",
+			response:      "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "not http",
+			response:      "220 smtp.test ESMTP\r\n\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			client, server := net.Pipe()
+			defer client.Close()
+
+			requestCh := make(chan string, 1)
+
+			go func() {
+				defer server.Close()
+
+				reader := bufio.NewReader(server)
+
+				var request strings.Builder
+
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					request.WriteString(line)
+
+					if line == "\r\n" {
+						break
+					}
+				}
+
+				requestCh <- request.String()
+
+				server.Write([]byte(tt.response))
+			}()
+
+			p := NewHTTPProtocol("proxy.test")
+			err := p.Handshake(ctx, bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client)))
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			request := <-requestCh
+			for _, want := range []string{"OPTIONS * HTTP/1.1\r\n", "Host: proxy.test\r\n", "Upgrade: TLS/1.2, HTTP/1.1\r\n", "Connection: Upgrade\r\n"} {
+				if !strings.Contains(request, want) {
+					t.Errorf("Request missing %q:\n%s", want, request)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPProtocolInvalidHost(t *testing.T) {
+	conn := &dryRunConn{}
+	p := NewHTTPProtocol("proxy.test\r\nX-Injected: 1")
+
+	if p.Name() != ProtocolHTTP.String() {
+		t.Errorf("Expected name %q, got %q", ProtocolHTTP, p.Name())
+	}
+
+	err := p.Handshake(context.Background(), bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)))
+	if err == nil {
+		t.Fatal("Expected an error for a host with CRLF")
+	}
+
+	if len(conn.sent) != 0 {
+		t.Errorf("Expected nothing to be sent, got %q", conn.sent)
+	}
+}
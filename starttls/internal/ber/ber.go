@@ -0,0 +1,172 @@
+// Package ber implements the small subset of ASN.1 BER needed by binary
+// STARTTLS protocols such as LDAP: single-byte tags, definite length forms
+// up to three length bytes, and INTEGER decoding.
+package ber
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Universal tags.
+const (
+	TagInteger     = 0x02
+	TagOctetString = 0x04
+	TagEnumerated  = 0x0a
+	TagSequence    = 0x30
+)
+
+// MaxLength bounds the length of an element read from the network.
+const MaxLength = 1 << 20
+
+// ErrTruncated is returned when data ends before the element does.
+var ErrTruncated = errors.New("truncated BER element")
+
+// Element is a single decoded tag-length-value element.
+type Element struct {
+	Tag   byte
+	Value []byte
+}
+
+// Encode encodes a single-byte tag and value using definite length form.
+func Encode(tag byte, value []byte) []byte {
+	out := []byte{tag}
+
+	switch n := len(value); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	return append(out, value...)
+}
+
+// Parse decodes the element at the start of data and returns the remaining bytes.
+func Parse(data []byte) (Element, []byte, error) {
+	if len(data) < 2 {
+		return Element{}, nil, ErrTruncated
+	}
+
+	tag := data[0]
+
+	length, n, err := decodeLength(data[1:])
+	if err != nil {
+		return Element{}, nil, err
+	}
+
+	data = data[1+n:]
+	if length > len(data) {
+		return Element{}, nil, ErrTruncated
+	}
+
+	return Element{Tag: tag, Value: data[:length]}, data[length:], nil
+}
+
+// Children decodes the elements contained in a constructed value, such as
+// the fields of a SEQUENCE.
+func Children(data []byte) ([]Element, error) {
+	var elems []Element
+
+	for len(data) > 0 {
+		var (
+			elem Element
+			err  error
+		)
+
+		elem, data, err = Parse(data)
+		if err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, elem)
+	}
+
+	return elems, nil
+}
+
+// Read reads a complete element from r. Elements longer than MaxLength are
+// rejected.
+func Read(r io.Reader) (Element, error) {
+	header := make([]byte, 2, 5)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return Element{}, err
+	}
+
+	if header[1] >= 0x80 {
+		extra := make([]byte, int(header[1]&0x7f))
+
+		_, err = io.ReadFull(r, extra)
+		if err != nil {
+			return Element{}, err
+		}
+
+		header = append(header, extra...)
+	}
+
+	length, _, err := decodeLength(header[1:])
+	if err != nil {
+		return Element{}, err
+	}
+
+	if length > MaxLength {
+		return Element{}, fmt.Errorf("BER element too large: %d bytes", length)
+	}
+
+	value := make([]byte, length)
+
+	_, err = io.ReadFull(r, value)
+	if err != nil {
+		return Element{}, err
+	}
+
+	return Element{Tag: header[0], Value: value}, nil
+}
+
+// Int decodes a two's complement big-endian INTEGER or ENUMERATED value.
+func Int(value []byte) int {
+	n := 0
+	for i, b := range value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+
+		n = n<<8 | int(b)
+	}
+
+	return n
+}
+
+// decodeLength decodes a definite length and returns it with the number of bytes consumed.
+func decodeLength(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, ErrTruncated
+	}
+
+	if data[0] < 0x80 {
+		return int(data[0]), 1, nil
+	}
+
+	n := int(data[0] & 0x7f)
+	if n == 0 || n > 3 {
+		return 0, 0, fmt.Errorf("unsupported BER length form 0x%02x", data[0])
+	}
+
+	if len(data) < 1+n {
+		return 0, 0, ErrTruncated
+	}
+
+	length := 0
+	for _, b := range data[1 : 1+n] {
+		length = length<<8 | int(b)
+	}
+
+	return length, 1 + n, nil
+}
@@ -0,0 +1,113 @@
+package ber
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestLengthForms(t *testing.T) {
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000} {
+		value := bytes.Repeat([]byte{'x'}, n)
+
+		elem, rest, err := Parse(Encode(TagOctetString, value))
+		if err != nil {
+			t.Fatalf("length %d: unexpected error: %v", n, err)
+		}
+
+		if len(elem.Value) != n || len(rest) != 0 || elem.Tag != TagOctetString {
+			t.Errorf("length %d: decoded %d bytes with %d left over", n, len(elem.Value), len(rest))
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "short value", data: []byte{TagOctetString, 0x05, 'a'}},
+		{name: "short length", data: []byte{TagOctetString, 0x82, 0x01}},
+		{name: "indefinite length", data: []byte{TagSequence, 0x80, 0x00, 0x00}},
+		{name: "four length bytes", data: []byte{TagOctetString, 0x84, 0, 0, 0, 1, 'a'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Parse(tt.data)
+			if err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+
+	_, _, err := Parse([]byte{TagOctetString, 0x05, 'a'})
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got: %v", err)
+	}
+}
+
+func TestChildren(t *testing.T) {
+	seq := Encode(TagSequence, append(Encode(TagInteger, []byte{0x07}), Encode(TagOctetString, []byte("dn"))...))
+
+	elem, _, err := Parse(seq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	children, err := Children(elem.Value)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(children) != 2 || Int(children[0].Value) != 7 || string(children[1].Value) != "dn" {
+		t.Errorf("Unexpected children %+v", children)
+	}
+
+	_, err = Children([]byte{TagInteger, 0x02, 0x01})
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got: %v", err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	value := bytes.Repeat([]byte{'x'}, 300)
+	data := append(Encode(TagOctetString, value), Encode(TagInteger, []byte{0x01})...)
+	r := bytes.NewReader(data)
+
+	elem, err := Read(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if elem.Tag != TagOctetString || !bytes.Equal(elem.Value, value) {
+		t.Errorf("Unexpected element %x", elem.Tag)
+	}
+
+	elem, err = Read(r)
+	if err != nil || elem.Tag != TagInteger {
+		t.Errorf("Expected second element, got %+v, %v", elem, err)
+	}
+
+	_, err = Read(bytes.NewReader([]byte{TagOctetString, 0x83, 0x20, 0x00, 0x00}))
+	if err == nil {
+		t.Error("Expected error for oversized element")
+	}
+}
+
+func TestInt(t *testing.T) {
+	tests := map[int][]byte{
+		0:   {0x00},
+		52:  {0x34},
+		255: {0x00, 0xff},
+		-1:  {0xff},
+		256: {0x01, 0x00},
+	}
+
+	for expected, value := range tests {
+		if got := Int(value); got != expected {
+			t.Errorf("Int(%x) = %d, expected %d", value, got, expected)
+		}
+	}
+}
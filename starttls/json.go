@@ -0,0 +1,224 @@
+package starttls
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The MarshalJSON methods below give results and errors stable snake_case
+// field names, so scan pipelines can persist them directly. Durations are
+// encoded as fractional milliseconds and errors as their message.
+
+// MarshalJSON encodes the result with stable field names.
+func (r *StartTLSResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Protocol          ProtocolID        `json:"protocol"`
+		TLSEstablished    bool              `json:"tls_established"`
+		UpgradeCommand    string            `json:"upgrade_command,omitempty"`
+		ImplicitTLS       bool              `json:"implicit_tls"`
+		FallbackReason    string            `json:"fallback_reason,omitempty"`
+		Capabilities      []string          `json:"capabilities,omitempty"`
+		Findings          []Finding         `json:"findings,omitempty"`
+		Details           any               `json:"details,omitempty"`
+		RejectionBehavior RejectionBehavior `json:"rejection_behavior"`
+		Probed            bool              `json:"probed"`
+		Banner            string            `json:"banner,omitempty"`
+		Duration          float64           `json:"duration_ms"`
+		Timings           []StepTiming      `json:"timings,omitempty"`
+		BytesSent         int64             `json:"bytes_sent"`
+		BytesReceived     int64             `json:"bytes_received"`
+	}{
+		Protocol:          r.Protocol,
+		TLSEstablished:    r.TLSEstablished,
+		UpgradeCommand:    r.UpgradeCommand,
+		ImplicitTLS:       r.ImplicitTLS,
+		FallbackReason:    errorMessage(r.FallbackReason),
+		Capabilities:      r.Capabilities,
+		Findings:          r.Findings,
+		Details:           r.Details,
+		RejectionBehavior: r.RejectionBehavior,
+		Probed:            r.Probed,
+		Banner:            r.Banner,
+		Duration:          milliseconds(r.Duration),
+		Timings:           r.Timings,
+		BytesSent:         r.BytesSent,
+		BytesReceived:     r.BytesReceived,
+	})
+}
+
+// MarshalJSON encodes the timing with its duration in milliseconds.
+func (t StepTiming) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Step     string  `json:"step"`
+		Duration float64 `json:"duration_ms"`
+	}{t.Step, milliseconds(t.Duration)})
+}
+
+// MarshalJSON encodes the error with the protocol, step and server response.
+// When the underlying error is a ProtocolError it adds whether the condition
+// is temporary and, for *SMTPError, *FTPError, *LDAPError and
+// *MySQLServerError, the reply or result code. The message is that of the
+// underlying error, without the transcript, which has its own field.
+func (e *NegotiationError) MarshalJSON() ([]byte, error) {
+	var code int
+
+	var smtpErr *SMTPError
+	var ftpErr *FTPError
+	var ldapErr *LDAPError
+	var mysqlErr *MySQLServerError
+
+	switch {
+	case errors.As(e.Err, &smtpErr):
+		code = smtpErr.Code
+	case errors.As(e.Err, &ftpErr):
+		code = ftpErr.Code
+	case errors.As(e.Err, &ldapErr):
+		code = ldapErr.ResultCode
+	case errors.As(e.Err, &mysqlErr):
+		code = int(mysqlErr.Code)
+	}
+
+	var temporary *bool
+
+	var protoErr ProtocolError
+	if errors.As(e.Err, &protoErr) {
+		temporary = new(bool)
+		*temporary = protoErr.Temporary()
+	}
+
+	return json.Marshal(struct {
+		Protocol   ProtocolID       `json:"protocol"`
+		Step       string           `json:"step,omitempty"`
+		Code       int              `json:"code,omitempty"`
+		Temporary  *bool            `json:"temporary,omitempty"`
+		Message    string           `json:"message"`
+		Response   string           `json:"response,omitempty"`
+		Transcript []TranscriptLine `json:"transcript,omitempty"`
+	}{e.Protocol, e.Step, code, temporary, errorMessage(e.Err), e.Response, e.Transcript})
+}
+
+// MarshalJSON encodes the error with its reply codes and message.
+func (e *SMTPError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Code         int    `json:"code"`
+		EnhancedCode string `json:"enhanced_code,omitempty"`
+		Message      string `json:"message"`
+	}{e.Code, e.EnhancedCode.String(), e.Error()})
+}
+
+// MarshalJSON encodes the error with its status, response code and message.
+func (e *IMAPError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Status       string `json:"status"`
+		ResponseCode string `json:"response_code,omitempty"`
+		Temporary    bool   `json:"temporary"`
+		Message      string `json:"message"`
+	}{e.Status, e.ResponseCode, e.Temporary(), e.Error()})
+}
+
+// MarshalJSON encodes the error with its response code and message.
+func (e *POP3Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ResponseCode string `json:"response_code,omitempty"`
+		Temporary    bool   `json:"temporary"`
+		Message      string `json:"message"`
+	}{e.ResponseCode, e.Temporary(), e.Error()})
+}
+
+// MarshalJSON encodes the error with its reply code and message.
+func (e *FTPError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Code      int    `json:"code"`
+		Temporary bool   `json:"temporary"`
+		Message   string `json:"message"`
+	}{e.Code, e.Temporary(), e.Error()})
+}
+
+// MarshalJSON encodes the error with its result code and message.
+func (e *LDAPError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ResultCode int    `json:"result_code"`
+		Temporary  bool   `json:"temporary"`
+		Message    string `json:"message"`
+	}{e.ResultCode, e.Temporary(), e.Error()})
+}
+
+// MarshalJSON encodes the error with the exceeded limit and its message.
+func (e *LimitError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Limit   string `json:"limit"`
+		Max     int    `json:"max"`
+		Message string `json:"message"`
+	}{e.Limit, e.Max, e.Error()})
+}
+
+// MarshalJSON encodes the error with its code, SQL state and message.
+func (e *MySQLServerError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Code     uint16 `json:"code"`
+		SQLState string `json:"sql_state,omitempty"`
+		Message  string `json:"message"`
+	}{e.Code, e.SQLState, e.Error()})
+}
+
+// MarshalJSON encodes the error with the server version and its message.
+func (e *MySQLLegacyServerError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ProtocolVersion uint8  `json:"protocol_version"`
+		ServerVersion   string `json:"server_version"`
+		Message         string `json:"message"`
+	}{e.ProtocolVersion, e.ServerVersion, e.Error()})
+}
+
+// MarshalJSON encodes the error with the packet header fields and its
+// message.
+func (e *MySQLFramingError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Sequence         byte   `json:"sequence"`
+		ExpectedSequence byte   `json:"expected_sequence"`
+		Length           int    `json:"length"`
+		Read             int    `json:"read"`
+		Message          string `json:"message"`
+	}{e.Sequence, e.ExpectedSequence, e.Length, e.Read, e.Error()})
+}
+
+// MarshalJSON encodes the result as StartTLSResult does, with the message of
+// Err added as "error". The embedded result would otherwise encode it alone
+// and drop Err.
+func (r ScanResult) MarshalJSON() ([]byte, error) {
+	result := r.StartTLSResult
+	if result == nil {
+		result = &StartTLSResult{}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil || r.Err == nil {
+		return b, err
+	}
+
+	message, err := json.Marshal(errorMessage(r.Err))
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace the closing brace of the result with the error field.
+	b = append(b[:len(b)-1], `,"error":`...)
+	b = append(b, message...)
+
+	return append(b, '}'), nil
+}
+
+// errorMessage returns the message of err, or an empty string for nil.
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// milliseconds returns d as fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,198 @@
+package starttls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestResultJSON(t *testing.T) {
+	result, err := negotiateWithServer(t, "25", []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var decoded struct {
+		Protocol          string   `json:"protocol"`
+		TLSEstablished    bool     `json:"tls_established"`
+		UpgradeCommand    string   `json:"upgrade_command"`
+		Capabilities      []string `json:"capabilities"`
+		RejectionBehavior string   `json:"rejection_behavior"`
+		Banner            string   `json:"banner"`
+		Duration          *float64 `json:"duration_ms"`
+		Timings           []struct {
+			Step     string   `json:"step"`
+			Duration *float64 `json:"duration_ms"`
+		} `json:"timings"`
+		Details struct {
+			Extensions []string `json:"extensions"`
+		} `json:"details"`
+		BytesSent int64 `json:"bytes_sent"`
+	}
+
+	err = json.Unmarshal(b, &decoded)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if decoded.Protocol != "smtp" || !decoded.TLSEstablished || decoded.UpgradeCommand != "STARTTLS" {
+		t.Errorf("Unexpected protocol fields in %s", b)
+	}
+
+	if decoded.RejectionBehavior != "not-observed" || decoded.Banner != "220 test.test.test server" {
+		t.Errorf("Unexpected rejection behavior or banner in %s", b)
+	}
+
+	if decoded.Duration == nil || len(decoded.Timings) != 3 || decoded.Timings[2].Step != StepUpgrade || decoded.Timings[2].Duration == nil {
+		t.Errorf("Expected duration_ms and three timings in %s", b)
+	}
+
+	if len(decoded.Details.Extensions) == 0 || decoded.BytesSent == 0 {
+		t.Errorf("Expected SMTP details and byte counts in %s", b)
+	}
+}
+
+func TestResultJSONFields(t *testing.T) {
+	result := &StartTLSResult{
+		Protocol:       "imap",
+		FallbackReason: ErrStartTLSNotAdvertised,
+		Findings:       []Finding{{ID: FindingLoginDisabledMissing, Severity: SeverityLow, Message: "m"}},
+		Duration:       1500 * time.Microsecond,
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := `{"protocol":"imap","tls_established":false,"implicit_tls":false,` +
+		`"fallback_reason":"` + ErrStartTLSNotAdvertised.Error() + `",` +
+		`"findings":[{"id":"logindisabled-missing","severity":"low","message":"m"}],` +
+		`"rejection_behavior":"not-observed","probed":false,"duration_ms":1.5,"bytes_sent":0,"bytes_received":0}`
+
+	if string(b) != expected {
+		t.Errorf("Expected %s, got %s", expected, b)
+	}
+}
+
+func TestScanResultJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   ScanResult
+		expected string
+	}{
+		{
+			name:   "upgraded",
+			result: ScanResult{StartTLSResult: &StartTLSResult{Protocol: "smtp", TLSEstablished: true}},
+			expected: `{"protocol":"smtp","tls_established":true,"implicit_tls":false,` +
+				`"rejection_behavior":"not-observed","probed":false,"duration_ms":0,"bytes_sent":0,"bytes_received":0}`,
+		},
+		{
+			name:   "failed",
+			result: ScanResult{StartTLSResult: &StartTLSResult{}, Err: errors.New("connection refused")},
+			expected: `{"protocol":"","tls_established":false,"implicit_tls":false,` +
+				`"rejection_behavior":"not-observed","probed":false,"duration_ms":0,"bytes_sent":0,"bytes_received":0,` +
+				`"error":"connection refused"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.result)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if string(b) != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, b)
+			}
+		})
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	smtpErr := &SMTPError{Code: 454, EnhancedCode: EnhancedStatusCode{4, 7, 0}, Message: "try later", err: ErrStartTLSNotSupported}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name: "negotiation error",
+			err: &NegotiationError{
+				Protocol:   "smtp",
+				Step:       StepUpgrade,
+				Response:   "454 4.7.0 try later",
+				Transcript: []TranscriptLine{{Sent: true, Text: "STARTTLS"}},
+				Err:        smtpErr,
+			},
+			expected: `{"protocol":"smtp","step":"upgrade","code":454,"temporary":true,"message":"` + smtpErr.Error() + `",` +
+				`"response":"454 4.7.0 try later","transcript":[{"sent":true,"text":"STARTTLS"}]}`,
+		},
+		{
+			name:     "negotiation error without code",
+			err:      &NegotiationError{Protocol: "ldap", Err: ErrStartTLSNotSupported},
+			expected: `{"protocol":"ldap","message":"` + ErrStartTLSNotSupported.Error() + `"}`,
+		},
+		{
+			name: "negotiation error with mysql code",
+			err: &NegotiationError{
+				Protocol: "mysql",
+				Step:     StepGreeting,
+				Err:      fmt.Errorf("wrapped: %w", &MySQLServerError{Code: 1130, Message: "denied"}),
+			},
+			expected: `{"protocol":"mysql","step":"greeting","code":1130,"temporary":false,"message":"wrapped: mysql: server error 1130: denied"}`,
+		},
+		{
+			name:     "negotiation error with ftp code",
+			err:      &NegotiationError{Protocol: "ftp", Step: StepUpgrade, Err: &FTPError{Code: 421, Message: "busy", err: ErrStartTLSNotSupported}},
+			expected: `{"protocol":"ftp","step":"upgrade","code":421,"temporary":true,"message":"STARTTLS not supported by server: 421 busy"}`,
+		},
+		{
+			name:     "imap error",
+			err:      newIMAPError("a001 NO [UNAVAILABLE] later", ErrStartTLSNotSupported),
+			expected: `{"status":"NO","response_code":"UNAVAILABLE","temporary":true,"message":"STARTTLS not supported by server: imap: a001 NO [UNAVAILABLE] later"}`,
+		},
+		{
+			name:     "smtp error",
+			err:      smtpErr,
+			expected: `{"code":454,"enhanced_code":"4.7.0","message":"` + smtpErr.Error() + `"}`,
+		},
+		{
+			name:     "limit error",
+			err:      &LimitError{Limit: "line", Max: 512},
+			expected: `{"limit":"line","max":512,"message":"invalid server response: server line exceeds 512 bytes"}`,
+		},
+		{
+			name:     "mysql server error",
+			err:      &MySQLServerError{Code: 1040, SQLState: "08004", Message: "Too many connections"},
+			expected: `{"code":1040,"sql_state":"08004","message":"mysql: server error 1040 (08004): Too many connections"}`,
+		},
+		{
+			name:     "mysql framing error",
+			err:      &MySQLFramingError{Sequence: 2, ExpectedSequence: 1},
+			expected: `{"sequence":2,"expected_sequence":1,"length":0,"read":0,"message":"` + (&MySQLFramingError{Sequence: 2, ExpectedSequence: 1}).Error() + `"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.err)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if string(b) != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, b)
+			}
+		})
+	}
+}
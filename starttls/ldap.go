@@ -0,0 +1,143 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+
+	"github.com/jsandas/starttls-go/starttls/internal/ber"
+)
+
+// LDAP protocol implementation.
+type ldapProtocol struct {
+	name string
+}
+
+func newLDAPProtocol() *ldapProtocol {
+	return &ldapProtocol{
+		name: string(ProtocolLDAP),
+	}
+}
+
+// LDAP protocol constants.
+const (
+	ldapStartTLSOID              = "1.3.6.1.4.1.1466.20037"
+	ldapNoticeOfDisconnectionOID = "1.3.6.1.4.1.1466.20036"
+	ldapMessageID                = 1
+	ldapResultSuccess            = 0
+	ldapTagExtendedRequest       = 0x77 // [APPLICATION 23] constructed
+	ldapTagExtendedResponse      = 0x78 // [APPLICATION 24] constructed
+	ldapTagRequestName           = 0x80 // [0] primitive
+	ldapTagResponseName          = 0x8a // [10] primitive
+)
+
+func (p *ldapProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	_, err := rw.Write(p.createStartTLSRequest())
+	if err != nil {
+		return fmt.Errorf("ldap: failed to write StartTLS request: %w", err)
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return fmt.Errorf("ldap: failed to flush StartTLS request: %w", err)
+	}
+
+	msg, err := readLDAPMessage(ctx, rw.Reader)
+	if err != nil {
+		return fmt.Errorf("ldap: failed to read StartTLS response: %w", err)
+	}
+
+	resp, err := p.parseExtendedResponse(msg)
+	if err != nil {
+		return fmt.Errorf("ldap: %w", err)
+	}
+
+	if resp.messageID == 0 && resp.name == ldapNoticeOfDisconnectionOID {
+		return fmt.Errorf("%w: ldap: server sent notice of disconnection: %s",
+			ErrStartTLSNotSupported, sanitizeResponse(resp.diagnostic))
+	}
+
+	if resp.messageID != ldapMessageID {
+		return fmt.Errorf("%w: ldap: unexpected message ID %d", ErrInvalidResponse, resp.messageID)
+	}
+
+	if resp.resultCode != ldapResultSuccess {
+		return &LDAPError{ResultCode: resp.resultCode, Message: sanitizeResponse(resp.diagnostic)}
+	}
+
+	return nil
+}
+
+func (p *ldapProtocol) Name() string {
+	return p.name
+}
+
+// createStartTLSRequest encodes the StartTLS ExtendedRequest LDAPMessage.
+func (p *ldapProtocol) createStartTLSRequest() []byte {
+	messageID := ber.Encode(ber.TagInteger, []byte{ldapMessageID})
+	requestName := ber.Encode(ldapTagRequestName, []byte(ldapStartTLSOID))
+	extendedReq := ber.Encode(ldapTagExtendedRequest, requestName)
+
+	return ber.Encode(ber.TagSequence, append(messageID, extendedReq...))
+}
+
+// ldapExtendedResponse holds the fields of an ExtendedResponse used by the handshake.
+type ldapExtendedResponse struct {
+	messageID  int
+	resultCode int
+	diagnostic string
+	name       string
+}
+
+// parseExtendedResponse decodes an LDAPMessage carrying an ExtendedResponse.
+func (p *ldapProtocol) parseExtendedResponse(msg ber.Element) (*ldapExtendedResponse, error) {
+	if msg.Tag != ber.TagSequence {
+		return nil, fmt.Errorf("%w: expected LDAPMessage sequence, got tag 0x%02x", ErrInvalidResponse, msg.Tag)
+	}
+
+	id, rest, err := ber.Parse(msg.Value)
+	if err != nil || id.Tag != ber.TagInteger {
+		return nil, fmt.Errorf("%w: malformed message ID", ErrInvalidResponse)
+	}
+
+	op, _, err := ber.Parse(rest)
+	if err != nil || op.Tag != ldapTagExtendedResponse {
+		return nil, fmt.Errorf("%w: expected ExtendedResponse", ErrInvalidResponse)
+	}
+
+	resp := &ldapExtendedResponse{messageID: ber.Int(id.Value)}
+
+	// resultCode, matchedDN and diagnosticMessage are followed by optional
+	// referral, responseName and responseValue elements.
+	fields, err := ber.Children(op.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed ExtendedResponse: %w", ErrInvalidResponse, err)
+	}
+
+	if len(fields) == 0 || fields[0].Tag != ber.TagEnumerated {
+		return nil, fmt.Errorf("%w: malformed result code", ErrInvalidResponse)
+	}
+
+	resp.resultCode = ber.Int(fields[0].Value)
+
+	if len(fields) < 3 || fields[2].Tag != ber.TagOctetString {
+		return nil, fmt.Errorf("%w: ExtendedResponse missing diagnostic message", ErrInvalidResponse)
+	}
+
+	resp.diagnostic = string(fields[2].Value)
+
+	for _, field := range fields[3:] {
+		if field.Tag == ldapTagResponseName {
+			resp.name = string(field.Value)
+		}
+	}
+
+	return resp, nil
+}
+
+// readLDAPMessage reads a complete BER-encoded LDAPMessage from r.
+func readLDAPMessage(ctx context.Context, r *bufio.Reader) (ber.Element, error) {
+	return readContext(ctx, func() (ber.Element, error) {
+		return ber.Read(r)
+	})
+}
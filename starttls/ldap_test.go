@@ -0,0 +1,87 @@
+package starttls
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/jsandas/starttls-go/starttls/internal/ber"
+)
+
+func buildLDAPExtendedResponse(messageID, resultCode byte, diagnostic, name string) []byte {
+	fields := ber.Encode(ber.TagEnumerated, []byte{resultCode})
+	fields = append(fields, ber.Encode(ber.TagOctetString, nil)...)
+	fields = append(fields, ber.Encode(ber.TagOctetString, []byte(diagnostic))...)
+
+	if name != "" {
+		fields = append(fields, ber.Encode(ldapTagResponseName, []byte(name))...)
+	}
+
+	msg := ber.Encode(ber.TagInteger, []byte{messageID})
+	msg = append(msg, ber.Encode(ldapTagExtendedResponse, fields)...)
+
+	return ber.Encode(ber.TagSequence, msg)
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	tests := []struct {
+		name          string
+		response      []byte
+		expectedError error
+	}{
+		{
+			name:     "success",
+			response: buildLDAPExtendedResponse(1, ldapResultSuccess, "", ldapStartTLSOID),
+		},
+		{
+			name:          "unavailable",
+			response:      buildLDAPExtendedResponse(1, 52, "StartTLS not configured", ""),
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "notice of disconnection",
+			response:      buildLDAPExtendedResponse(0, 2, "unsupported extended operation", ldapNoticeOfDisconnectionOID),
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "wrong message id",
+			response:      buildLDAPExtendedResponse(7, ldapResultSuccess, "", ""),
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "not an extended response",
+			response:      ber.Encode(ber.TagSequence, ber.Encode(ber.TagInteger, []byte{1})),
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request []byte
+
+			_, err := negotiateWithHandler(t, "389", func(conn net.Conn) {
+				elem, err := ber.Read(conn)
+				if err != nil {
+					return
+				}
+
+				request = ber.Encode(elem.Tag, elem.Value)
+
+				conn.Write(tt.response)
+			})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !bytes.Contains(request, []byte(ldapStartTLSOID)) {
+				t.Errorf("Request does not carry the StartTLS OID: %x", request)
+			}
+		})
+	}
+}
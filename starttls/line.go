@@ -0,0 +1,114 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Line protocol implementation for caller-defined STARTTLS dialects.
+type lineProtocol struct {
+	BaseProtocol
+	// greetMsg is nil when the client speaks first.
+	greetMsg func(line string) bool
+	respMsg  func(line string) bool
+}
+
+// NewLineProtocol returns a protocol for a simple line-based STARTTLS dialect:
+// wait for a line matching greetingPattern, send command, and expect a reply
+// matching responsePattern. An empty greetingPattern skips the greeting for
+// dialects where the client speaks first. CRLF is appended to command when
+// it has no line terminator.
+func NewLineProtocol(name ProtocolID, greetingPattern, command, responsePattern string) (StartTLSProtocol, error) {
+	var greetMsg func(string) bool
+
+	if greetingPattern != "" {
+		pattern, err := regexp.Compile(greetingPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid greeting pattern: %w", err)
+		}
+
+		greetMsg = pattern.MatchString
+	}
+
+	respMsg, err := regexp.Compile(responsePattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response pattern: %w", err)
+	}
+
+	if !strings.HasSuffix(command, "\n") {
+		command += "\r\n"
+	}
+
+	return &lineProtocol{
+		BaseProtocol: NewBaseProtocol(name, command),
+		greetMsg:     greetMsg,
+		respMsg:      respMsg.MatchString,
+	}, nil
+}
+
+func (p *lineProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	// A greeting matcher from the options makes the client wait for a
+	// greeting even when the dialect has none.
+	if p.greetMsg != nil || sessionFromContext(ctx).cfg.greetingMatcher != nil {
+		_, err := p.ReadGreeting(ctx, rw, p.greetMsg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.StartTLS(ctx, rw, p.respMsg)
+}
+
+// expectGreeting skips lines until match accepts one and returns it without
+// its terminator. With WithStrictMatching, the first line must match.
+func expectGreeting(ctx context.Context, rw *bufio.ReadWriter, match func(string) bool) (string, error) {
+	for {
+		line, err := readLine(ctx, rw.Reader)
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if match(line) {
+			return line, nil
+		}
+
+		if sessionFromContext(ctx).cfg.strictMatching {
+			return "", fmt.Errorf("%w: unexpected greeting: %s", ErrInvalidResponse, sanitizeResponse(line))
+		}
+	}
+}
+
+// sendStartTLS sends the upgrade command and checks its reply.
+func sendStartTLS(ctx context.Context, rw *bufio.ReadWriter, authMsg string, match func(string) bool) error {
+	_, err := rw.WriteString(authMsg)
+	if err != nil {
+		return err
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return err
+	}
+
+	return expectStartTLSResponse(ctx, rw, match)
+}
+
+// expectStartTLSResponse reads the first line of the reply to the upgrade
+// command and checks it with match.
+func expectStartTLSResponse(ctx context.Context, rw *bufio.ReadWriter, match func(string) bool) error {
+	line, err := readLine(ctx, rw.Reader)
+	if err != nil {
+		return err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if !match(line) {
+		return fmt.Errorf("%w: %s", ErrStartTLSNotSupported, sanitizeResponse(line))
+	}
+
+	return nil
+}
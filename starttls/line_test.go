@@ -0,0 +1,129 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewLineProtocol(t *testing.T) {
+	tests := []struct {
+		name            string
+		greetingPattern string
+		serverMessages  []string
+		expectedCommand string
+		expectedError   error
+	}{
+		{
+			name:            "greeting and upgrade",
+			greetingPattern: "^\\+READY",
+			serverMessages:  []string{"* banner noise\r\n+READY appliance\r\n", "+GO\r\n"},
+			expectedCommand: "UPGRADE\r\n",
+		},
+		{
+			name:            "client speaks first",
+			serverMessages:  []string{"+GO\r\n"},
+			expectedCommand: "UPGRADE\r\n",
+		},
+		{
+			name:            "rejected",
+			greetingPattern: "^\\+READY",
+			serverMessages:  []string{"+READY appliance\r\n", "-NO tls\r\n"},
+			expectedCommand: "UPGRADE\r\n",
+			expectedError:   ErrStartTLSNotSupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewLineProtocol("appliance", tt.greetingPattern, "UPGRADE", "^\\+GO")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			client, server := net.Pipe()
+			defer client.Close()
+
+			commandCh := make(chan string, 1)
+
+			go func() {
+				defer server.Close()
+
+				messages := tt.serverMessages
+				if tt.greetingPattern != "" {
+					server.Write([]byte(messages[0]))
+					messages = messages[1:]
+				}
+
+				line, err := bufio.NewReader(server).ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				commandCh <- line
+
+				server.Write([]byte(messages[0]))
+			}()
+
+			err = p.Handshake(ctx, bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client)))
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if command := <-commandCh; command != tt.expectedCommand {
+				t.Errorf("Expected command %q, got %q", tt.expectedCommand, command)
+			}
+
+			if p.Name() != "appliance" {
+				t.Errorf("Expected name appliance, got %s", p.Name())
+			}
+		})
+	}
+}
+
+func TestLineProtocolStrictGreeting(t *testing.T) {
+	p, err := NewLineProtocol("appliance", "^\\+READY", "UPGRADE", "^\\+GO")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+
+		server.Write([]byte("* banner noise\r\n+READY appliance\r\n"))
+	}()
+
+	_, err = NegotiateWithProtocol(ctx, client, p, WithStrictMatching())
+	if !errors.Is(err, ErrInvalidResponse) {
+		t.Fatalf("Expected ErrInvalidResponse, got: %v", err)
+	}
+}
+
+func TestNewLineProtocolInvalidPattern(t *testing.T) {
+	_, err := NewLineProtocol("bad", "(", "UPGRADE", "^OK")
+	if err == nil {
+		t.Error("Expected error for invalid greeting pattern")
+	}
+
+	_, err = NewLineProtocol("bad", "^OK", "UPGRADE", "[")
+	if err == nil {
+		t.Error("Expected error for invalid response pattern")
+	}
+}
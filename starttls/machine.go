@@ -0,0 +1,410 @@
+package starttls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Step is a transition of a Machine.
+type Step struct {
+	// Name is StepGreeting, StepCapabilities or StepUpgrade.
+	Name string
+	// Send holds the command to write before reading the reply. It is
+	// empty for the greeting.
+	Send []byte
+	// Expect is the reply that lets the negotiation proceed: the reply code
+	// for SMTP, LMTP and FTP, e.g. "250", "+OK" for POP3, and the status
+	// "OK" for IMAP.
+	Expect string
+}
+
+// Machine runs the STARTTLS negotiation of SMTP, LMTP, IMAP, POP3 or FTP one
+// step at a time without doing any I/O, for callers that drive the
+// connection themselves, interleave their own commands, or instrument each
+// transition. Next returns the step in progress; the caller writes its Send
+// bytes and passes each line of the reply to Receive until Receive reports
+// the reply complete. Once Next reports no step and Done is true, the server
+// has accepted the upgrade and the TLS handshake can start:
+//
+//	for step, ok := m.Next(); ok; step, ok = m.Next() {
+//		conn.Write(step.Send)
+//
+//		for complete := false; !complete; {
+//			line, err := r.ReadString('\n')
+//			if err != nil {
+//				return err
+//			}
+//
+//			complete, err = m.Receive(line)
+//			if err != nil {
+//				return err
+//			}
+//		}
+//	}
+//
+// Commands the caller sends between steps must have their replies read by
+// the caller; IMAP commands must not use the tags of the Machine, which are
+// "a001", "a002" and so on.
+//
+// The Machine sends the commands Negotiate sends without options, and no
+// Option applies to it: it has no timeouts, hooks, events or audits, and
+// cannot send X-ANONYMOUSTLS, pipeline commands, request FTP features or
+// use another IMAP tag prefix.
+type Machine struct {
+	protocol ProtocolID
+	step     Step
+	// reply holds the lines of the reply received so far.
+	reply        []string
+	capabilities []string
+	// smtp and imap are the implementations of Negotiate that build the
+	// commands of the Machine, set for the protocols using them.
+	smtp *smtpProtocol
+	imap *imapProtocol
+	// upgrade is the command requesting the upgrade.
+	upgrade string
+	// tag is the tag of the IMAP command in progress.
+	tag string
+	err error
+}
+
+// NewMachine returns a Machine for the protocol registered under name by
+// default: "smtp", "lmtp", "imap", "pop3" or "ftp". Names are
+// case-insensitive; other names return ErrUnknownProtocol.
+func NewMachine(name ProtocolID) (*Machine, error) {
+	m := &Machine{protocol: ProtocolID(strings.ToLower(string(name)))}
+
+	switch m.protocol {
+	case ProtocolSMTP, ProtocolLMTP:
+		m.smtp = newSMTPProtocol()
+		if m.protocol == ProtocolLMTP {
+			m.smtp = newLMTPProtocol()
+		}
+
+		m.upgrade = m.smtp.authMsg
+		m.step = Step{Name: StepGreeting, Expect: smtpReadyCode}
+	case ProtocolFTP:
+		m.upgrade = newFTPProtocol().authMsg
+		m.step = Step{Name: StepGreeting, Expect: "220"}
+	case ProtocolIMAP:
+		m.imap = newIMAPProtocol()
+		m.upgrade = m.imap.authMsg
+		m.step = Step{Name: StepGreeting, Expect: "OK"}
+	case ProtocolPOP3:
+		m.upgrade = newPOP3Protocol().authMsg
+		m.step = Step{Name: StepGreeting, Expect: "+OK"}
+	default:
+		return nil, fmt.Errorf("%w: no state machine for %q", ErrUnknownProtocol, name)
+	}
+
+	return m, nil
+}
+
+// Next returns the step in progress, which stays the same until Receive
+// completes its reply. It returns false once the server has accepted the
+// upgrade or the negotiation has failed.
+func (m *Machine) Next() (Step, bool) {
+	if m.err != nil || m.step.Name == "" {
+		return Step{}, false
+	}
+
+	return m.step, true
+}
+
+// Receive passes the next line of the reply to the step in progress, with or
+// without its terminator, and reports whether the reply is complete, in which
+// case the machine moves on to the next step. A reply that does not let the
+// negotiation proceed returns the error Negotiate would, such as
+// ErrStartTLSNotSupported or an *SMTPError; the error is kept and returned by
+// later calls and Err.
+func (m *Machine) Receive(line string) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+
+	if m.step.Name == "" {
+		return false, fmt.Errorf("%s: negotiation already finished", m.protocol)
+	}
+
+	m.reply = append(m.reply, strings.TrimRight(line, "\r\n"))
+
+	var (
+		complete bool
+		err      error
+	)
+
+	switch m.protocol {
+	case ProtocolSMTP, ProtocolLMTP:
+		complete, err = m.receiveSMTP()
+	case ProtocolIMAP:
+		complete, err = m.receiveIMAP()
+	case ProtocolPOP3:
+		complete, err = m.receivePOP3()
+	case ProtocolFTP:
+		complete, err = m.receiveFTP()
+	}
+
+	if err != nil {
+		m.err = err
+
+		return false, err
+	}
+
+	if complete {
+		m.reply = nil
+	}
+
+	return complete, nil
+}
+
+// Done reports whether the server has accepted the upgrade.
+func (m *Machine) Done() bool {
+	return m.err == nil && m.step.Name == ""
+}
+
+// Err returns the error that ended the negotiation, if any.
+func (m *Machine) Err() error {
+	return m.err
+}
+
+// Capabilities returns the extensions or capabilities the server advertised,
+// like StartTLSResult.Capabilities.
+func (m *Machine) Capabilities() []string {
+	return m.capabilities
+}
+
+// receiveSMTP handles the replies of SMTP and LMTP, whose lines all carry
+// the reply code and end with one without a hyphen after it.
+func (m *Machine) receiveSMTP() (bool, error) {
+	line := m.reply[len(m.reply)-1]
+	if len(line) < 3 || line[:3] != m.reply[0][:3] {
+		return false, fmt.Errorf("%s: %w: malformed reply line: %s", m.protocol, ErrInvalidResponse, sanitizeResponse(line))
+	}
+
+	if len(line) > 3 && line[3] == '-' {
+		return false, nil
+	}
+
+	reply := m.codeReply()
+
+	switch m.step.Name {
+	case StepGreeting:
+		if reply.code != smtpReadyCode {
+			return false, fmt.Errorf("%s: greeting failed: %w", m.protocol, newSMTPError(m.protocol, reply, ErrInvalidResponse))
+		}
+
+		m.step = Step{Name: StepCapabilities, Send: []byte(m.smtp.helloCommand()), Expect: "250"}
+	case StepCapabilities:
+		if reply.code != "250" {
+			return false, fmt.Errorf("%s: %s failed: %w", m.protocol, m.smtp.helloCmd, newSMTPError(m.protocol, reply, ErrInvalidResponse))
+		}
+
+		caps := &SMTPCapabilities{Extensions: reply.lines[1:]}
+		m.capabilities = caps.Extensions
+
+		if !caps.Has("STARTTLS") {
+			return false, fmt.Errorf("%s: %w: %w: extensions: %s", m.protocol, ErrStartTLSNotAdvertised, ErrStartTLSNotSupported,
+				sanitizeResponse(strings.Join(caps.Extensions, ", ")))
+		}
+
+		m.step = Step{Name: StepUpgrade, Send: []byte(m.upgrade), Expect: smtpReadyCode}
+	case StepUpgrade:
+		if reply.code != smtpReadyCode {
+			return false, fmt.Errorf("%s: STARTTLS failed: %w", m.protocol, newSMTPError(m.protocol, reply, ErrStartTLSNotSupported))
+		}
+
+		m.step = Step{}
+	}
+
+	return true, nil
+}
+
+// receiveFTP handles FTP replies. A multiline reply starts with "xyz-" and
+// ends with a line starting with "xyz "; the lines in between may contain
+// anything.
+func (m *Machine) receiveFTP() (bool, error) {
+	first, line := m.reply[0], m.reply[len(m.reply)-1]
+	if len(first) < 3 {
+		return false, fmt.Errorf("ftp: %w: malformed reply line: %s", ErrInvalidResponse, sanitizeResponse(first))
+	}
+
+	if len(first) > 3 && first[3] == '-' && (len(m.reply) == 1 || !strings.HasPrefix(line, first[:3]+" ")) {
+		return false, nil
+	}
+
+	reply := m.codeReply()
+
+	switch {
+	case m.step.Name == StepGreeting && reply.code == "120":
+		// A 120 reply announces a delay and is followed by the greeting.
+		m.reply = nil
+
+		return false, nil
+	case m.step.Name == StepGreeting && reply.code != "220":
+		return false, fmt.Errorf("ftp: unexpected greeting: %w", newFTPError(reply, ErrInvalidResponse))
+	case m.step.Name == StepGreeting:
+		m.step = Step{Name: StepUpgrade, Send: []byte(m.upgrade), Expect: "234"}
+	case reply.code == "234":
+		m.step = Step{}
+	default:
+		return false, fmt.Errorf("ftp: AUTH TLS failed: %w", newFTPError(reply, ftpAuthTLSError(reply.code)))
+	}
+
+	return true, nil
+}
+
+// codeReply returns the complete reply received for a protocol with reply
+// codes. Only the first and last lines of a multiline FTP reply carry the
+// code.
+func (m *Machine) codeReply() *codeReply {
+	reply := &codeReply{code: m.reply[0][:3], raw: m.reply}
+
+	for i, line := range m.reply {
+		if m.protocol != ProtocolFTP || i == 0 || i == len(m.reply)-1 {
+			line = line[min(len(line), 4):]
+		}
+
+		reply.lines = append(reply.lines, strings.TrimSpace(line))
+	}
+
+	return reply
+}
+
+// receiveIMAP handles the IMAP greeting and the untagged and tagged
+// responses to the commands of the machine.
+func (m *Machine) receiveIMAP() (bool, error) {
+	line := m.reply[len(m.reply)-1]
+
+	if m.step.Name == StepGreeting {
+		status, err := parseIMAPGreeting(line)
+		if err != nil {
+			return false, fmt.Errorf("imap: greeting failed: %w", err)
+		}
+
+		switch status {
+		case "PREAUTH":
+			return false, fmt.Errorf("imap: %w: %w", ErrIMAPPreauth, ErrStartTLSNotSupported)
+		case "BYE":
+			return false, fmt.Errorf("imap: server refused the connection: %w", newIMAPError(line, ErrInvalidResponse))
+		}
+
+		caps := parseIMAPGreetingCapabilities(line)
+		if caps == nil {
+			m.step = m.imapCommand(StepCapabilities, "CAPABILITY")
+
+			return true, nil
+		}
+
+		return true, m.imapUpgrade(caps)
+	}
+
+	if data, ok := strings.CutPrefix(line, "* "); ok {
+		if atoms, ok := strings.CutPrefix(data, "CAPABILITY "); ok && m.step.Name == StepCapabilities {
+			m.capabilities = append(m.capabilities, strings.Fields(atoms)...)
+		}
+
+		return false, nil
+	}
+
+	text, ok := strings.CutPrefix(line, m.tag+" ")
+	if !ok {
+		return false, fmt.Errorf("%w: unexpected response to %s: %s", ErrInvalidResponse, m.tag, sanitizeResponse(line))
+	}
+
+	status, _, _ := strings.Cut(text, " ")
+
+	switch status = strings.ToUpper(status); {
+	case m.step.Name == StepCapabilities && status != "OK":
+		return false, fmt.Errorf("imap: CAPABILITY failed: %w: %s", ErrInvalidResponse, sanitizeResponse(line))
+	case m.step.Name == StepCapabilities:
+		return true, m.imapUpgrade(m.capabilities)
+	case status == "OK":
+		m.step = Step{}
+	case status == "NO" || status == "BAD":
+		return false, newIMAPError(line, ErrStartTLSNotSupported)
+	default:
+		return false, fmt.Errorf("%w: imap: STARTTLS: %s", ErrInvalidResponse, sanitizeResponse(line))
+	}
+
+	return true, nil
+}
+
+// imapUpgrade moves to STARTTLS when caps advertise it.
+func (m *Machine) imapUpgrade(caps []string) error {
+	m.capabilities = caps
+
+	if !(&IMAPCapabilities{Capabilities: caps}).Has("STARTTLS") {
+		return fmt.Errorf("imap: %w: %w: capabilities: %s", ErrStartTLSNotAdvertised, ErrStartTLSNotSupported,
+			sanitizeResponse(strings.Join(caps, " ")))
+	}
+
+	m.step = m.imapCommand(StepUpgrade, m.upgrade)
+
+	return nil
+}
+
+// imapCommand returns a step sending command with the next tag.
+func (m *Machine) imapCommand(name, command string) Step {
+	var line string
+
+	m.tag, line = m.imap.taggedCommand(command)
+
+	return Step{Name: name, Send: []byte(line), Expect: "OK"}
+}
+
+// receivePOP3 handles the POP3 status lines and the CAPA listing, which
+// ends with a line holding a single dot.
+func (m *Machine) receivePOP3() (bool, error) {
+	line := m.reply[len(m.reply)-1]
+
+	if m.step.Name == StepCapabilities && len(m.reply) > 1 {
+		if line != "." {
+			return false, nil
+		}
+
+		for _, capability := range m.reply[1 : len(m.reply)-1] {
+			// Undo byte-stuffing of lines starting with a dot.
+			m.capabilities = append(m.capabilities, strings.TrimPrefix(capability, "."))
+		}
+
+		if !(&POP3Info{Capabilities: m.capabilities}).Has("STLS") {
+			return false, fmt.Errorf("pop3: %w: %w: capabilities: %s", ErrStartTLSNotAdvertised, ErrStartTLSNotSupported,
+				sanitizeResponse(strings.Join(m.capabilities, ", ")))
+		}
+
+		m.step = Step{Name: StepUpgrade, Send: []byte(m.upgrade), Expect: "+OK"}
+
+		return true, nil
+	}
+
+	ok, err := parsePOP3Status(line)
+	if err != nil {
+		return false, fmt.Errorf("pop3: %w", err)
+	}
+
+	switch m.step.Name {
+	case StepGreeting:
+		if !ok {
+			return false, fmt.Errorf("pop3: server refused the connection: %w", newPOP3Error(line, ErrInvalidResponse))
+		}
+
+		m.step = Step{Name: StepCapabilities, Send: []byte(pop3CapaCommand), Expect: "+OK"}
+
+		return true, nil
+	case StepCapabilities:
+		if !ok {
+			return false, fmt.Errorf("pop3: CAPA failed: %w: %w: CAPA not supported: %s", ErrStartTLSNotAdvertised,
+				ErrStartTLSNotSupported, sanitizeResponse(line))
+		}
+
+		// The capabilities follow the status line.
+		return false, nil
+	default:
+		if !ok {
+			return false, fmt.Errorf("pop3: STARTTLS failed: %w", newPOP3Error(line, ErrStartTLSNotSupported))
+		}
+
+		m.step = Step{}
+
+		return true, nil
+	}
+}
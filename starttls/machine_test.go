@@ -0,0 +1,260 @@
+package starttls
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runMachine feeds m one reply per step and returns the commands it sent
+// and the error that ended the negotiation.
+func runMachine(m *Machine, replies []string) ([]string, error) {
+	var sent []string
+
+	for _, reply := range replies {
+		step, ok := m.Next()
+		if !ok {
+			break
+		}
+
+		if len(step.Send) > 0 {
+			sent = append(sent, strings.TrimSpace(string(step.Send)))
+		}
+
+		for line := range strings.Lines(reply) {
+			_, err := m.Receive(line)
+			if err != nil {
+				return sent, err
+			}
+		}
+	}
+
+	return sent, nil
+}
+
+func TestMachine(t *testing.T) {
+	tests := []struct {
+		name                 string
+		protocol             ProtocolID
+		replies              []string
+		expectedSent         []string
+		expectedCapabilities []string
+		expectedError        error
+	}{
+		{
+			name:                 "smtp",
+			protocol:             "smtp",
+			replies:              []string{"220-mail.test\r\n220 ESMTP\r\n", serverMessagesSMTP, "220 go ahead\r\n"},
+			expectedSent:         []string{"EHLO tlstools.com", "STARTTLS"},
+			expectedCapabilities: []string{"STARTTLS"},
+		},
+		{
+			name:          "smtp rejected",
+			protocol:      "smtp",
+			replies:       []string{serverMessagesStart, serverMessagesSMTP, "454 4.7.0 TLS not available\r\n"},
+			expectedSent:  []string{"EHLO tlstools.com", "STARTTLS"},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "lmtp not advertised",
+			protocol:      "LMTP",
+			replies:       []string{serverMessagesStart, "250-lmtp.test\r\n250 PIPELINING\r\n"},
+			expectedSent:  []string{"LHLO tlstools.com"},
+			expectedError: ErrStartTLSNotAdvertised,
+		},
+		{
+			name:                 "imap capabilities in greeting",
+			protocol:             "imap",
+			replies:              []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n", "a001 OK Begin TLS\r\n"},
+			expectedSent:         []string{"a001 STARTTLS"},
+			expectedCapabilities: []string{"IMAP4rev1", "STARTTLS"},
+		},
+		{
+			name:     "imap capability command",
+			protocol: "imap",
+			replies: []string{
+				"* OK ready\r\n",
+				"* CAPABILITY IMAP4rev1 STARTTLS\r\na001 OK done\r\n",
+				"a002 OK Begin TLS\r\n",
+			},
+			expectedSent:         []string{"a001 CAPABILITY", "a002 STARTTLS"},
+			expectedCapabilities: []string{"IMAP4rev1", "STARTTLS"},
+		},
+		{
+			name:          "imap preauth",
+			protocol:      "imap",
+			replies:       []string{"* PREAUTH logged in\r\n"},
+			expectedError: ErrIMAPPreauth,
+		},
+		{
+			name:                 "pop3",
+			protocol:             "pop3",
+			replies:              []string{serverMessagesPOP3, "+OK\r\nTOP\r\nSTLS\r\n.\r\n", "+OK Begin TLS\r\n"},
+			expectedSent:         []string{"CAPA", "STLS"},
+			expectedCapabilities: []string{"TOP", "STLS"},
+		},
+		{
+			name:          "pop3 rejected",
+			protocol:      "pop3",
+			replies:       []string{serverMessagesPOP3, "+OK\r\nSTLS\r\n.\r\n", "-ERR not now\r\n"},
+			expectedSent:  []string{"CAPA", "STLS"},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:         "ftp",
+			protocol:     "ftp",
+			replies:      []string{"120 wait\r\n220-welcome\r\n 220 text\r\n220 ready\r\n", "234 AUTH TLS OK\r\n"},
+			expectedSent: []string{"AUTH TLS"},
+		},
+		{
+			name:          "ftp policy denied",
+			protocol:      "ftp",
+			replies:       []string{"220 ready\r\n", "534 denied\r\n"},
+			expectedSent:  []string{"AUTH TLS"},
+			expectedError: ErrFTPPolicyDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMachine(tt.protocol)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			sent, err := runMachine(m, tt.replies)
+
+			if !slices.Equal(sent, tt.expectedSent) {
+				t.Errorf("Expected commands %q, got %q", tt.expectedSent, sent)
+			}
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) || !errors.Is(m.Err(), tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+
+				if m.Done() {
+					t.Error("Expected the machine not to be done after a failure")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !m.Done() {
+				t.Error("Expected the machine to be done")
+			}
+
+			if _, ok := m.Next(); ok {
+				t.Error("Expected no further step")
+			}
+
+			if !slices.Equal(m.Capabilities(), tt.expectedCapabilities) {
+				t.Errorf("Expected capabilities %q, got %q", tt.expectedCapabilities, m.Capabilities())
+			}
+		})
+	}
+}
+
+func TestMachineSteps(t *testing.T) {
+	m, err := NewMachine("smtp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []Step{
+		{Name: StepGreeting, Expect: "220"},
+		{Name: StepCapabilities, Send: []byte("EHLO tlstools.com\r\n"), Expect: "250"},
+		{Name: StepUpgrade, Send: []byte("STARTTLS\r\n"), Expect: "220"},
+	}
+
+	replies := []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart}
+
+	for i, reply := range replies {
+		step, ok := m.Next()
+		if !ok || step.Name != expected[i].Name || string(step.Send) != string(expected[i].Send) || step.Expect != expected[i].Expect {
+			t.Fatalf("Expected step %+v, got %+v", expected[i], step)
+		}
+
+		for line := range strings.Lines(reply) {
+			complete, err := m.Receive(line)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if again, _ := m.Next(); !complete && again.Name != step.Name {
+				t.Fatalf("Step changed before the reply was complete")
+			}
+		}
+	}
+
+	_, err = m.Receive("220 again\r\n")
+	if err == nil {
+		t.Error("Expected an error when receiving after the negotiation finished")
+	}
+}
+
+func TestMachineMatchesDryRun(t *testing.T) {
+	servers := []struct {
+		protocol ProtocolID
+		greeting string
+		respond  func(command string) string
+	}{
+		{protocol: ProtocolSMTP, greeting: "220 dry-run ESMTP\r\n", respond: dryRunSMTPReply},
+		{protocol: ProtocolLMTP, greeting: "220 dry-run ESMTP\r\n", respond: dryRunSMTPReply},
+		{protocol: ProtocolIMAP, greeting: "* OK dry-run ready\r\n", respond: dryRunIMAPReply},
+		{protocol: ProtocolPOP3, greeting: "+OK dry-run ready\r\n", respond: dryRunPOP3Reply},
+		{protocol: ProtocolFTP, greeting: "220 dry-run ready\r\n", respond: dryRunFTPReply},
+	}
+
+	for _, server := range servers {
+		t.Run(string(server.protocol), func(t *testing.T) {
+			expected, err := DryRun(server.protocol)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			m, err := NewMachine(server.protocol)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var sent []string
+
+			reply := server.greeting
+			for step, ok := m.Next(); ok; step, ok = m.Next() {
+				if len(step.Send) > 0 {
+					sent = append(sent, string(step.Send))
+					reply = server.respond(strings.TrimRight(string(step.Send), "\r\n"))
+				}
+
+				for line := range strings.Lines(reply) {
+					_, err = m.Receive(line)
+					if err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+				}
+			}
+
+			var want []string
+			for _, b := range expected {
+				want = append(want, string(b))
+			}
+
+			if !m.Done() || !slices.Equal(sent, want) {
+				t.Errorf("Expected the commands of Negotiate %q, got %q", want, sent)
+			}
+		})
+	}
+}
+
+func TestNewMachineUnknownProtocol(t *testing.T) {
+	_, err := NewMachine("mysql")
+	if !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol, got %v", err)
+	}
+}
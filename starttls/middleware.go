@@ -0,0 +1,46 @@
+package starttls
+
+// Middleware wraps a protocol to add behavior around its handshake, such
+// as rate limiting, logging or metrics:
+//
+//	func timed(next starttls.StartTLSProtocol) starttls.StartTLSProtocol {
+//		return timedProtocol{next}
+//	}
+//
+// The wrapper's Handshake is called in place of the protocol's. Options
+// that need more of the protocol than Handshake and Name, such as
+// WithGracefulQuit and WithRejectionObservation, keep using the wrapped
+// protocol, and the result reports the wrapped protocol's name.
+type Middleware func(StartTLSProtocol) StartTLSProtocol
+
+// RegisterMiddleware adds middleware applied to every negotiation, around
+// the middleware passed with WithMiddleware. The first middleware is the
+// outermost. Use ResetMiddleware to remove it again.
+func RegisterMiddleware(middleware ...Middleware) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.middleware = append(registry.middleware, middleware...)
+}
+
+// ResetMiddleware removes all middleware added with RegisterMiddleware.
+func ResetMiddleware() {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.middleware = nil
+}
+
+// applyMiddleware wraps protocol in the registered middleware and then in
+// that of cfg, so that the first registered middleware is the outermost.
+func applyMiddleware(cfg *config, protocol StartTLSProtocol) StartTLSProtocol {
+	registry.RLock()
+	chain := append(registry.middleware[:len(registry.middleware):len(registry.middleware)], cfg.middleware...)
+	registry.RUnlock()
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		protocol = chain[i](protocol)
+	}
+
+	return protocol
+}
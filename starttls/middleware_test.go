@@ -0,0 +1,105 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// recordingProtocol appends its name to calls before and after the handshake
+// of the protocol it wraps.
+type recordingProtocol struct {
+	StartTLSProtocol
+	name  string
+	calls *[]string
+	err   *error
+}
+
+func (p recordingProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	*p.calls = append(*p.calls, p.name+" before")
+	err := p.StartTLSProtocol.Handshake(ctx, rw)
+	*p.calls = append(*p.calls, p.name+" after")
+
+	if p.err != nil {
+		*p.err = err
+	}
+
+	return err
+}
+
+func recording(name string, calls *[]string, err *error) Middleware {
+	return func(next StartTLSProtocol) StartTLSProtocol {
+		return recordingProtocol{StartTLSProtocol: next, name: name, calls: calls, err: err}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	t.Cleanup(ResetMiddleware)
+
+	var calls []string
+
+	RegisterMiddleware(recording("registered", &calls, nil))
+
+	result, err := negotiateWithServer(t, "25", []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart},
+		WithMiddleware(recording("first", &calls, nil), recording("second", &calls, nil)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"registered before", "first before", "second before", "second after", "first after", "registered after"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected calls %q, got %q", expected, calls)
+	}
+
+	if result.Protocol != ProtocolSMTP {
+		t.Errorf("Expected the wrapped protocol name, got %q", result.Protocol)
+	}
+
+	ResetMiddleware()
+	calls = nil
+
+	_, err = negotiateWithServer(t, "587", []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(calls) != 0 {
+		t.Errorf("Expected no calls after ResetMiddleware, got %q", calls)
+	}
+}
+
+func TestMiddlewareGracefulQuit(t *testing.T) {
+	var calls []string
+	var handshakeErr error
+	var commands []string
+
+	_, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+		_, _ = conn.Write([]byte(serverMessagesStart))
+
+		r := bufio.NewReader(conn)
+		for _, reply := range []string{serverMessagesSMTPNoTLS, "221 bye\r\n"} {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			commands = append(commands, strings.TrimSpace(line))
+			_, _ = conn.Write([]byte(reply))
+		}
+	}, WithGracefulQuit(), WithMiddleware(recording("mw", &calls, &handshakeErr)))
+
+	if !errors.Is(err, ErrStartTLSNotAdvertised) {
+		t.Fatalf("Expected ErrStartTLSNotAdvertised, got %v", err)
+	}
+
+	if !errors.Is(handshakeErr, ErrStartTLSNotAdvertised) {
+		t.Errorf("Expected the middleware to see the handshake error, got %v", handshakeErr)
+	}
+
+	if len(commands) == 0 || commands[len(commands)-1] != "QUIT" {
+		t.Errorf("Expected QUIT through the middleware, got %q", commands)
+	}
+}
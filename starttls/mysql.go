@@ -0,0 +1,214 @@
+package starttls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // mysql_native_password is defined in terms of SHA-1
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MySQL authentication plugins understood by AuthenticateMySQL.
+const (
+	mysqlNativePassword = "mysql_native_password"
+	mysqlCachingSHA2    = "caching_sha2_password"
+	mysqlSHA256Password = "sha256_password"
+	mysqlClearPassword  = "mysql_clear_password"
+)
+
+// MySQL authentication constants.
+const (
+	clientPluginAuthLenencData = 0x00200000
+	mysqlOKPacket              = 0x00
+	mysqlAuthMoreData          = 0x01
+	mysqlAuthSwitch            = 0xfe
+	cachingSHA2FastAuthOK      = 0x03
+	cachingSHA2FullAuth        = 0x04
+	// maxMySQLAuthRounds bounds the number of server packets read during
+	// authentication, so a misbehaving server cannot keep it going.
+	maxMySQLAuthRounds = 4
+)
+
+// AuthenticateMySQL completes the MySQL login over the TLS connection by
+// sending the HandshakeResponse41 and answering auth switch and
+// caching_sha2_password requests, so that a scan can verify a login over
+// TLS works end to end, not just that the server accepts the SSL request.
+//
+// conn must be the upgraded connection, typically the *tls.Conn wrapping
+// the connection passed to Negotiate, and result the result Negotiate
+// returned for it. opts must be the options passed to Negotiate, since the
+// response repeats the flags, character set and connection attributes of
+// the SSL request. The server's plugin is only used when the client flags
+// include CLIENT_PLUGIN_AUTH (0x00080000); otherwise mysql_native_password
+// is assumed. Rejected credentials are returned as a *MySQLServerError.
+//
+// mysql_native_password, caching_sha2_password, sha256_password and
+// mysql_clear_password are supported; the last two, and the full
+// caching_sha2_password authentication, send the password in the clear
+// inside the TLS session.
+func AuthenticateMySQL(ctx context.Context, conn io.ReadWriter, result *StartTLSResult, user, password string, opts ...Option) error {
+	info, ok := ResultDetails[*MySQLHandshakeInfo](result)
+	if !ok || !result.TLSEstablished {
+		return errors.New("mysql: authentication requires the result of a successful MySQL negotiation")
+	}
+
+	cfg := newConfig(opts)
+	flags := mysqlClientFlags(cfg)
+
+	plugin := mysqlNativePassword
+	if flags&clientPluginAuth != 0 && info.AuthPluginName != "" {
+		plugin = info.AuthPluginName
+	}
+
+	authResponse, ok := mysqlAuthResponse(plugin, password, info.scramble)
+	if !ok {
+		// The server switches to the plugin the account uses, so an
+		// unknown default plugin is not an error yet.
+		plugin = mysqlNativePassword
+		authResponse, _ = mysqlAuthResponse(plugin, password, info.scramble)
+	}
+
+	payload := appendMySQLClientHeader(nil, cfg)
+	payload = append(payload, user...)
+	payload = append(payload, 0)
+
+	switch {
+	case flags&clientPluginAuthLenencData != 0:
+		payload = appendMySQLLengthEncodedString(payload, string(authResponse))
+	case flags&clientSecureConn != 0:
+		payload = append(payload, byte(len(authResponse)))
+		payload = append(payload, authResponse...)
+	default:
+		payload = append(payload, authResponse...)
+		payload = append(payload, 0)
+	}
+
+	if flags&clientPluginAuth != 0 {
+		payload = append(payload, plugin...)
+		payload = append(payload, 0)
+	}
+
+	if flags&clientConnectAttrs != 0 {
+		payload = appendMySQLConnectAttrs(payload, cfg.mysqlConnectAttrs)
+	}
+
+	// The SSL request was packet 1, so the response continues from it.
+	p := &mysqlProtocol{name: string(ProtocolMySQL), sequence: 1}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	err := p.writeMySQLPacket(rw, payload)
+	if err != nil {
+		return fmt.Errorf("mysql: failed to write handshake response: %w", err)
+	}
+
+	for range maxMySQLAuthRounds {
+		body, err := readContext(ctx, func() ([]byte, error) {
+			return p.readMySQLPacket(rw, p.sequence+1)
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(body) == 0 {
+			return fmt.Errorf("%w: mysql: empty authentication packet", ErrInvalidResponse)
+		}
+
+		switch {
+		case body[0] == mysqlOKPacket:
+			return nil
+		case body[0] == mysqlErrPacket:
+			return parseMySQLErrPacket(body)
+		case body[0] == mysqlAuthSwitch:
+			name, data, _ := bytes.Cut(body[1:], []byte{0})
+			plugin = string(name)
+
+			authResponse, ok = mysqlAuthResponse(plugin, password, strings.TrimSuffix(string(data), "\x00"))
+			if !ok {
+				return fmt.Errorf("mysql: unsupported authentication plugin %q", sanitizeResponse(plugin))
+			}
+
+			err = p.writeMySQLPacket(rw, authResponse)
+		case body[0] == mysqlAuthMoreData && plugin == mysqlCachingSHA2 && len(body) == 2:
+			if body[1] == cachingSHA2FastAuthOK {
+				continue
+			}
+
+			if body[1] != cachingSHA2FullAuth {
+				return fmt.Errorf("%w: mysql: unexpected caching_sha2_password state %d", ErrInvalidResponse, body[1])
+			}
+
+			// Full authentication sends the password itself, which the
+			// TLS session protects.
+			err = p.writeMySQLPacket(rw, append([]byte(password), 0))
+		default:
+			return fmt.Errorf("%w: mysql: unexpected authentication packet 0x%02x", ErrInvalidResponse, body[0])
+		}
+
+		if err != nil {
+			return fmt.Errorf("mysql: failed to write authentication data: %w", err)
+		}
+	}
+
+	return fmt.Errorf("%w: mysql: authentication did not complete", ErrInvalidResponse)
+}
+
+// writeMySQLPacket writes payload as the next packet of the sequence.
+func (p *mysqlProtocol) writeMySQLPacket(rw *bufio.ReadWriter, payload []byte) error {
+	p.sequence++
+
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), p.sequence}
+
+	_, err := rw.Write(append(header, payload...))
+	if err != nil {
+		return err
+	}
+
+	return rw.Flush()
+}
+
+// mysqlAuthResponse computes the authentication data plugin sends for
+// password, reporting whether the plugin is supported.
+func mysqlAuthResponse(plugin, password, scramble string) ([]byte, bool) {
+	switch plugin {
+	case mysqlNativePassword:
+		if password == "" {
+			return nil, true
+		}
+
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		hash := sha1.Sum([]byte(password))
+		hash2 := sha1.Sum(hash[:])
+		mask := sha1.Sum(append([]byte(scramble), hash2[:]...))
+
+		return xorBytes(hash[:], mask[:]), true
+	case mysqlCachingSHA2:
+		if password == "" {
+			return nil, true
+		}
+
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		hash := sha256.Sum256([]byte(password))
+		hash2 := sha256.Sum256(hash[:])
+		mask := sha256.Sum256(append(hash2[:], scramble...))
+
+		return xorBytes(hash[:], mask[:]), true
+	case mysqlSHA256Password, mysqlClearPassword:
+		return append([]byte(password), 0), true
+	default:
+		return nil, false
+	}
+}
+
+// xorBytes returns a XOR b for slices of equal length.
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+
+	return out
+}
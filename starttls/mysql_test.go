@@ -0,0 +1,220 @@
+package starttls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // mysql_native_password is defined in terms of SHA-1
+	"crypto/sha256"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+const testMySQLScramble = "abcdefghijklmnopqrst"
+
+// parseMySQLHandshakeResponse splits a HandshakeResponse41 sent with
+// CLIENT_SECURE_CONNECTION into the user, auth response and plugin name,
+// returning the remaining bytes.
+func parseMySQLHandshakeResponse(t *testing.T, body []byte) (string, []byte, string, []byte) {
+	t.Helper()
+
+	// Called from the server goroutine, so it must not use t.Fatal.
+	if len(body) < 34 {
+		t.Errorf("Handshake response too short: %x", body)
+
+		return "", nil, "", nil
+	}
+
+	user, rest, _ := bytes.Cut(body[32:], []byte{0})
+	auth := rest[1 : 1+int(rest[0])]
+	rest = rest[1+int(rest[0]):]
+	plugin, rest, _ := bytes.Cut(rest, []byte{0})
+
+	return string(user), auth, string(plugin), rest
+}
+
+// verifyNativePassword checks a mysql_native_password response the way the
+// server does, from the stored SHA1(SHA1(password)).
+func verifyNativePassword(response []byte, password string) bool {
+	hash := sha1.Sum([]byte(password))
+	stored := sha1.Sum(hash[:])
+	mask := sha1.Sum(append([]byte(testMySQLScramble), stored[:]...))
+	candidate := sha1.Sum(xorBytes(response, mask[:]))
+
+	return len(response) == sha1.Size && candidate == stored
+}
+
+// verifyCachingSHA2Password checks a caching_sha2_password fast
+// authentication response from the stored SHA256(SHA256(password)).
+func verifyCachingSHA2Password(response []byte, password string) bool {
+	hash := sha256.Sum256([]byte(password))
+	stored := sha256.Sum256(hash[:])
+	mask := sha256.Sum256(append(stored[:], testMySQLScramble...))
+	candidate := sha256.Sum256(xorBytes(response, mask[:]))
+
+	return len(response) == sha256.Size && candidate == stored
+}
+
+func TestAuthenticateMySQL(t *testing.T) {
+	pluginFlags := WithMySQLClientFlags(clientSecureConn | clientPluginAuth)
+
+	tests := []struct {
+		name        string
+		plugin      string
+		opts        []Option
+		server      func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter)
+		expectError bool
+		// expectedCode is the MySQL error number of a *MySQLServerError.
+		expectedCode uint16
+	}{
+		{
+			name:   "native password",
+			plugin: mysqlNativePassword,
+			server: func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter) {
+				body, _ := p.readMySQLPacket(rw, 2)
+
+				user, auth, _, _ := parseMySQLHandshakeResponse(t, body)
+				if user != "scanner" || !verifyNativePassword(auth, "secret") {
+					t.Errorf("Unexpected response for %q: %x", user, auth)
+				}
+
+				_ = p.writeMySQLPacket(rw, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0})
+			},
+		},
+		{
+			name:   "caching sha2 fast auth",
+			plugin: mysqlCachingSHA2,
+			opts:   []Option{pluginFlags},
+			server: func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter) {
+				body, _ := p.readMySQLPacket(rw, 2)
+
+				_, auth, plugin, _ := parseMySQLHandshakeResponse(t, body)
+				if plugin != mysqlCachingSHA2 || !verifyCachingSHA2Password(auth, "secret") {
+					t.Errorf("Unexpected %s response: %x", plugin, auth)
+				}
+
+				_ = p.writeMySQLPacket(rw, []byte{mysqlAuthMoreData, cachingSHA2FastAuthOK})
+				_ = p.writeMySQLPacket(rw, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0})
+			},
+		},
+		{
+			name:   "caching sha2 full auth",
+			plugin: mysqlCachingSHA2,
+			opts:   []Option{pluginFlags},
+			server: func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter) {
+				_, _ = p.readMySQLPacket(rw, 2)
+				_ = p.writeMySQLPacket(rw, []byte{mysqlAuthMoreData, cachingSHA2FullAuth})
+
+				body, _ := p.readMySQLPacket(rw, 4)
+				if string(body) != "secret\x00" {
+					t.Errorf("Expected the password, got %q", body)
+				}
+
+				_ = p.writeMySQLPacket(rw, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0})
+			},
+		},
+		{
+			name:   "auth switch",
+			plugin: mysqlCachingSHA2,
+			opts:   []Option{pluginFlags},
+			server: func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter) {
+				_, _ = p.readMySQLPacket(rw, 2)
+				_ = p.writeMySQLPacket(rw, append([]byte("\xfemysql_native_password\x00"), testMySQLScramble+"\x00"...))
+
+				body, _ := p.readMySQLPacket(rw, 4)
+				if !verifyNativePassword(body, "secret") {
+					t.Errorf("Unexpected auth switch response: %x", body)
+				}
+
+				_ = p.writeMySQLPacket(rw, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0})
+			},
+		},
+		{
+			name:   "connect attributes",
+			plugin: mysqlNativePassword,
+			opts:   []Option{pluginFlags, WithMySQLConnectAttrs(map[string]string{"program_name": "scanner"})},
+			server: func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter) {
+				body, _ := p.readMySQLPacket(rw, 2)
+
+				_, _, _, rest := parseMySQLHandshakeResponse(t, body)
+				if expected := appendMySQLConnectAttrs(nil, map[string]string{"program_name": "scanner"}); !bytes.Equal(rest, expected) {
+					t.Errorf("Expected attributes %q, got %q", expected, rest)
+				}
+
+				_ = p.writeMySQLPacket(rw, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0})
+			},
+		},
+		{
+			name:   "access denied",
+			plugin: mysqlNativePassword,
+			server: func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter) {
+				_, _ = p.readMySQLPacket(rw, 2)
+				_ = p.writeMySQLPacket(rw, append([]byte{mysqlErrPacket, 0x15, 0x04}, "#28000Access denied for user 'scanner'"...))
+			},
+			expectError:  true,
+			expectedCode: 1045,
+		},
+		{
+			name:   "unsupported switch",
+			plugin: mysqlNativePassword,
+			server: func(t *testing.T, p *mysqlProtocol, rw *bufio.ReadWriter) {
+				_, _ = p.readMySQLPacket(rw, 2)
+				_ = p.writeMySQLPacket(rw, []byte("\xfeauth_gssapi_client\x00data\x00"))
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			client, server := net.Pipe()
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				defer server.Close()
+
+				tt.server(t, &mysqlProtocol{name: "mysql"}, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)))
+			}()
+
+			result := &StartTLSResult{
+				TLSEstablished: true,
+				Details:        &MySQLHandshakeInfo{AuthPluginName: tt.plugin, scramble: testMySQLScramble},
+			}
+
+			err := AuthenticateMySQL(ctx, client, result, "scanner", "secret", tt.opts...)
+
+			client.Close()
+			<-done
+
+			if !tt.expectError {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+
+			var serverErr *MySQLServerError
+			if tt.expectedCode != 0 && (!errors.As(err, &serverErr) || serverErr.Code != tt.expectedCode) {
+				t.Errorf("Expected MySQL error %d, got: %v", tt.expectedCode, err)
+			}
+		})
+	}
+
+	t.Run("not negotiated", func(t *testing.T) {
+		err := AuthenticateMySQL(context.Background(), nil, &StartTLSResult{}, "scanner", "secret")
+		if err == nil {
+			t.Error("Expected an error without a MySQL result")
+		}
+	})
+}
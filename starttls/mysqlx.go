@@ -0,0 +1,251 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MySQL X Protocol implementation.
+type mysqlxProtocol struct {
+	name string
+}
+
+func newMySQLXProtocol() *mysqlxProtocol {
+	return &mysqlxProtocol{
+		name: string(ProtocolMySQLX),
+	}
+}
+
+// MySQL X Protocol constants.
+const (
+	mysqlxClientCapabilitiesGet = 1
+	mysqlxClientCapabilitiesSet = 2
+	mysqlxServerOK              = 0
+	mysqlxServerError           = 1
+	mysqlxServerCapabilities    = 2
+	mysqlxServerNotice          = 11
+	maxMySQLXMessageSize        = 1 << 20
+	protoWireVarint             = 0
+	protoWireBytes              = 2
+)
+
+// mysqlxCapabilitiesSetTLS is the CapabilitiesSet message enabling the "tls"
+// capability: Capabilities{Capability{name: "tls", value: Any{Scalar{V_BOOL: true}}}}.
+var mysqlxCapabilitiesSetTLS = []byte{
+	0x0a, 0x11, // CapabilitiesSet.capabilities
+	0x0a, 0x0f, // Capabilities.capabilities
+	0x0a, 0x03, 't', 'l', 's', // Capability.name
+	0x12, 0x08, // Capability.value
+	0x08, 0x01, // Any.type = SCALAR
+	0x12, 0x04, // Any.scalar
+	0x08, 0x07, // Scalar.type = V_BOOL
+	0x40, 0x01, // Scalar.v_bool = true
+}
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// mysqlxMessage is a single X Protocol frame.
+type mysqlxMessage struct {
+	msgType byte
+	payload []byte
+}
+
+func (p *mysqlxProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	err := p.writeMessage(rw, mysqlxClientCapabilitiesGet, nil)
+	if err != nil {
+		return fmt.Errorf("mysqlx: failed to write CapabilitiesGet: %w", err)
+	}
+
+	msg, err := p.readMessage(ctx, rw)
+	if err != nil {
+		return fmt.Errorf("mysqlx: failed to read capabilities: %w", err)
+	}
+
+	if msg.msgType != mysqlxServerCapabilities {
+		return p.unexpectedMessage(msg)
+	}
+
+	names, err := parseMySQLXCapabilityNames(msg.payload)
+	if err != nil {
+		return fmt.Errorf("%w: mysqlx: malformed capabilities: %w", ErrInvalidResponse, err)
+	}
+
+	sessionFromContext(ctx).result.Capabilities = names
+
+	if !containsFold(names, "tls") {
+		return fmt.Errorf("%w: mysqlx: server does not offer the tls capability", ErrStartTLSNotSupported)
+	}
+
+	if stopBeforeUpgrade(ctx) {
+		return errProbeStopped
+	}
+
+	err = p.writeMessage(rw, mysqlxClientCapabilitiesSet, mysqlxCapabilitiesSetTLS)
+	if err != nil {
+		return fmt.Errorf("mysqlx: failed to write CapabilitiesSet: %w", err)
+	}
+
+	msg, err = p.readMessage(ctx, rw)
+	if err != nil {
+		return fmt.Errorf("mysqlx: failed to read CapabilitiesSet response: %w", err)
+	}
+
+	if msg.msgType != mysqlxServerOK {
+		return p.unexpectedMessage(msg)
+	}
+
+	return nil
+}
+
+func (p *mysqlxProtocol) Name() string {
+	return p.name
+}
+
+func (p *mysqlxProtocol) writeMessage(rw *bufio.ReadWriter, msgType byte, payload []byte) error {
+	header := make([]byte, 5)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)+1))
+	header[4] = msgType
+
+	_, err := rw.Write(append(header, payload...))
+	if err != nil {
+		return err
+	}
+
+	return rw.Flush()
+}
+
+// readMessage reads the next frame, skipping notices.
+func (p *mysqlxProtocol) readMessage(ctx context.Context, rw *bufio.ReadWriter) (mysqlxMessage, error) {
+	for {
+		msg, err := readContext(ctx, func() (mysqlxMessage, error) {
+			return readMySQLXMessage(rw.Reader)
+		})
+		if err != nil {
+			return mysqlxMessage{}, err
+		}
+
+		if msg.msgType != mysqlxServerNotice {
+			return msg, nil
+		}
+	}
+}
+
+// unexpectedMessage builds the error for a frame other than the one expected.
+func (p *mysqlxProtocol) unexpectedMessage(msg mysqlxMessage) error {
+	if msg.msgType == mysqlxServerError {
+		return fmt.Errorf("%w: mysqlx: %s", ErrStartTLSNotSupported, sanitizeResponse(parseMySQLXErrorMessage(msg.payload)))
+	}
+
+	return fmt.Errorf("%w: mysqlx: unexpected message type %d", ErrInvalidResponse, msg.msgType)
+}
+
+func readMySQLXMessage(r io.Reader) (mysqlxMessage, error) {
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return mysqlxMessage{}, err
+	}
+
+	length := binary.LittleEndian.Uint32(header)
+	if length == 0 || length > maxMySQLXMessageSize {
+		return mysqlxMessage{}, fmt.Errorf("%w: invalid X Protocol frame length %d", ErrInvalidResponse, length)
+	}
+
+	payload := make([]byte, length-1)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return mysqlxMessage{}, err
+	}
+
+	return mysqlxMessage{msgType: header[4], payload: payload}, nil
+}
+
+// parseMySQLXCapabilityNames returns the capability names from a
+// Capabilities message.
+func parseMySQLXCapabilityNames(payload []byte) ([]string, error) {
+	var names []string
+
+	err := forEachProtoField(payload, func(num int, _ uint64, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+
+		// Capability.name is field 1.
+		return forEachProtoField(data, func(num int, _ uint64, name []byte) error {
+			if num == 1 {
+				names = append(names, string(name))
+			}
+
+			return nil
+		})
+	})
+
+	return names, err
+}
+
+// parseMySQLXErrorMessage returns the msg field of an Error message.
+func parseMySQLXErrorMessage(payload []byte) string {
+	var message string
+
+	_ = forEachProtoField(payload, func(num int, _ uint64, data []byte) error {
+		if num == 3 {
+			message = string(data)
+		}
+
+		return nil
+	})
+
+	return message
+}
+
+// forEachProtoField walks the varint and length-delimited fields of a
+// protobuf message. Fields of other wire types are rejected.
+func forEachProtoField(data []byte, fn func(num int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+
+		data = data[n:]
+		num := int(key >> 3)
+
+		switch key & 0x7 {
+		case protoWireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+
+			data = data[n:]
+
+			err := fn(num, v, nil)
+			if err != nil {
+				return err
+			}
+		case protoWireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errProtoTruncated
+			}
+
+			value := data[n : n+int(length)]
+			data = data[n+int(length):]
+
+			err := fn(num, 0, value)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&0x7)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package starttls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+func mysqlxFrame(msgType byte, payload []byte) []byte {
+	frame := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)+1))
+	frame = append(frame, msgType)
+
+	return append(frame, payload...)
+}
+
+// mysqlxCapabilities encodes a Capabilities message with boolean capabilities.
+func mysqlxCapabilities(names ...string) []byte {
+	var out []byte
+
+	for _, name := range names {
+		capability := append([]byte{0x0a, byte(len(name))}, name...)
+		capability = append(capability, 0x12, 0x08, 0x08, 0x01, 0x12, 0x04, 0x08, 0x07, 0x40, 0x01)
+		out = append(out, 0x0a, byte(len(capability)))
+		out = append(out, capability...)
+	}
+
+	return out
+}
+
+func mysqlxError(msg string) []byte {
+	return append([]byte{0x10, 0x8d, 0x08, 0x1a, byte(len(msg))}, msg...)
+}
+
+func TestMySQLXHandshake(t *testing.T) {
+	tests := []struct {
+		name          string
+		responses     [][]byte
+		expectedError error
+	}{
+		{
+			name: "success with notice",
+			responses: [][]byte{
+				append(mysqlxFrame(mysqlxServerNotice, []byte{0x08, 0x01}),
+					mysqlxFrame(mysqlxServerCapabilities, mysqlxCapabilities("tls", "authentication.mechanisms"))...),
+				mysqlxFrame(mysqlxServerOK, nil),
+			},
+		},
+		{
+			name: "tls not offered",
+			responses: [][]byte{
+				mysqlxFrame(mysqlxServerCapabilities, mysqlxCapabilities("authentication.mechanisms")),
+			},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name: "capabilities set rejected",
+			responses: [][]byte{
+				mysqlxFrame(mysqlxServerCapabilities, mysqlxCapabilities("tls")),
+				mysqlxFrame(mysqlxServerError, mysqlxError("Capability prepare failed for 'tls'")),
+			},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name: "unexpected message",
+			responses: [][]byte{
+				mysqlxFrame(42, nil),
+			},
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests [][]byte
+
+			result, err := negotiateWithHandler(t, "33060", func(conn net.Conn) {
+				for _, response := range tt.responses {
+					msg, err := readMySQLXMessage(conn)
+					if err != nil {
+						return
+					}
+
+					requests = append(requests, mysqlxFrame(msg.msgType, msg.payload))
+
+					conn.Write(response)
+				}
+			})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !containsFold(result.Capabilities, "tls") {
+				t.Errorf("Expected tls capability, got %v", result.Capabilities)
+			}
+
+			expected := [][]byte{
+				mysqlxFrame(mysqlxClientCapabilitiesGet, nil),
+				mysqlxFrame(mysqlxClientCapabilitiesSet, mysqlxCapabilitiesSetTLS),
+			}
+
+			if len(requests) != len(expected) {
+				t.Fatalf("Expected %d requests, got %d", len(expected), len(requests))
+			}
+
+			for i := range expected {
+				if !bytes.Equal(requests[i], expected[i]) {
+					t.Errorf("Request %d: expected %x, got %x", i, expected[i], requests[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMySQLXCapabilitiesSetTLSEncoding(t *testing.T) {
+	names, err := parseMySQLXCapabilityNames(mysqlxCapabilitiesSetTLS[2:])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(names) != 1 || names[0] != "tls" {
+		t.Errorf("Expected [tls], got %v", names)
+	}
+}
@@ -0,0 +1,70 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// NATS protocol implementation.
+type natsProtocol struct {
+	name string
+}
+
+func newNATSProtocol() *natsProtocol {
+	return &natsProtocol{
+		name: string(ProtocolNATS),
+	}
+}
+
+// NATSInfo holds the fields of the NATS INFO message relevant to TLS.
+type NATSInfo struct {
+	ServerID     string `json:"server_id"`
+	Version      string `json:"version"`
+	TLSRequired  bool   `json:"tls_required"`
+	TLSAvailable bool   `json:"tls_available"`
+}
+
+// Handshake reads the INFO message and checks that the server offers TLS.
+// NATS has no upgrade command; the client starts TLS right after INFO.
+func (p *natsProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	result := sessionFromContext(ctx).result
+	start := now(ctx)
+
+	stepCtx, cancel := stepContext(ctx, StepGreeting)
+	line, err := readLine(stepCtx, rw.Reader)
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("nats: failed to read INFO: %w", err)
+	}
+
+	result.Banner = strings.TrimRight(line, "\r\n")
+	result.addTiming(StepGreeting, start, now(ctx))
+
+	payload, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	if !ok {
+		return fmt.Errorf("%w: nats: expected INFO, got: %s", ErrInvalidResponse, sanitizeResponse(line))
+	}
+
+	info := &NATSInfo{}
+
+	err = json.Unmarshal([]byte(payload), info)
+	if err != nil {
+		return fmt.Errorf("%w: nats: malformed INFO: %w", ErrInvalidResponse, err)
+	}
+
+	result.Details = info
+
+	if !info.TLSRequired && !info.TLSAvailable {
+		return fmt.Errorf("%w: nats: server does not offer TLS", ErrStartTLSNotSupported)
+	}
+
+	return nil
+}
+
+func (p *natsProtocol) Name() string {
+	return p.name
+}
@@ -0,0 +1,61 @@
+package starttls
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNATSHandshake(t *testing.T) {
+	tests := []struct {
+		name          string
+		info          string
+		expectedError error
+	}{
+		{
+			name: "tls required",
+			info: `INFO {"server_id":"abc","version":"2.10.0","tls_required":true}` + "\r\n",
+		},
+		{
+			name: "tls available",
+			info: `INFO {"server_id":"abc","version":"2.10.0","tls_available":true}` + "\r\n",
+		},
+		{
+			name:          "no tls",
+			info:          `INFO {"server_id":"abc","version":"2.10.0"}` + "\r\n",
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "not info",
+			info:          "-ERR 'Authorization Violation'\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "malformed json",
+			info:          "INFO {not json}\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "4222", []string{tt.info})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			info, ok := ResultDetails[*NATSInfo](result)
+			if !ok || info.ServerID != "abc" || info.Version != "2.10.0" {
+				t.Errorf("Unexpected details: %+v", result.Details)
+			}
+		})
+	}
+}
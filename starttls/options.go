@@ -0,0 +1,387 @@
+package starttls
+
+import (
+	"log/slog"
+	"maps"
+	"strings"
+	"time"
+)
+
+// Option configures a single negotiation.
+type Option func(*config)
+
+type config struct {
+	observeRejection time.Duration
+	opportunistic    bool
+	autoDetectWait   time.Duration
+	smtpAnonymousTLS bool
+	smtpPipelining   bool
+	smtpMailAudit    bool
+	imapTagPrefix    string
+	imapLoginAudit   bool
+	ftpFeatures      bool
+	gracefulQuit     bool
+	strictCRLF       bool
+	strictMatching   bool
+	greeting         string
+	greetingMatcher  func(line string) bool
+	responseMatcher  func(line string) bool
+	maxLineBytes     int
+	maxResponseBytes int
+	events           func(Event)
+	portMap          map[string]ProtocolID
+	directTLSPorts   map[string]bool
+	probeOnly        bool
+	probeConfirm     bool
+	stepTimeouts     map[string]time.Duration
+	transcript       bool
+	hooks            *Hooks
+	middleware       []Middleware
+	logger           *slog.Logger
+	clock            Clock
+
+	mysqlClientFlags   uint32
+	mysqlCharset       byte
+	mysqlMaxPacketSize uint32
+	mysqlConnectAttrs  map[string]string
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{clock: realClock{}}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// WithRejectionObservation makes the negotiation keep watching the server for
+// up to d after it rejects STARTTLS, recording whether it closes the
+// connection, keeps answering commands, or goes silent in
+// StartTLSResult.RejectionBehavior.
+func WithRejectionObservation(d time.Duration) Option {
+	return func(c *config) {
+		c.observeRejection = d
+	}
+}
+
+// WithOpportunistic makes Negotiate succeed when the server does not offer
+// or rejects STARTTLS, returning a result with TLSEstablished false and the
+// reason in FallbackReason. Other failures, such as I/O errors, are still
+// returned as errors.
+func WithOpportunistic() Option {
+	return func(c *config) {
+		c.opportunistic = true
+	}
+}
+
+// WithAutoDetect makes Negotiate infer the protocol from the server greeting
+// when the port is not registered, waiting up to wait for the greeting. A
+// server that stays silent, like a direct TLS server, is treated as not
+// needing STARTTLS; an unrecognized greeting returns ErrProtocolNotDetected.
+func WithAutoDetect(wait time.Duration) Option {
+	return func(c *config) {
+		c.autoDetectWait = wait
+	}
+}
+
+// WithPortMap assigns ports to registered protocol names for this call only,
+// such as "10143" to ProtocolIMAP, taking precedence over the ports set with
+// Register and the direct TLS ports. This lets scanners carry per-tenant
+// mappings without changing global state. Names are case-insensitive; a
+// mapped name that is not registered returns ErrUnknownProtocol.
+func WithPortMap(ports map[string]ProtocolID) Option {
+	return func(c *config) {
+		c.portMap = maps.Clone(ports)
+	}
+}
+
+// WithDirectTLSPorts treats ports as direct TLS ports for this call only, in
+// addition to those reported by DirectTLSPorts: StartTLS returns nil and
+// Negotiate sets ImplicitTLS without reading from the connection. A port
+// mapped with WithPortMap is still negotiated.
+func WithDirectTLSPorts(ports ...string) Option {
+	return func(c *config) {
+		if c.directTLSPorts == nil {
+			c.directTLSPorts = make(map[string]bool, len(ports))
+		}
+
+		for _, port := range ports {
+			c.directTLSPorts[port] = true
+		}
+	}
+}
+
+// WithGracefulQuit ends the session politely with QUIT (SMTP, POP3, FTP) or
+// LOGOUT (IMAP) when the server does not offer or rejects STARTTLS, instead
+// of leaving the caller to close the connection abruptly, which trips abuse
+// detection on some mail servers. It has no effect in opportunistic mode,
+// where the session is handed back to the caller.
+func WithGracefulQuit() Option {
+	return func(c *config) {
+		c.gracefulQuit = true
+	}
+}
+
+// WithProbeOnly verifies STARTTLS support without committing to TLS, for
+// availability checks that should not cost the server a TLS handshake. Once
+// the server has advertised STARTTLS (SMTP, LMTP, IMAP, POP3, MySQL, MySQL X,
+// NATS, and FTP with WithFTPFeatures), the negotiation stops before the
+// upgrade command and ends the session with QUIT or LOGOUT where the
+// protocol has one; StartTLSResult.Probed is set.
+//
+// When confirm is true, or the protocol does not advertise STARTTLS, the
+// upgrade command is sent and its positive reply checked. The server then
+// waits for a TLS handshake, so the caller should close the connection.
+func WithProbeOnly(confirm bool) Option {
+	return func(c *config) {
+		c.probeOnly = true
+		c.probeConfirm = confirm
+	}
+}
+
+// WithGreeting supplies the greeting lines the caller has already read from
+// the connection, such as when it is taken over from another library, so
+// that the negotiation uses them instead of waiting for a greeting the
+// server will not send again. Each line is completed with CRLF unless it
+// already ends with a newline. It applies to the protocols whose server
+// greets with text lines: SMTP, LMTP, IMAP, POP3, FTP and NATS.
+func WithGreeting(lines ...string) Option {
+	return func(c *config) {
+		var b strings.Builder
+
+		for _, line := range lines {
+			b.WriteString(line)
+
+			if !strings.HasSuffix(line, "\n") {
+				b.WriteString("\r\n")
+			}
+		}
+
+		c.greeting = b.String()
+	}
+}
+
+// WithStepTimeout bounds a single step of the negotiation, StepGreeting,
+// StepCapabilities or StepUpgrade, by d in addition to the context passed
+// to Negotiate, so that a slow greeting (greet-pause) can be given a
+// generous limit while command replies are held to a tight one. A step
+// that runs out of time fails with context.DeadlineExceeded. The protocols
+// that report StartTLSResult.Timings honor it.
+func WithStepTimeout(step string, d time.Duration) Option {
+	return func(c *config) {
+		if c.stepTimeouts == nil {
+			c.stepTimeouts = make(map[string]time.Duration)
+		}
+
+		c.stepTimeouts[step] = d
+	}
+}
+
+// WithTranscript records the lines sent and received during the negotiation
+// and attaches them to a failure's NegotiationError, whose message then
+// includes them, so that failures against flaky servers can be diagnosed
+// from logs alone. It is off by default because the transcript may contain
+// data that should not be logged, such as the audit LOGIN of
+// WithIMAPLoginAudit. Binary protocols such as MySQL are recorded as-is.
+func WithTranscript() Option {
+	return func(c *config) {
+		c.transcript = true
+	}
+}
+
+// WithHooks calls the functions set in hooks as the negotiation proceeds,
+// for logging, metrics and test assertions. See Hooks.
+func WithHooks(hooks *Hooks) Option {
+	return func(c *config) {
+		c.hooks = hooks
+	}
+}
+
+// WithClock makes the negotiation take the time from clock instead of the
+// time package. Read deadlines set on the connection, as by WithAutoDetect,
+// still use the real time.
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithMiddleware wraps the protocol of this call in middleware, inside the
+// middleware added with RegisterMiddleware. The first middleware is the
+// outermost. See Middleware.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(c *config) {
+		c.middleware = append(c.middleware, middleware...)
+	}
+}
+
+// WithLogger logs each negotiation step to logger at debug level, with the
+// protocol, remote address, step, last command sent, reply code, duration
+// and, for the step that failed, the error.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithStrictCRLF makes the text protocols reject server lines that end in a
+// bare LF instead of CRLF with ErrInvalidResponse, for conformance scans.
+// By default both terminators are accepted.
+func WithStrictCRLF() Option {
+	return func(c *config) {
+		c.strictCRLF = true
+	}
+}
+
+// WithStrictMatching makes the negotiation fail with ErrInvalidResponse on
+// server output that the default, lenient mode tolerates: a line protocol
+// greeting preceded by lines that do not match its pattern, SMTP, LMTP or
+// FTP reply lines without a well-formed reply code, and a reply to STARTTLS
+// or AUTH TLS that neither accepts nor refuses it, such as 250. In strict
+// mode only 4yz and 5yz replies count as the server refusing the upgrade.
+func WithStrictMatching() Option {
+	return func(c *config) {
+		c.strictMatching = true
+	}
+}
+
+// WithMaxLineBytes bounds the length of a line read from the server,
+// including its terminator, to n bytes, so a server that never ends a line
+// cannot make the client buffer unbounded data. A longer line fails the
+// negotiation with a *LimitError. By default lines are not bounded.
+func WithMaxLineBytes(n int) Option {
+	return func(c *config) {
+		c.maxLineBytes = n
+	}
+}
+
+// WithMaxResponseBytes bounds the bytes read from the server during the
+// negotiation, across all its replies, to n, so a server that sends an
+// endless reply, such as a multiline one with short lines, cannot make the
+// client buffer unbounded data. Reading more fails the negotiation with a
+// *LimitError. By default the responses are not bounded.
+func WithMaxResponseBytes(n int) Option {
+	return func(c *config) {
+		c.maxResponseBytes = n
+	}
+}
+
+// WithGreetingMatcher replaces the greeting check of the text protocols,
+// SMTP, LMTP, IMAP, POP3, FTP and those from NewLineProtocol, for broken
+// appliances, such as an SMTP server that greets with a lone "220-" line.
+// Lines are read until match accepts one, without its terminator, which is
+// then taken as a ready greeting; with WithStrictMatching the first line must
+// match. Pass a regexp's MatchString to match a pattern.
+func WithGreetingMatcher(match func(line string) bool) Option {
+	return func(c *config) {
+		c.greetingMatcher = match
+	}
+}
+
+// WithResponseMatcher replaces the check of the reply to the upgrade command
+// of the text protocols, for servers that accept it with a nonstandard reply.
+// The upgrade proceeds when match accepts the first reply line, the tagged
+// status line for IMAP, without its terminator, and otherwise fails with
+// ErrStartTLSNotSupported. Pass a regexp's MatchString to match a pattern.
+func WithResponseMatcher(match func(line string) bool) Option {
+	return func(c *config) {
+		c.responseMatcher = match
+	}
+}
+
+// WithSMTPAnonymousTLS makes the SMTP handshake upgrade with X-ANONYMOUSTLS
+// instead of STARTTLS when the server advertises it, as Exchange hub
+// transports do for intra-organization mail.
+func WithSMTPAnonymousTLS() Option {
+	return func(c *config) {
+		c.smtpAnonymousTLS = true
+	}
+}
+
+// WithSMTPMailAuditPipelining sends the commands of WithSMTPMailAudit in
+// one group with STARTTLS when the EHLO reply advertises PIPELINING (RFC
+// 2920), saving the round trips the audit adds. It does not speed up the
+// negotiation otherwise: EHLO must be sent alone and STARTTLS must end a
+// group, so without WithSMTPMailAudit it has no effect.
+func WithSMTPMailAuditPipelining() Option {
+	return func(c *config) {
+		c.smtpPipelining = true
+	}
+}
+
+// WithSMTPMailAudit makes the SMTP handshake send MAIL FROM:<> after EHLO
+// and before STARTTLS, recording whether the server refuses it with "530
+// Must issue a STARTTLS command first" or accepts mail in plaintext as a
+// finding. An accepted transaction is reset before STARTTLS is sent.
+func WithSMTPMailAudit() Option {
+	return func(c *config) {
+		c.smtpMailAudit = true
+	}
+}
+
+// WithIMAPTagPrefix sets the prefix of IMAP command tags, which default to
+// "a001", "a002" and so on. The prefix must be a valid IMAP tag: no spaces,
+// control characters or any of (){%*"\+].
+func WithIMAPTagPrefix(prefix string) Option {
+	return func(c *config) {
+		c.imapTagPrefix = prefix
+	}
+}
+
+// WithIMAPLoginAudit makes the IMAP handshake send LOGIN with placeholder
+// credentials before STARTTLS and record, as a finding, whether the server
+// refuses it or evaluates the credentials in plaintext. No real credentials
+// are ever sent. A server that accepts them is logged out and the
+// negotiation fails with ErrIMAPLoginAccepted.
+func WithIMAPLoginAudit() Option {
+	return func(c *config) {
+		c.imapLoginAudit = true
+	}
+}
+
+// WithFTPFeatures sends FEAT before AUTH TLS and records the advertised
+// features in the result as *FTPInfo, so it can be told whether AUTH TLS and
+// PROT were advertised or merely accepted.
+func WithFTPFeatures() Option {
+	return func(c *config) {
+		c.ftpFeatures = true
+	}
+}
+
+// WithMySQLClientFlags sets the capability flags sent in the MySQL SSL
+// request, for example to add CLIENT_PLUGIN_AUTH (0x00080000) or to mimic a
+// specific client. CLIENT_SSL and CLIENT_PROTOCOL_41 are always added. The
+// default is CLIENT_SECURE_CONNECTION.
+func WithMySQLClientFlags(flags uint32) Option {
+	return func(c *config) {
+		c.mysqlClientFlags = flags
+	}
+}
+
+// WithMySQLCharset sets the collation ID sent in the MySQL SSL request, such
+// as 45 (utf8mb4_general_ci) or 255 (utf8mb4_0900_ai_ci). The default is 33
+// (utf8_general_ci).
+func WithMySQLCharset(collation byte) Option {
+	return func(c *config) {
+		c.mysqlCharset = collation
+	}
+}
+
+// WithMySQLMaxPacketSize sets the maximum packet size announced in the MySQL
+// SSL request. The default is 16777215.
+func WithMySQLMaxPacketSize(size uint32) Option {
+	return func(c *config) {
+		c.mysqlMaxPacketSize = size
+	}
+}
+
+// WithMySQLConnectAttrs sets connection attributes, such as program_name or
+// _client_name, that identify the connection in MySQL's performance_schema.
+// The SSL request then announces CLIENT_CONNECT_ATTRS and AuthenticateMySQL
+// sends the attributes in the handshake response after the TLS handshake.
+func WithMySQLConnectAttrs(attrs map[string]string) Option {
+	return func(c *config) {
+		c.mysqlConnectAttrs = attrs
+	}
+}
@@ -0,0 +1,138 @@
+package starttls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TLSMode describes how a service offers TLS.
+type TLSMode int
+
+// TLS modes reported by ProbeTLSMode.
+const (
+	// TLSModeUnknown means the service neither spoke TLS nor sent a
+	// recognizable greeting.
+	TLSModeUnknown TLSMode = iota
+	// TLSModeDirect means the service accepts a TLS ClientHello immediately.
+	TLSModeDirect
+	// TLSModeSTARTTLS means the service upgrades a plaintext session to TLS.
+	TLSModeSTARTTLS
+	// TLSModePlaintext means the service speaks a known plaintext protocol
+	// but does not offer STARTTLS.
+	TLSModePlaintext
+)
+
+// Probe timeouts.
+const (
+	// probeGreetingWait is how long ProbeTLSMode waits for a plaintext
+	// greeting on ports that are not registered.
+	probeGreetingWait = 3 * time.Second
+	// probeHandshakeWait bounds the direct TLS attempt so that plaintext
+	// servers ignoring the ClientHello do not stall the probe.
+	probeHandshakeWait = 5 * time.Second
+)
+
+// String returns the lowercase name of the mode.
+func (m TLSMode) String() string {
+	switch m {
+	case TLSModeUnknown:
+		return "unknown"
+	case TLSModeDirect:
+		return "direct-tls"
+	case TLSModeSTARTTLS:
+		return "starttls"
+	case TLSModePlaintext:
+		return "plaintext"
+	default:
+		return "invalid"
+	}
+}
+
+// ProbeTLSMode determines whether the service at addr ("host:port") speaks
+// direct TLS, supports STARTTLS, or is plaintext only. It first attempts a
+// TLS handshake and, when that is not answered with TLS, reconnects and
+// checks for STARTTLS with WithProbeOnly, detecting the protocol from the
+// greeting when the port is not registered. Certificates are not verified;
+// the probe only checks which mode the service uses. opts are passed to
+// Negotiate.
+func ProbeTLSMode(ctx context.Context, addr string, opts ...Option) (TLSMode, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return TLSModeUnknown, err
+	}
+
+	direct, err := probeDirectTLS(ctx, addr, host)
+	if err != nil {
+		return TLSModeUnknown, err
+	}
+
+	if direct {
+		return TLSModeDirect, nil
+	}
+
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return TLSModeUnknown, err
+	}
+	defer conn.Close()
+
+	opts = append([]Option{WithAutoDetect(probeGreetingWait), WithProbeOnly(false)}, opts...)
+
+	result, err := Negotiate(ctx, conn, port, opts...)
+
+	switch {
+	case errors.Is(err, ErrStartTLSNotSupported):
+		return TLSModePlaintext, nil
+	case err != nil:
+		return TLSModeUnknown, err
+	case result.TLSEstablished, result.Probed:
+		return TLSModeSTARTTLS, nil
+	case result.FallbackReason != nil:
+		return TLSModePlaintext, nil
+	default:
+		return TLSModeUnknown, nil
+	}
+}
+
+// probeDirectTLS reports whether the server answers a ClientHello with TLS.
+// A TLS alert counts as TLS: the server parsed the hello and refused it.
+func probeDirectTLS(ctx context.Context, addr, host string) (bool, error) {
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true, //nolint:gosec // only probing whether the server speaks TLS
+		MinVersion:         tls.VersionTLS10,
+	})
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, probeHandshakeWait)
+	defer cancel()
+
+	err = tlsConn.HandshakeContext(handshakeCtx)
+	if err == nil {
+		return true, nil
+	}
+
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		return true, nil
+	}
+
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("direct TLS probe: %w", ctx.Err())
+	}
+
+	return false, nil
+}
@@ -0,0 +1,105 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveScript accepts connections until the listener is closed and plays the
+// same line-based script on each: send messages[0], then answer every line
+// read with the next message.
+func serveScript(listener net.Listener, messages []string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+
+			conn.Write([]byte(messages[0]))
+
+			for _, msg := range messages[1:] {
+				if _, err := reader.ReadString('\n'); err != nil {
+					return
+				}
+
+				conn.Write([]byte(msg))
+			}
+		}()
+	}
+}
+
+func TestProbeTLSMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		listen   func(ctx context.Context) (net.Listener, error)
+		messages []string
+		expected TLSMode
+	}{
+		{
+			name: "direct tls",
+			listen: func(ctx context.Context) (net.Listener, error) {
+				lc := net.ListenConfig{}
+
+				l, err := lc.Listen(ctx, "tcp", "127.0.0.1:0")
+				if err != nil {
+					return nil, err
+				}
+
+				return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}), nil
+			},
+			messages: []string{"220 smtp.test ESMTP\r\n"},
+			expected: TLSModeDirect,
+		},
+		{
+			name:     "starttls",
+			messages: []string{"220 smtp.test ESMTP\r\n", serverMessagesSMTP, "220 ready for TLS\r\n"},
+			expected: TLSModeSTARTTLS,
+		},
+		{
+			name:     "plaintext",
+			messages: []string{"220 smtp.test ESMTP\r\n", serverMessagesSMTPNoTLS, serverMessagesNotSupported},
+			expected: TLSModePlaintext,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			listen := tt.listen
+			if listen == nil {
+				listen = func(ctx context.Context) (net.Listener, error) {
+					lc := net.ListenConfig{}
+					return lc.Listen(ctx, "tcp", "127.0.0.1:0")
+				}
+			}
+
+			listener, err := listen(ctx)
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer listener.Close()
+
+			go serveScript(listener, tt.messages)
+
+			mode, err := ProbeTLSMode(ctx, listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if mode != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, mode)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package starttls
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// registry maps protocol names to their factories and ports to protocol
+// names, and holds the candidate protocols of ports with several, the direct
+// TLS ports and the middleware applied to every negotiation. It is safe for
+// concurrent use.
+var registry = struct {
+	sync.RWMutex
+	byName     map[ProtocolID]func() StartTLSProtocol
+	byPort     map[string]ProtocolID
+	candidates map[string][]ProtocolID
+	directTLS  map[string]bool
+	middleware []Middleware
+}{
+	byName: map[ProtocolID]func() StartTLSProtocol{
+		ProtocolFTP:    func() StartTLSProtocol { return newFTPProtocol() },
+		ProtocolIMAP:   func() StartTLSProtocol { return newIMAPProtocol() },
+		ProtocolLDAP:   func() StartTLSProtocol { return newLDAPProtocol() },
+		ProtocolLMTP:   func() StartTLSProtocol { return newLMTPProtocol() },
+		ProtocolMySQL:  func() StartTLSProtocol { return newMySQLProtocol() },
+		ProtocolMySQLX: func() StartTLSProtocol { return newMySQLXProtocol() },
+		ProtocolNATS:   func() StartTLSProtocol { return newNATSProtocol() },
+		ProtocolPOP3:   func() StartTLSProtocol { return newPOP3Protocol() },
+		ProtocolSMTP:   func() StartTLSProtocol { return newSMTPProtocol() },
+	},
+	byPort: map[string]ProtocolID{
+		"21":    ProtocolFTP,
+		"24":    ProtocolLMTP,
+		"25":    ProtocolSMTP,
+		"26":    ProtocolSMTP,
+		"587":   ProtocolSMTP,
+		"2525":  ProtocolSMTP,
+		"110":   ProtocolPOP3,
+		"143":   ProtocolIMAP,
+		"389":   ProtocolLDAP,
+		"3306":  ProtocolMySQL,
+		"4222":  ProtocolNATS,
+		"33060": ProtocolMySQLX,
+	},
+	candidates: map[string][]ProtocolID{},
+	// Services on these ports speak TLS from the first byte, such as HTTPS,
+	// SMTPS, implicit FTPS, IMAPS, POP3S and RDP.
+	directTLS: map[string]bool{
+		"443":  true,
+		"465":  true,
+		"990":  true,
+		"993":  true,
+		"995":  true,
+		"3389": true,
+		"8443": true,
+		"9443": true,
+	},
+}
+
+// ProtocolID names a protocol, such as ProtocolSMTP. It identifies the
+// protocol in results, errors, events and logs, and selects it in Protocol,
+// Register and WithPortMap. Protocols registered with Register use their
+// own names. Names are lower case.
+type ProtocolID string
+
+// Built-in protocol identifiers.
+const (
+	ProtocolSMTP   ProtocolID = "smtp"
+	ProtocolLMTP   ProtocolID = "lmtp"
+	ProtocolIMAP   ProtocolID = "imap"
+	ProtocolPOP3   ProtocolID = "pop3"
+	ProtocolFTP    ProtocolID = "ftp"
+	ProtocolLDAP   ProtocolID = "ldap"
+	ProtocolMySQL  ProtocolID = "mysql"
+	ProtocolMySQLX ProtocolID = "mysqlx"
+	ProtocolNATS   ProtocolID = "nats"
+	// ProtocolHTTP names the protocol of NewHTTPProtocol, which is not
+	// registered on any port.
+	ProtocolHTTP ProtocolID = "http"
+)
+
+// String returns the name of the protocol.
+func (id ProtocolID) String() string {
+	return string(id)
+}
+
+// ParseProtocolID returns the identifier of the protocol registered under
+// name, which is case-insensitive. An unknown name returns
+// ErrUnknownProtocol.
+func ParseProtocolID(name string) (ProtocolID, error) {
+	id := ProtocolID(strings.ToLower(name))
+
+	_, err := lookupName(id)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Register adds a protocol under name and assigns ports to it, so that
+// StartTLS and Negotiate use it for those ports and Protocol returns it by
+// name. Registering an existing name, including a built-in one such as
+// "smtp", replaces its factory; ports already assigned to another protocol
+// are reassigned. Names are case-insensitive. Register panics if name is
+// empty or factory is nil.
+func Register(name ProtocolID, ports []string, factory func() StartTLSProtocol) {
+	if name == "" || factory == nil {
+		panic("starttls: Register requires a name and a factory")
+	}
+
+	name = ProtocolID(strings.ToLower(string(name)))
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.byName[name] = factory
+
+	for _, port := range ports {
+		registry.byPort[port] = name
+		delete(registry.candidates, port)
+	}
+}
+
+// Unregister removes the protocol registered under name together with the
+// ports assigned to it. Those ports are then treated like any unknown port,
+// unless RegisterCandidates gave them other candidates, the first of which
+// takes over.
+func Unregister(name ProtocolID) {
+	name = ProtocolID(strings.ToLower(string(name)))
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	delete(registry.byName, name)
+
+	for port, names := range registry.candidates {
+		names = slices.DeleteFunc(names, func(n ProtocolID) bool { return n == name })
+		if len(names) == 0 {
+			delete(registry.candidates, port)
+
+			continue
+		}
+
+		registry.candidates[port] = names
+		registry.byPort[port] = names[0]
+	}
+
+	for port, portName := range registry.byPort {
+		if portName == name {
+			delete(registry.byPort, port)
+		}
+	}
+}
+
+// Protocol returns a new instance of the protocol registered under name,
+// for use with StartTLSWithProtocol. The built-in names are "smtp", "lmtp",
+// "imap", "pop3", "ftp", "ldap", "mysql", "mysqlx" and "nats". Names are
+// case-insensitive; an unknown name returns ErrUnknownProtocol.
+func Protocol(name ProtocolID) (StartTLSProtocol, error) {
+	factory, err := lookupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return factory(), nil
+}
+
+// Port is a port given to StartTLS, Negotiate and the other functions that
+// look up the protocol for a port: a number, such as 25, or a string holding
+// either a port, such as "25", or a "host:port" address, such as
+// "mail.example.com:25", whose port is used. A string port may also be a
+// service name, such as "submission" or "pop3", which is resolved to its TCP
+// port with net.LookupPort unless it is itself registered as a port.
+type Port interface {
+	string | int
+}
+
+// portString returns port as the string the registry is keyed by.
+func portString[P Port](port P) string {
+	if n, ok := any(port).(int); ok {
+		return strconv.Itoa(n)
+	}
+
+	s := any(port).(string)
+	if _, p, err := net.SplitHostPort(s); err == nil {
+		return p
+	}
+
+	return s
+}
+
+// servicePort returns port, or the TCP port of the service name port, such
+// as "submission", resolved with net.LookupPort. A name that the port map of
+// cfg or the registry uses as a port is returned unchanged.
+func servicePort(cfg *config, port string) (string, error) {
+	if _, err := strconv.Atoi(port); err == nil || knownPort(cfg, port) {
+		return port, nil
+	}
+
+	number, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(number), nil
+}
+
+// knownPort reports whether port is mapped or marked as direct TLS by cfg
+// or the registry.
+func knownPort(cfg *config, port string) bool {
+	if _, ok := cfg.portMap[port]; ok || cfg.directTLSPorts[port] {
+		return true
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	_, ok := registry.byPort[port]
+
+	return ok || registry.directTLS[port]
+}
+
+// LookupProtocol reports how Negotiate treats port, so callers can decide
+// before dialing: TLSModeSTARTTLS with a new instance of the protocol
+// negotiated on it, TLSModeDirect for a direct TLS port, or TLSModeUnknown
+// for a port Negotiate leaves alone. opts are applied as Negotiate would, so
+// WithPortMap and WithDirectTLSPorts are taken into account.
+func LookupProtocol[P Port](p P, opts ...Option) (StartTLSProtocol, TLSMode, error) {
+	cfg := newConfig(opts)
+
+	port, err := servicePort(cfg, portString(p))
+	if err != nil {
+		return nil, TLSModeUnknown, err
+	}
+
+	factory, ok, err := resolvePort(cfg, port)
+	if err != nil {
+		return nil, TLSModeUnknown, err
+	}
+
+	switch {
+	case isDirectTLS(cfg, port):
+		return nil, TLSModeDirect, nil
+	case ok:
+		return factory(), TLSModeSTARTTLS, nil
+	default:
+		return nil, TLSModeUnknown, nil
+	}
+}
+
+// RegisterDirectTLSPorts marks ports as direct TLS ports, where the TLS
+// handshake starts immediately: StartTLS returns nil for them and Negotiate
+// sets ImplicitTLS. Use it for services such as IMAPS or SMTPS on
+// non-standard ports. See WithDirectTLSPorts to mark ports for one call.
+func RegisterDirectTLSPorts(ports ...string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, port := range ports {
+		registry.directTLS[port] = true
+	}
+}
+
+// UnregisterDirectTLSPorts removes ports from the direct TLS ports,
+// including the built-in ones such as "443".
+func UnregisterDirectTLSPorts(ports ...string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, port := range ports {
+		delete(registry.directTLS, port)
+	}
+}
+
+// IsDirectTLSPort reports whether port is a direct TLS port. The built-in
+// direct TLS ports are 443, 465, 990, 993, 995, 3389, 8443 and 9443.
+func IsDirectTLSPort[P Port](p P) bool {
+	port, err := servicePort(newConfig(nil), portString(p))
+	if err != nil {
+		return false
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+
+	return registry.directTLS[port]
+}
+
+// isDirectTLS reports whether Negotiate treats port as a direct TLS port:
+// one marked with WithDirectTLSPorts or RegisterDirectTLSPorts that the
+// per-call port map of cfg does not assign to a protocol.
+func isDirectTLS(cfg *config, port string) bool {
+	if _, mapped := cfg.portMap[port]; mapped {
+		return false
+	}
+
+	return cfg.directTLSPorts[port] || IsDirectTLSPort(port)
+}
+
+// DirectTLSPorts returns the direct TLS ports in ascending order.
+func DirectTLSPorts() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	return slices.SortedFunc(maps.Keys(registry.directTLS), comparePorts)
+}
+
+// comparePorts orders ports numerically, and names that are not numbers
+// after them.
+func comparePorts(a, b string) int {
+	x, errX := strconv.Atoi(a)
+	y, errY := strconv.Atoi(b)
+
+	switch {
+	case errX == nil && errY == nil:
+		return cmp.Compare(x, y)
+	case errX == nil:
+		return -1
+	case errY == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// lookupName returns the factory of the protocol registered under name.
+func lookupName(name ProtocolID) (func() StartTLSProtocol, error) {
+	registry.RLock()
+	factory, ok := registry.byName[ProtocolID(strings.ToLower(string(name)))]
+	registry.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProtocol, name)
+	}
+
+	return factory, nil
+}
+
+// lookupPort returns the factory of the protocol registered for port.
+func lookupPort(port string) (func() StartTLSProtocol, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	factory, ok := registry.byName[registry.byPort[port]]
+
+	return factory, ok
+}
+
+// resolvePort returns the factory of the protocol for port, preferring the
+// per-call port map of cfg over the registry. A mapped name that is not
+// registered returns ErrUnknownProtocol.
+func resolvePort(cfg *config, port string) (func() StartTLSProtocol, bool, error) {
+	name, ok := cfg.portMap[port]
+	if !ok {
+		factory, ok := lookupPort(port)
+
+		return factory, ok, nil
+	}
+
+	factory, err := lookupName(name)
+	if err != nil {
+		return nil, false, fmt.Errorf("port %s: %w", port, err)
+	}
+
+	return factory, true, nil
+}
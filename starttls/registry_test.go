@@ -0,0 +1,275 @@
+package starttls
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	factory := func() StartTLSProtocol {
+		p, _ := NewLineProtocol("appliance", `^\+READY`, "UPGRADE", `^\+GO`)
+
+		return p
+	}
+
+	Register("Appliance", []string{"7000", "7001"}, factory)
+	t.Cleanup(func() { Unregister("appliance") })
+
+	result, err := negotiateWithServer(t, "7001", []string{"+READY\r\n", "+GO\r\n"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if result.Protocol != "appliance" || !result.TLSEstablished {
+		t.Errorf("Expected established appliance negotiation, got %+v", result)
+	}
+
+	p, err := Protocol("APPLIANCE")
+	if err != nil || p.Name() != "appliance" {
+		t.Errorf("Expected appliance protocol by name, got %v, %v", p, err)
+	}
+
+	Unregister("appliance")
+
+	if _, ok := lookupPort("7000"); ok {
+		t.Error("Port 7000 is still registered after Unregister")
+	}
+
+	if _, err := Protocol("appliance"); !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol, got: %v", err)
+	}
+}
+
+func TestRegisterOverridesBuiltin(t *testing.T) {
+	Register("nats", nil, func() StartTLSProtocol {
+		p, _ := NewLineProtocol("nats", "", "UPGRADE", `^\+GO`)
+
+		return p
+	})
+	t.Cleanup(func() {
+		Register("nats", []string{"4222"}, func() StartTLSProtocol { return newNATSProtocol() })
+	})
+
+	factory, ok := lookupPort("4222")
+	if !ok {
+		t.Fatal("Port 4222 lost its protocol")
+	}
+
+	if _, ok := factory().(*lineProtocol); !ok {
+		t.Errorf("Expected the replacement protocol, got %T", factory())
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a nil factory")
+		}
+	}()
+
+	Register("broken", nil, nil)
+}
+
+func TestWithPortMap(t *testing.T) {
+	portMap := map[string]ProtocolID{"10143": "IMAP", "993": "imap", "10025": "unknown"}
+	messages := []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n", serverMessagesIMAPSuccess}
+
+	result, err := negotiateWithServer(t, "10143", messages, WithPortMap(portMap))
+	if err != nil || result.Protocol != "imap" || !result.TLSEstablished {
+		t.Errorf("Expected established imap negotiation, got %+v, %v", result, err)
+	}
+
+	result, err = negotiateWithServer(t, "993", messages, WithPortMap(portMap))
+	if err != nil || result.ImplicitTLS || !result.TLSEstablished {
+		t.Errorf("Expected the mapping to override the direct TLS port, got %+v, %v", result, err)
+	}
+
+	if _, err := Negotiate(context.Background(), nil, "10025", WithPortMap(portMap)); !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol, got: %v", err)
+	}
+
+	if _, ok := lookupPort("10143"); ok {
+		t.Error("WithPortMap changed the global registry")
+	}
+}
+
+func TestRegisterDirectTLSPorts(t *testing.T) {
+	expected := []string{"443", "465", "990", "993", "995", "3389", "8443", "9443"}
+	if ports := DirectTLSPorts(); !slices.Equal(ports, expected) {
+		t.Errorf("Expected built-in direct TLS ports %v, got %v", expected, ports)
+	}
+
+	RegisterDirectTLSPorts("10993")
+	t.Cleanup(func() { UnregisterDirectTLSPorts("10993") })
+
+	result, err := Negotiate(context.Background(), nil, "10993")
+	if err != nil || !result.ImplicitTLS {
+		t.Errorf("Expected implicit TLS for port 10993, got %+v, %v", result, err)
+	}
+
+	UnregisterDirectTLSPorts("10993")
+
+	if IsDirectTLSPort("10993") {
+		t.Error("Port 10993 is still a direct TLS port after UnregisterDirectTLSPorts")
+	}
+}
+
+func TestWithDirectTLSPorts(t *testing.T) {
+	result, err := Negotiate(context.Background(), nil, "25", WithDirectTLSPorts("10465", "25"))
+	if err != nil || !result.ImplicitTLS {
+		t.Errorf("Expected implicit TLS for port 25, got %+v, %v", result, err)
+	}
+
+	if IsDirectTLSPort("10465") {
+		t.Error("WithDirectTLSPorts changed the global direct TLS ports")
+	}
+
+	messages := []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n", serverMessagesIMAPSuccess}
+
+	result, err = negotiateWithServer(t, "10143", messages,
+		WithDirectTLSPorts("10143"), WithPortMap(map[string]ProtocolID{"10143": "imap"}))
+	if err != nil || result.ImplicitTLS || !result.TLSEstablished {
+		t.Errorf("Expected the port mapping to take precedence, got %+v, %v", result, err)
+	}
+}
+
+func TestLookupProtocol(t *testing.T) {
+	tests := []struct {
+		name             string
+		port             string
+		opts             []Option
+		expectedProtocol string
+		expectedMode     TLSMode
+	}{
+		{name: "registered port", port: "587", expectedProtocol: "smtp", expectedMode: TLSModeSTARTTLS},
+		{name: "service name", port: "pop3", expectedProtocol: "pop3", expectedMode: TLSModeSTARTTLS},
+		{name: "direct tls port", port: "993", expectedMode: TLSModeDirect},
+		{name: "direct tls service name", port: "https", expectedMode: TLSModeDirect},
+		{name: "unknown port", port: "8080", expectedMode: TLSModeUnknown},
+		{
+			name:             "per-call port map",
+			port:             "10143",
+			opts:             []Option{WithPortMap(map[string]ProtocolID{"10143": "imap"})},
+			expectedProtocol: "imap",
+			expectedMode:     TLSModeSTARTTLS,
+		},
+		{
+			name:         "per-call direct tls port",
+			port:         "25",
+			opts:         []Option{WithDirectTLSPorts("25")},
+			expectedMode: TLSModeDirect,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocol, mode, err := LookupProtocol(tt.port, tt.opts...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if mode != tt.expectedMode {
+				t.Errorf("Expected mode %s, got %s", tt.expectedMode, mode)
+			}
+
+			var name string
+			if protocol != nil {
+				name = protocol.Name()
+			}
+
+			if name != tt.expectedProtocol {
+				t.Errorf("Expected protocol %q, got %q", tt.expectedProtocol, name)
+			}
+		})
+	}
+
+	_, _, err := LookupProtocol("25", WithPortMap(map[string]ProtocolID{"25": "gopher"}))
+	if !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol for an unregistered mapping, got %v", err)
+	}
+
+	_, _, err = LookupProtocol("no-such-service")
+	if err == nil {
+		t.Error("Expected an error for an unknown service name")
+	}
+}
+
+func TestPortString(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     string
+		expected string
+	}{
+		{name: "port", port: "25", expected: "25"},
+		{name: "host and port", port: "mail.example.com:587", expected: "587"},
+		{name: "ipv6 address", port: "[2001:db8::1]:143", expected: "143"},
+		{name: "empty host", port: ":110", expected: "110"},
+		{name: "service name", port: "submission", expected: "submission"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := portString(tt.port); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	if got := portString(465); got != "465" {
+		t.Errorf("Expected \"465\", got %q", got)
+	}
+}
+
+func TestNegotiatePortForms(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, port := range []string{"mail.example.com:25", "[::1]:25", "smtp", "mail.example.com:smtp"} {
+		conn := &dryRunConn{respond: dryRunSMTPReply}
+		conn.replies.WriteString(serverMessagesStart)
+
+		result, err := Negotiate(ctx, conn, port)
+		if err != nil || result.Protocol != "smtp" || !result.TLSEstablished {
+			t.Errorf("%s: expected an SMTP upgrade, got %+v, %v", port, result, err)
+		}
+	}
+
+	conn := &dryRunConn{respond: dryRunIMAPReply}
+	conn.replies.WriteString("* OK ready\r\n")
+
+	result, err := Negotiate(ctx, conn, 143)
+	if err != nil || result.Protocol != "imap" || !result.TLSEstablished {
+		t.Errorf("Expected an IMAP upgrade for port 143, got %+v, %v", result, err)
+	}
+
+	result, err = Negotiate(ctx, conn, 993)
+	if err != nil || !result.ImplicitTLS {
+		t.Errorf("Expected port 993 to be direct TLS, got %+v, %v", result, err)
+	}
+
+	_, mode, err := LookupProtocol("mail.example.com:smtp")
+	if err != nil || mode != TLSModeSTARTTLS {
+		t.Errorf("Expected STARTTLS for the smtp service, got %v, %v", mode, err)
+	}
+
+	_, err = Negotiate(ctx, conn, "no-such-service")
+	if err == nil {
+		t.Error("Expected an error for an unknown service name")
+	}
+
+	if !IsDirectTLSPort("https") || IsDirectTLSPort("pop3") {
+		t.Error("Expected the https service to be direct TLS and pop3 not")
+	}
+
+	// A name used as a port in the port map is not resolved.
+	conn = &dryRunConn{respond: dryRunSMTPReply}
+	conn.replies.WriteString(serverMessagesStart)
+
+	result, err = Negotiate(ctx, conn, "appliance", WithPortMap(map[string]ProtocolID{"appliance": ProtocolSMTP}))
+	if err != nil || result.Protocol != ProtocolSMTP {
+		t.Errorf("Expected the mapped name to select SMTP, got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,409 @@
+package starttls
+
+import (
+	"strings"
+	"time"
+)
+
+// StartTLSResult describes the outcome of a STARTTLS negotiation.
+type StartTLSResult struct {
+	// Protocol is the name of the negotiated protocol, empty when the port
+	// does not use STARTTLS.
+	Protocol ProtocolID
+	// TLSEstablished reports whether the server accepted STARTTLS and the
+	// connection is ready for the TLS handshake.
+	TLSEstablished bool
+	// UpgradeCommand is the command sent to request the upgrade, such as
+	// "STARTTLS", "STLS" or "AUTH TLS", for line-based protocols.
+	UpgradeCommand string
+	// ImplicitTLS reports that the port is a known direct TLS port, such as
+	// 465 or 990, where the TLS handshake starts immediately.
+	ImplicitTLS bool
+	// FallbackReason is set in opportunistic mode when the negotiation fell
+	// back to plaintext instead of failing, and explains why.
+	FallbackReason error
+	// Capabilities lists the capabilities the server advertised before TLS.
+	Capabilities []string
+	// Findings lists security-relevant observations made during negotiation.
+	Findings []Finding
+	// Details holds protocol-specific metadata. Its concrete type depends on
+	// the protocol: *SMTPCapabilities for SMTP, *IMAPCapabilities for IMAP,
+	// *POP3Info for POP3, *FTPInfo for FTP with WithFTPFeatures,
+	// *MySQLHandshakeInfo for MySQL and *NATSInfo for NATS. Use ResultDetails
+	// for typed access.
+	Details any
+	// RejectionBehavior records how the server behaved after rejecting
+	// STARTTLS. It is only populated with WithRejectionObservation.
+	RejectionBehavior RejectionBehavior
+	// Probed reports that WithProbeOnly verified STARTTLS support and
+	// stopped the negotiation. TLSEstablished is then false and the
+	// connection must not be used for a TLS handshake.
+	Probed bool
+	// Banner is the greeting of text protocols as the server sent it, with
+	// line terminators removed and the lines of a multiline greeting joined
+	// by "\n". MySQL greets in binary, so its server version is used
+	// instead. It is not sanitized.
+	Banner string
+	// Duration is how long the whole negotiation took.
+	Duration time.Duration
+	// Timings lists how long each step of the negotiation took, in order,
+	// for the protocols that report steps.
+	Timings []StepTiming
+	// BytesSent and BytesReceived count the bytes written to and read from
+	// the connection during the negotiation. BytesReceived can include
+	// data buffered past the last reply the negotiation read.
+	BytesSent     int64
+	BytesReceived int64
+
+	// pending holds bytes read past the server's acceptance of the upgrade.
+	pending []byte
+	// imapTags counts the IMAP tags used on the connection, so that
+	// PostTLSCapabilities continues the numbering.
+	imapTags int
+}
+
+// Negotiation steps reported in StartTLSResult.Timings.
+const (
+	// StepGreeting is waiting for the server greeting.
+	StepGreeting = "greeting"
+	// StepCapabilities is the capability request, such as EHLO, CAPABILITY,
+	// CAPA or FEAT.
+	StepCapabilities = "capabilities"
+	// StepUpgrade is the upgrade command and the server's reply to it.
+	StepUpgrade = "upgrade"
+)
+
+// StepTiming is the duration of one step of the negotiation.
+type StepTiming struct {
+	// Step is one of the Step* constants.
+	Step     string
+	Duration time.Duration
+}
+
+// addTiming records that step ran from start until end.
+func (r *StartTLSResult) addTiming(step string, start, end time.Time) {
+	r.Timings = append(r.Timings, StepTiming{Step: step, Duration: end.Sub(start)})
+}
+
+// ResultDetails returns the protocol-specific details of r as T, reporting
+// whether r carries details of that type.
+//
+//	caps, ok := starttls.ResultDetails[*starttls.SMTPCapabilities](result)
+func ResultDetails[T any](r *StartTLSResult) (T, bool) {
+	if r == nil {
+		var zero T
+
+		return zero, false
+	}
+
+	details, ok := r.Details.(T)
+
+	return details, ok
+}
+
+// SMTPCapabilities holds what the server advertised in its EHLO reply.
+type SMTPCapabilities struct {
+	// Domain is the server domain from the first line of the EHLO reply.
+	Domain string `json:"domain"`
+	// Extensions lists the EHLO keywords with their parameters,
+	// e.g. "SIZE 35882577" or "AUTH PLAIN LOGIN".
+	Extensions []string `json:"extensions"`
+	// RequireTLS reports whether the server advertised the REQUIRETLS
+	// extension (RFC 8689).
+	RequireTLS bool `json:"require_tls"`
+	// AnonymousTLS reports whether the server advertised the Microsoft
+	// Exchange X-ANONYMOUSTLS extension.
+	AnonymousTLS bool `json:"anonymous_tls"`
+}
+
+// Has reports whether the extension keyword was advertised.
+func (c *SMTPCapabilities) Has(keyword string) bool {
+	_, ok := c.Param(keyword)
+
+	return ok
+}
+
+// Keywords returns the advertised extension keywords in upper case, without
+// their parameters, e.g. "SIZE", "PIPELINING", "AUTH", "STARTTLS".
+func (c *SMTPCapabilities) Keywords() []string {
+	keywords := make([]string, 0, len(c.Extensions))
+
+	for _, ext := range c.Extensions {
+		name, _, _ := strings.Cut(ext, " ")
+		keywords = append(keywords, strings.ToUpper(name))
+	}
+
+	return keywords
+}
+
+// Param returns the parameters advertised with the extension keyword, such
+// as "35882577" for SIZE, and whether the keyword was advertised at all.
+func (c *SMTPCapabilities) Param(keyword string) (string, bool) {
+	for _, ext := range c.Extensions {
+		name, param, _ := strings.Cut(ext, " ")
+		if strings.EqualFold(name, keyword) {
+			return strings.TrimSpace(param), true
+		}
+	}
+
+	return "", false
+}
+
+// AuthMechanisms returns the SASL mechanisms advertised with AUTH.
+func (c *SMTPCapabilities) AuthMechanisms() []string {
+	param, _ := c.Param("AUTH")
+
+	return strings.Fields(param)
+}
+
+// IMAPCapabilities holds the capabilities an IMAP server advertised.
+type IMAPCapabilities struct {
+	// Capabilities lists the capability atoms, e.g. "IMAP4rev1" or "AUTH=PLAIN".
+	Capabilities []string `json:"capabilities"`
+}
+
+// Has reports whether the capability was advertised.
+func (c *IMAPCapabilities) Has(capability string) bool {
+	for _, atom := range c.Capabilities {
+		if strings.EqualFold(atom, capability) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthMechanisms returns the SASL mechanisms advertised as AUTH= capabilities.
+func (c *IMAPCapabilities) AuthMechanisms() []string {
+	var mechanisms []string
+
+	for _, atom := range c.Capabilities {
+		if len(atom) > 5 && strings.EqualFold(atom[:5], "AUTH=") {
+			mechanisms = append(mechanisms, strings.ToUpper(atom[5:]))
+		}
+	}
+
+	return mechanisms
+}
+
+// LoginDisabled reports whether the server advertised LOGINDISABLED, which
+// means LOGIN is refused until the connection is protected by TLS.
+func (c *IMAPCapabilities) LoginDisabled() bool {
+	return c.Has("LOGINDISABLED")
+}
+
+// POP3Info holds what a POP3 server revealed in its greeting and CAPA reply.
+type POP3Info struct {
+	// APOPTimestamp is the APOP challenge from the greeting, including the
+	// angle brackets, or empty when the server does not offer APOP.
+	APOPTimestamp string `json:"apop_timestamp,omitempty"`
+	// Capabilities lists the CAPA lines with their parameters, e.g. "TOP",
+	// "SASL PLAIN LOGIN" or "STLS".
+	Capabilities []string `json:"capabilities"`
+}
+
+// Has reports whether the capability keyword was advertised.
+func (i *POP3Info) Has(keyword string) bool {
+	for _, capability := range i.Capabilities {
+		name, _, _ := strings.Cut(capability, " ")
+		if strings.EqualFold(name, keyword) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SASLMechanisms returns the mechanisms advertised with the SASL capability.
+func (i *POP3Info) SASLMechanisms() []string {
+	for _, capability := range i.Capabilities {
+		name, mechanisms, _ := strings.Cut(capability, " ")
+		if strings.EqualFold(name, "SASL") {
+			return strings.Fields(mechanisms)
+		}
+	}
+
+	return nil
+}
+
+// FTPInfo holds the FEAT reply of an FTP server, recorded with WithFTPFeatures.
+type FTPInfo struct {
+	// Features lists the feature lines with their parameters, e.g.
+	// "AUTH TLS;SSL", "PBSZ" or "PROT".
+	Features []string `json:"features"`
+}
+
+// Has reports whether the feature was advertised. A feature with
+// parameters matches by name, and "AUTH TLS" also matches "AUTH TLS;SSL".
+func (i *FTPInfo) Has(feature string) bool {
+	name, param, _ := strings.Cut(feature, " ")
+
+	for _, f := range i.Features {
+		fname, fparams, _ := strings.Cut(f, " ")
+		if !strings.EqualFold(fname, name) {
+			continue
+		}
+
+		if param == "" || containsFold(strings.Split(fparams, ";"), param) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MySQLHandshakeInfo holds the fields of the initial MySQL handshake packet.
+type MySQLHandshakeInfo struct {
+	ProtocolVersion uint8  `json:"protocol_version"`
+	ServerVersion   string `json:"server_version"`
+	// ThreadID is the connection ID the server assigned.
+	ThreadID uint32 `json:"thread_id"`
+	// Capabilities is the full 32-bit server capability bitmask.
+	Capabilities uint32 `json:"capabilities"`
+	// MariaDB reports whether the server identified itself as MariaDB.
+	// ServerVersion then has the "5.5.5-" compatibility prefix removed.
+	MariaDB bool `json:"mariadb"`
+	// MariaDBCapabilities holds the MariaDB extended capability bits, sent
+	// by MariaDB servers in place of the CLIENT_MYSQL flag.
+	MariaDBCapabilities uint32 `json:"mariadb_capabilities,omitempty"`
+	// CharacterSet is the server's default collation ID, e.g. 255 for
+	// utf8mb4_0900_ai_ci.
+	CharacterSet uint8 `json:"character_set"`
+	// StatusFlags holds the SERVER_STATUS_* flags.
+	StatusFlags uint16 `json:"status_flags"`
+	// AuthPluginName is the default authentication plugin, e.g.
+	// "caching_sha2_password". It is empty when the server does not
+	// support CLIENT_PLUGIN_AUTH.
+	AuthPluginName string `json:"auth_plugin_name,omitempty"`
+
+	// scramble is the auth plugin data, kept for AuthenticateMySQL.
+	scramble string
+}
+
+// RejectionBehavior classifies what a server does after rejecting STARTTLS.
+type RejectionBehavior int
+
+// Rejection behaviors.
+const (
+	// RejectionNotObserved means the behavior was not observed.
+	RejectionNotObserved RejectionBehavior = iota
+	// RejectionClosed means the server closed the connection.
+	RejectionClosed
+	// RejectionOpen means the server kept answering commands, which usually
+	// indicates a deliberate policy rejection.
+	RejectionOpen
+	// RejectionHang means the server stopped responding, which is typical of
+	// broken middleboxes that strip STARTTLS.
+	RejectionHang
+)
+
+// String returns the lowercase name of the behavior.
+func (b RejectionBehavior) String() string {
+	switch b {
+	case RejectionNotObserved:
+		return "not-observed"
+	case RejectionClosed:
+		return "closed"
+	case RejectionOpen:
+		return "open"
+	case RejectionHang:
+		return "hang"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes the behavior as its String name.
+func (b RejectionBehavior) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// Severity ranks how serious a finding is.
+type Severity int
+
+// Finding severities.
+const (
+	SeverityInfo Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+)
+
+// String returns the lowercase name of the severity.
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityLow:
+		return "low"
+	case SeverityMedium:
+		return "medium"
+	case SeverityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes the severity as its String name.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding identifiers.
+const (
+	FindingCompressionOffered     = "compression-offered"
+	FindingRequireTLSMissing      = "requiretls-missing"
+	FindingAPOPAdvertised         = "apop-advertised"
+	FindingMailRequiresTLS        = "mail-requires-tls"
+	FindingPlaintextMailAccepted  = "plaintext-mail-accepted"
+	FindingLoginDisabledMissing   = "logindisabled-missing"
+	FindingLoginRequiresTLS       = "login-requires-tls"
+	FindingPlaintextLoginAccepted = "plaintext-login-accepted"
+)
+
+// Finding is a security-relevant observation recorded during negotiation.
+type Finding struct {
+	// ID identifies the kind of finding, one of the Finding* constants.
+	ID       string   `json:"id"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// addFinding records a finding on the result.
+func (r *StartTLSResult) addFinding(id string, severity Severity, message string) {
+	r.Findings = append(r.Findings, Finding{ID: id, Severity: severity, Message: message})
+}
+
+// auditCapabilities records findings derived from the advertised capabilities.
+func (r *StartTLSResult) auditCapabilities() {
+	for _, capability := range r.Capabilities {
+		if isCompressionCapability(capability) {
+			r.addFinding(FindingCompressionOffered, SeverityMedium,
+				"server offers "+sanitizeResponse(capability)+" before TLS; compression combined with TLS enables CRIME-style attacks")
+		}
+	}
+
+	if caps, ok := r.Details.(*SMTPCapabilities); ok && caps.Has("STARTTLS") && !caps.RequireTLS {
+		r.addFinding(FindingRequireTLSMissing, SeverityInfo,
+			"server supports STARTTLS but does not advertise REQUIRETLS (RFC 8689)")
+	}
+
+	if caps, ok := r.Details.(*IMAPCapabilities); ok && caps.Has("STARTTLS") && !caps.LoginDisabled() {
+		r.addFinding(FindingLoginDisabledMissing, SeverityLow,
+			"server supports STARTTLS but does not advertise LOGINDISABLED, so clients may send passwords before TLS")
+	}
+
+	if info, ok := r.Details.(*POP3Info); ok && info.APOPTimestamp != "" {
+		r.addFinding(FindingAPOPAdvertised, SeverityLow,
+			"server advertises APOP, which authenticates with an MD5 digest of a shared secret")
+	}
+}
+
+// isCompressionCapability reports whether a capability offers application
+// layer compression, such as IMAP COMPRESS=DEFLATE.
+func isCompressionCapability(capability string) bool {
+	capability = strings.ToUpper(capability)
+
+	return strings.Contains(capability, "COMPRESS") || strings.Contains(capability, "DEFLATE")
+}
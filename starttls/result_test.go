@@ -0,0 +1,604 @@
+package starttls
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateCompressionFinding(t *testing.T) {
+	tests := []struct {
+		name           string
+		port           string
+		serverMessages []string
+		expectFinding  bool
+	}{
+		{
+			name: "smtp compression offered",
+			port: "25",
+			serverMessages: []string{
+				serverMessagesStart,
+				"250-test.test.test\r\n250-X-COMPRESS DEFLATE\r\n250 STARTTLS\r\n",
+				"220 ready for TLS\r\n",
+			},
+			expectFinding: true,
+		},
+		{
+			name: "smtp no compression",
+			port: "25",
+			serverMessages: []string{
+				serverMessagesStart,
+				serverMessagesSMTP,
+				"220 ready for TLS\r\n",
+			},
+		},
+		{
+			name: "imap compress=deflate in greeting",
+			port: "143",
+			serverMessages: []string{
+				"* OK [CAPABILITY IMAP4rev1 STARTTLS COMPRESS=DEFLATE] ready\r\n",
+				serverMessagesIMAPSuccess,
+			},
+			expectFinding: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, tt.port, tt.serverMessages)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			found := false
+
+			for _, f := range result.Findings {
+				if f.ID == FindingCompressionOffered {
+					found = true
+				}
+			}
+
+			if found != tt.expectFinding {
+				t.Errorf("Expected compression finding %v, got findings %v (capabilities %v)",
+					tt.expectFinding, result.Findings, result.Capabilities)
+			}
+		})
+	}
+}
+
+func TestParseIMAPGreetingCapabilities(t *testing.T) {
+	got := parseIMAPGreetingCapabilities("* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n")
+	if len(got) != 2 || got[0] != "IMAP4rev1" || got[1] != "STARTTLS" {
+		t.Errorf("Unexpected capabilities: %v", got)
+	}
+
+	if got := parseIMAPGreetingCapabilities("* OK ready\r\n"); got != nil {
+		t.Errorf("Expected no capabilities, got %v", got)
+	}
+}
+
+func TestResultDetails(t *testing.T) {
+	t.Run("smtp", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "25", []string{
+			serverMessagesStart,
+			"250-test.test.test Hello\r\n250-SIZE 1000\r\n250-PIPELINING\r\n250 STARTTLS\r\n",
+			"220 ready for TLS\r\n",
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		caps, ok := ResultDetails[*SMTPCapabilities](result)
+		if !ok {
+			t.Fatalf("Expected SMTP details, got %T", result.Details)
+		}
+
+		if caps.Domain != "test.test.test" {
+			t.Errorf("Unexpected domain: %q", caps.Domain)
+		}
+
+		if !caps.Has("pipelining") || !caps.Has("SIZE") || caps.Has("CHUNKING") {
+			t.Errorf("Unexpected extensions: %v", caps.Extensions)
+		}
+
+		if _, ok := ResultDetails[*IMAPCapabilities](result); ok {
+			t.Error("Did not expect IMAP details for SMTP result")
+		}
+	})
+
+	t.Run("imap", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "143", []string{
+			"* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n",
+			serverMessagesIMAPSuccess,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		caps, ok := ResultDetails[*IMAPCapabilities](result)
+		if !ok {
+			t.Fatalf("Expected IMAP details, got %T", result.Details)
+		}
+
+		if !caps.Has("LOGINDISABLED") {
+			t.Errorf("Unexpected capabilities: %v", caps.Capabilities)
+		}
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "3306", []string{
+			string([]byte{
+				0x17, 0x00, 0x00, 0x00, // Packet length (23 bytes) and sequence number 0
+				0x0a,                          // Protocol version (10)
+				'8', '.', '0', '.', '1', 0x00, // Server version (null terminated)
+				0x01, 0x02, 0x03, 0x04, // Thread ID
+				'1', '2', '3', '4', '5', '6', '7', '8', // Salt part 1
+				0x00,       // Filler
+				0x00, 0x0a, // Capability flags lower (SERVER_SSL 0x800 and PROTOCOL_41 0x200)
+				0x21, // Character set
+			}),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		info, ok := ResultDetails[*MySQLHandshakeInfo](result)
+		if !ok {
+			t.Fatalf("Expected MySQL details, got %T", result.Details)
+		}
+
+		if info.ServerVersion != "8.0.1" || info.Capabilities&clientSSL == 0 {
+			t.Errorf("Unexpected handshake info: %+v", info)
+		}
+	})
+
+	t.Run("nil result", func(t *testing.T) {
+		if _, ok := ResultDetails[*SMTPCapabilities](nil); ok {
+			t.Error("Expected no details for nil result")
+		}
+	})
+}
+
+func TestRequireTLSFinding(t *testing.T) {
+	tests := []struct {
+		name          string
+		ehlo          string
+		requireTLS    bool
+		expectFinding bool
+	}{
+		{
+			name:          "starttls without requiretls",
+			ehlo:          serverMessagesSMTP,
+			expectFinding: true,
+		},
+		{
+			name:       "starttls with requiretls",
+			ehlo:       "250-test.test.test\r\n250-REQUIRETLS\r\n250 STARTTLS\r\n",
+			requireTLS: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "25", []string{
+				serverMessagesStart,
+				tt.ehlo,
+				"220 ready for TLS\r\n",
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			caps, _ := ResultDetails[*SMTPCapabilities](result)
+			if caps.RequireTLS != tt.requireTLS {
+				t.Errorf("Expected RequireTLS %v, got %v", tt.requireTLS, caps.RequireTLS)
+			}
+
+			found := false
+
+			for _, f := range result.Findings {
+				if f.ID == FindingRequireTLSMissing {
+					found = true
+				}
+			}
+
+			if found != tt.expectFinding {
+				t.Errorf("Expected REQUIRETLS finding %v, got findings %v", tt.expectFinding, result.Findings)
+			}
+		})
+	}
+}
+
+func TestAPOPFinding(t *testing.T) {
+	tests := []struct {
+		name              string
+		greeting          string
+		expectedTimestamp string
+	}{
+		{
+			name:              "apop advertised",
+			greeting:          "+OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>\r\n",
+			expectedTimestamp: "<1896.697170952@dbc.mtview.ca.us>",
+		},
+		{
+			name:     "no apop",
+			greeting: "+OK POP3 server ready\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "110", []string{
+				tt.greeting,
+				serverMessagesPOP3Capa,
+				serverMessagesPOP3Success,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			info, ok := ResultDetails[*POP3Info](result)
+			if !ok {
+				t.Fatalf("Expected POP3 details, got %T", result.Details)
+			}
+
+			if info.APOPTimestamp != tt.expectedTimestamp {
+				t.Errorf("Expected timestamp %q, got %q", tt.expectedTimestamp, info.APOPTimestamp)
+			}
+
+			found := false
+
+			for _, f := range result.Findings {
+				if f.ID == FindingAPOPAdvertised {
+					found = true
+				}
+			}
+
+			if found != (tt.expectedTimestamp != "") {
+				t.Errorf("Unexpected findings %v", result.Findings)
+			}
+		})
+	}
+}
+
+func TestSMTPCapabilitiesKeywords(t *testing.T) {
+	caps := &SMTPCapabilities{
+		Extensions: []string{"SIZE 35882577", "pipelining", "AUTH PLAIN LOGIN", "STARTTLS"},
+	}
+
+	if got := strings.Join(caps.Keywords(), ","); got != "SIZE,PIPELINING,AUTH,STARTTLS" {
+		t.Errorf("Unexpected keywords %s", got)
+	}
+
+	if size, ok := caps.Param("size"); !ok || size != "35882577" {
+		t.Errorf("Unexpected SIZE parameter %q, %v", size, ok)
+	}
+
+	if param, ok := caps.Param("STARTTLS"); !ok || param != "" {
+		t.Errorf("Unexpected STARTTLS parameter %q, %v", param, ok)
+	}
+
+	if _, ok := caps.Param("8BITMIME"); ok {
+		t.Error("Expected 8BITMIME to be missing")
+	}
+
+	if mechs := caps.AuthMechanisms(); len(mechs) != 2 || mechs[0] != "PLAIN" || mechs[1] != "LOGIN" {
+		t.Errorf("Unexpected AUTH mechanisms %v", mechs)
+	}
+
+	if !caps.Has("Pipelining") {
+		t.Error("Expected PIPELINING")
+	}
+}
+
+func TestIMAPCapabilitiesAccessors(t *testing.T) {
+	caps := &IMAPCapabilities{
+		Capabilities: []string{"IMAP4rev1", "STARTTLS", "auth=plain", "AUTH=XOAUTH2", "LOGINDISABLED"},
+	}
+
+	if mechs := strings.Join(caps.AuthMechanisms(), ","); mechs != "PLAIN,XOAUTH2" {
+		t.Errorf("Unexpected AUTH mechanisms %s", mechs)
+	}
+
+	if !caps.LoginDisabled() || !caps.Has("starttls") {
+		t.Errorf("Unexpected capability checks for %v", caps.Capabilities)
+	}
+
+	if (&IMAPCapabilities{Capabilities: []string{"IMAP4rev1"}}).LoginDisabled() {
+		t.Error("Did not expect LOGINDISABLED")
+	}
+}
+
+func TestPOP3Capabilities(t *testing.T) {
+	result, err := negotiateWithServer(t, "110", []string{
+		serverMessagesPOP3,
+		"+OK Capability list follows\r\nTOP\r\nUIDL\r\nSASL PLAIN LOGIN\r\nSTLS\r\n.\r\n",
+		serverMessagesPOP3Success,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	info, ok := ResultDetails[*POP3Info](result)
+	if !ok {
+		t.Fatalf("Expected POP3 details, got %T", result.Details)
+	}
+
+	if strings.Join(info.Capabilities, ",") != "TOP,UIDL,SASL PLAIN LOGIN,STLS" {
+		t.Errorf("Unexpected capabilities %q", info.Capabilities)
+	}
+
+	if !info.Has("uidl") || info.Has("USER") {
+		t.Errorf("Unexpected Has results for %q", info.Capabilities)
+	}
+
+	if mechs := strings.Join(info.SASLMechanisms(), ","); mechs != "PLAIN,LOGIN" {
+		t.Errorf("Unexpected SASL mechanisms %s", mechs)
+	}
+
+	if len(result.Capabilities) != 4 {
+		t.Errorf("Expected capabilities in result, got %q", result.Capabilities)
+	}
+}
+
+func TestSMTPMailAudit(t *testing.T) {
+	tests := []struct {
+		name            string
+		messages        []string
+		expectedFinding string
+		expectedError   error
+	}{
+		{
+			name: "tls enforced",
+			messages: []string{
+				serverMessagesStart,
+				serverMessagesSMTP,
+				"530 5.7.0 Must issue a STARTTLS command first\r\n",
+				serverMessagesStart,
+			},
+			expectedFinding: FindingMailRequiresTLS,
+		},
+		{
+			name: "plaintext accepted",
+			messages: []string{
+				serverMessagesStart,
+				serverMessagesSMTP,
+				"250 2.1.0 Ok\r\n",
+				"250 2.0.0 Ok\r\n",
+				serverMessagesStart,
+			},
+			expectedFinding: FindingPlaintextMailAccepted,
+		},
+		{
+			name: "inconclusive",
+			messages: []string{
+				serverMessagesStart,
+				serverMessagesSMTP,
+				"553 5.1.8 Sender address rejected\r\n",
+				serverMessagesStart,
+			},
+		},
+		{
+			name: "rset refused",
+			messages: []string{
+				serverMessagesStart,
+				serverMessagesSMTP,
+				"250 2.1.0 Ok\r\n",
+				"500 5.5.1 Unrecognized command\r\n",
+			},
+			expectedFinding: FindingPlaintextMailAccepted,
+			expectedError:   ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "25", tt.messages, WithSMTPMailAudit())
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+			}
+
+			var ids []string
+
+			for _, f := range result.Findings {
+				if f.ID == FindingMailRequiresTLS || f.ID == FindingPlaintextMailAccepted {
+					ids = append(ids, f.ID)
+				}
+			}
+
+			if tt.expectedFinding == "" && len(ids) != 0 || tt.expectedFinding != "" && (len(ids) != 1 || ids[0] != tt.expectedFinding) {
+				t.Errorf("Expected finding %q, got %v", tt.expectedFinding, ids)
+			}
+		})
+	}
+}
+
+func TestIMAPLoginFindings(t *testing.T) {
+	tests := []struct {
+		name             string
+		messages         []string
+		opts             []Option
+		expectedFindings []string
+	}{
+		{
+			name: "logindisabled missing",
+			messages: []string{
+				"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n",
+				serverMessagesIMAPSuccess,
+			},
+			expectedFindings: []string{FindingLoginDisabledMissing},
+		},
+		{
+			name: "logindisabled advertised",
+			messages: []string{
+				"* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n",
+				serverMessagesIMAPSuccess,
+			},
+		},
+		{
+			name: "login refused with privacyrequired",
+			messages: []string{
+				"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n",
+				"a001 NO [PRIVACYREQUIRED] Plaintext authentication disallowed\r\n",
+				"a002 OK Begin TLS negotiation now\r\n",
+			},
+			opts:             []Option{WithIMAPLoginAudit()},
+			expectedFindings: []string{FindingLoginRequiresTLS, FindingLoginDisabledMissing},
+		},
+		{
+			name: "login refused with bad",
+			messages: []string{
+				"* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n",
+				"a001 BAD LOGIN is disabled\r\n",
+				"a002 OK Begin TLS negotiation now\r\n",
+			},
+			opts:             []Option{WithIMAPLoginAudit()},
+			expectedFindings: []string{FindingLoginRequiresTLS},
+		},
+		{
+			name: "credentials evaluated",
+			messages: []string{
+				"* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n",
+				"a001 NO [AUTHENTICATIONFAILED] Invalid credentials\r\n",
+				"a002 OK Begin TLS negotiation now\r\n",
+			},
+			opts:             []Option{WithIMAPLoginAudit()},
+			expectedFindings: []string{FindingPlaintextLoginAccepted},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "143", tt.messages, tt.opts...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var ids []string
+			for _, f := range result.Findings {
+				ids = append(ids, f.ID)
+			}
+
+			if strings.Join(ids, ",") != strings.Join(tt.expectedFindings, ",") {
+				t.Errorf("Expected findings %v, got %v", tt.expectedFindings, ids)
+			}
+		})
+	}
+}
+
+func TestIMAPLoginAuditAccepted(t *testing.T) {
+	var received []string
+
+	result, err := negotiateWithHandler(t, "143", func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+
+		_, _ = conn.Write([]byte("* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n"))
+
+		for _, reply := range []string{
+			"a001 OK LOGIN completed\r\n",
+			"* BYE logging out\r\na002 OK LOGOUT completed\r\n",
+		} {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			received = append(received, line)
+			_, _ = conn.Write([]byte(reply))
+		}
+
+		// Anything sent after LOGOUT would be a second command.
+		line, err := reader.ReadString('\n')
+		if err == nil {
+			received = append(received, line)
+		}
+	}, WithIMAPLoginAudit(), WithGracefulQuit())
+
+	if !errors.Is(err, ErrIMAPLoginAccepted) || !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Fatalf("Expected ErrIMAPLoginAccepted and ErrStartTLSNotSupported, got %v", err)
+	}
+
+	if result.TLSEstablished || result.UpgradeCommand != "" {
+		t.Errorf("Expected no upgrade attempt, got command %q", result.UpgradeCommand)
+	}
+
+	if len(received) != 2 || !strings.HasSuffix(received[1], " LOGOUT\r\n") {
+		t.Errorf("Expected LOGIN then a single LOGOUT, got %q", received)
+	}
+
+	if len(result.Findings) != 1 || result.Findings[0].ID != FindingPlaintextLoginAccepted ||
+		result.Findings[0].Severity != SeverityHigh {
+		t.Errorf("Expected a high plaintext-login-accepted finding, got %+v", result.Findings)
+	}
+}
+
+func TestNegotiateMetrics(t *testing.T) {
+	tests := []struct {
+		name           string
+		port           string
+		messages       []string
+		expectedBanner string
+		expectedSteps  []string
+	}{
+		{
+			name:           "smtp multiline greeting",
+			port:           "25",
+			messages:       []string{"220-test.test.test ESMTP\r\n220 ready\r\n", serverMessagesSMTP, "220 ready for TLS\r\n"},
+			expectedBanner: "220-test.test.test ESMTP\n220 ready",
+			expectedSteps:  []string{StepGreeting, StepCapabilities, StepUpgrade},
+		},
+		{
+			name:           "imap capability request",
+			port:           "143",
+			messages:       []string{"* OK ready\r\n", "* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED\r\na001 OK done\r\n", "a002 OK Begin TLS\r\n"},
+			expectedBanner: "* OK ready",
+			expectedSteps:  []string{StepGreeting, StepCapabilities, StepUpgrade},
+		},
+		{
+			name:           "ftp",
+			port:           "21",
+			messages:       []string{"220 ftp.test ready\r\n", serverMessagesFTP},
+			expectedBanner: "220 ftp.test ready",
+			expectedSteps:  []string{StepGreeting, StepUpgrade},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, tt.port, tt.messages)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if result.Banner != tt.expectedBanner {
+				t.Errorf("Expected banner %q, got %q", tt.expectedBanner, result.Banner)
+			}
+
+			var steps []string
+			for _, timing := range result.Timings {
+				steps = append(steps, timing.Step)
+			}
+
+			if !slices.Equal(steps, tt.expectedSteps) {
+				t.Errorf("Expected steps %v, got %v", tt.expectedSteps, steps)
+			}
+
+			var received int64
+			for _, msg := range tt.messages {
+				received += int64(len(msg))
+			}
+
+			if result.BytesReceived != received || result.BytesSent == 0 {
+				t.Errorf("Expected %d bytes received and some sent, got %d and %d",
+					received, result.BytesReceived, result.BytesSent)
+			}
+
+			if result.Duration <= 0 {
+				t.Errorf("Expected a positive duration, got %v", result.Duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package starttls
+
+import (
+	"context"
+	"iter"
+	"net"
+	"sync"
+	"time"
+)
+
+// Scanner negotiates with many targets concurrently and yields the results
+// through an iterator:
+//
+//	scanner := &starttls.Scanner{Targets: addrs, Concurrency: 16}
+//	for target, result := range scanner.Results(ctx) {
+//		// ...
+//	}
+type Scanner struct {
+	// Targets are the "host:port" addresses to negotiate with.
+	Targets []string
+	// Concurrency is the number of targets negotiated at once. Zero or
+	// less negotiates one at a time.
+	Concurrency int
+	// Timeout bounds the negotiation with each target, including the
+	// dial. Zero means no limit other than the context.
+	Timeout time.Duration
+	// Options are passed to every negotiation.
+	Options []Option
+}
+
+// ScanResult is the outcome of the negotiation with one target. The
+// embedded result is never nil; it is empty when the target could not be
+// reached. It encodes to JSON as the result with an "error" field holding
+// the message of Err.
+type ScanResult struct {
+	*StartTLSResult
+	Err error
+}
+
+// Results returns an iterator over the targets and the outcome of their
+// negotiations, in the order the negotiations finish. Each target is dialed
+// over TCP and negotiated as by NegotiateCandidates, and no TLS handshake is
+// run. A connection upgraded to TLS is therefore closed without a quit
+// command, as the server expects a handshake; one that continued in
+// plaintext, as WithOpportunistic allows, is ended with CloseGracefully. One
+// whose negotiation failed is closed by NegotiateCandidates, without a quit
+// command unless Options include WithGracefulQuit. No more than Concurrency
+// negotiations run ahead of the loop, and ending the loop early cancels those
+// in progress and returns once they have stopped. When ctx is done, the
+// remaining targets are yielded with the error of the context.
+func (s *Scanner) Results(ctx context.Context) iter.Seq2[string, ScanResult] {
+	return func(yield func(string, ScanResult) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		type scanned struct {
+			target string
+			result ScanResult
+		}
+
+		targets := make(chan string)
+		results := make(chan scanned)
+		// stop is closed when the loop ends early, unlike ctx, which is
+		// also done when the caller's context is.
+		stop := make(chan struct{})
+
+		go func() {
+			defer close(targets)
+
+			for _, target := range s.Targets {
+				select {
+				case targets <- target:
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		var wg sync.WaitGroup
+
+		for range max(s.Concurrency, 1) {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for target := range targets {
+					select {
+					case results <- scanned{target, s.scan(ctx, target)}:
+					case <-stop:
+						return
+					}
+				}
+			}()
+		}
+
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		defer func() {
+			close(stop)
+			cancel()
+
+			for range results {
+			}
+		}()
+
+		for r := range results {
+			if !yield(r.target, r.result) {
+				return
+			}
+		}
+	}
+}
+
+// scan negotiates with target on a new connection and closes it.
+func (s *Scanner) scan(ctx context.Context, target string) ScanResult {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	dialer := &net.Dialer{}
+
+	conn, result, err := NegotiateCandidates(ctx, func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", target)
+	}, target, s.Options...)
+	if err == nil {
+		_ = CloseGracefully(ctx, conn, result, s.Options...)
+	}
+
+	return ScanResult{StartTLSResult: result, Err: err}
+}
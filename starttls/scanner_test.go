@@ -0,0 +1,95 @@
+package starttls
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScannerResults(t *testing.T) {
+	cert := newTestCertificate(t)
+
+	accepting, _, _ := startClientTestServer(t, cert, "220 ready for TLS\r\n")
+	rejecting, _, _ := startClientTestServer(t, cert, "454 4.7.0 TLS not available\r\n")
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	closed := listener.Addr().String()
+	listener.Close()
+
+	portMap := map[string]ProtocolID{}
+	for _, addr := range []string{accepting, rejecting, closed} {
+		_, port, _ := net.SplitHostPort(addr)
+		portMap[port] = ProtocolSMTP
+	}
+
+	scanner := &Scanner{
+		Targets:     []string{accepting, rejecting, closed},
+		Concurrency: 2,
+		Timeout:     2 * time.Second,
+		Options:     []Option{WithPortMap(portMap)},
+	}
+
+	results := map[string]ScanResult{}
+	for target, result := range scanner.Results(context.Background()) {
+		if result.StartTLSResult == nil {
+			t.Fatalf("%s: expected a result", target)
+		}
+
+		results[target] = result
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	if r := results[accepting]; r.Err != nil || !r.TLSEstablished || r.Protocol != ProtocolSMTP {
+		t.Errorf("Expected an upgrade, got %+v", r)
+	}
+
+	if r := results[rejecting]; !errors.Is(r.Err, ErrStartTLSNotSupported) {
+		t.Errorf("Expected ErrStartTLSNotSupported, got %v", r.Err)
+	}
+
+	if r := results[closed]; r.Err == nil {
+		t.Error("Expected a dial error for the closed port")
+	}
+}
+
+func TestScannerStop(t *testing.T) {
+	// The targets are never reached; ending the loop must not wait for
+	// the remaining ones.
+	scanner := &Scanner{Targets: []string{"localhost:bad", "localhost:bad", "localhost:bad", "localhost:bad"}, Concurrency: 2}
+
+	count := 0
+	for range scanner.Results(context.Background()) {
+		count++
+
+		break
+	}
+
+	if count != 1 {
+		t.Errorf("Expected one result before stopping, got %d", count)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	count = 0
+	for _, result := range scanner.Results(ctx) {
+		if result.Err == nil {
+			t.Error("Expected an error for each target")
+		}
+
+		count++
+	}
+
+	if count != len(scanner.Targets) {
+		t.Errorf("Expected every target after cancellation, got %d", count)
+	}
+}
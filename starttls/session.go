@@ -0,0 +1,236 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// session carries the per-call negotiation state through the protocol
+// handshake so helpers can record what they observe.
+type session struct {
+	cfg    *config
+	result *StartTLSResult
+	// step is the step in progress and response the last server reply,
+	// reported in a NegotiationError.
+	step      string
+	stepStart time.Time
+	response  string
+	// transcript is recorded with WithTranscript, WithHooks or WithLogger.
+	transcript *transcript
+	remoteAddr string
+	// capabilitiesSent records that the capabilities were sent as events.
+	capabilitiesSent bool
+	// ended records that the handshake ended the session itself, so that
+	// no quit command or rejection observation follows.
+	ended bool
+}
+
+func newSession(cfg *config, result *StartTLSResult, conn io.ReadWriter) *session {
+	s := &session{cfg: cfg, result: result}
+
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && cfg.logger != nil {
+		if addr := c.RemoteAddr(); addr != nil {
+			s.remoteAddr = addr.String()
+		}
+	}
+
+	return s
+}
+
+// readWriter returns the buffered reader and writer the handshake uses on
+// conn, reading the greeting from WithGreeting first, recording the
+// transcript when WithTranscript, WithHooks or WithLogger is set and
+// bounding the bytes read with WithMaxResponseBytes.
+func (s *session) readWriter(conn io.ReadWriter) *bufio.ReadWriter {
+	if s.cfg.greeting != "" {
+		conn = &greetingReadWriter{ReadWriter: conn, greeting: strings.NewReader(s.cfg.greeting)}
+	}
+
+	if s.cfg.maxResponseBytes > 0 {
+		conn = &limitedReadWriter{ReadWriter: conn, max: s.cfg.maxResponseBytes}
+	}
+
+	if s.cfg.transcript || s.cfg.hooks != nil || s.cfg.logger != nil {
+		s.transcript = &transcript{keep: s.cfg.transcript, hooks: s.cfg.hooks}
+		conn = &transcriptReadWriter{ReadWriter: conn, t: s.transcript}
+	}
+
+	return bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+}
+
+// greetingReadWriter returns the greeting the caller already read before
+// reading from the connection.
+type greetingReadWriter struct {
+	io.ReadWriter
+	greeting *strings.Reader
+}
+
+func (rw *greetingReadWriter) Read(b []byte) (int, error) {
+	if rw.greeting.Len() > 0 {
+		return rw.greeting.Read(b)
+	}
+
+	return rw.ReadWriter.Read(b)
+}
+
+// limitedReadWriter fails reads with a *LimitError once more than max bytes
+// have been read.
+type limitedReadWriter struct {
+	io.ReadWriter
+	max  int
+	read int
+}
+
+func (rw *limitedReadWriter) Read(b []byte) (int, error) {
+	if rw.read >= rw.max {
+		return 0, &LimitError{Limit: "response", Max: rw.max}
+	}
+
+	// Read at most one byte past the limit, which is enough to tell that
+	// the server exceeded it.
+	if len(b) > rw.max-rw.read {
+		b = b[:rw.max-rw.read+1]
+	}
+
+	n, err := rw.ReadWriter.Read(b)
+	rw.read += n
+
+	if rw.read > rw.max {
+		return max(0, n-(rw.read-rw.max)), &LimitError{Limit: "response", Max: rw.max}
+	}
+
+	return n, err
+}
+
+type sessionKey struct{}
+
+func withSession(ctx context.Context, s *session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// stepContext marks the start of a negotiation step, one of the Step*
+// constants, and bounds it by its timeout from WithStepTimeout. Without one,
+// ctx is returned unchanged.
+func stepContext(ctx context.Context, step string) (context.Context, context.CancelFunc) {
+	s := sessionFromContext(ctx)
+	s.endStep(ctx, nil)
+	s.step = step
+	s.stepStart = s.cfg.clock.Now()
+
+	if step == StepUpgrade {
+		s.emit(Event{Type: EventStartTLSSent, Text: s.result.UpgradeCommand})
+	}
+
+	if d := s.cfg.stepTimeouts[step]; d > 0 {
+		return withTimeout(ctx, s.cfg.clock, d)
+	}
+
+	return ctx, func() {}
+}
+
+// endStep reports the outcome of the step in progress to the OnStep hook
+// and the logger.
+func (s *session) endStep(ctx context.Context, err error) {
+	if s.step == "" {
+		return
+	}
+
+	var command string
+	if s.transcript != nil {
+		command = s.transcript.takeCommand()
+	}
+
+	if s.cfg.hooks != nil && s.cfg.hooks.OnStep != nil {
+		s.cfg.hooks.OnStep(s.step, err)
+	}
+
+	if s.step == StepGreeting && err == nil {
+		s.emit(Event{Type: EventGreeting, Text: s.result.Banner})
+	}
+
+	// IMAP servers may list their capabilities in the greeting, so they
+	// are sent once known rather than at the end of a particular step.
+	if len(s.result.Capabilities) > 0 && !s.capabilitiesSent {
+		s.capabilitiesSent = true
+
+		for _, capability := range s.result.Capabilities {
+			s.emit(Event{Type: EventCapability, Text: capability})
+		}
+	}
+
+	if s.cfg.logger == nil {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("protocol", s.result.Protocol.String()),
+		slog.String("remote_addr", s.remoteAddr),
+		slog.String("step", s.step),
+		slog.Duration("duration", s.cfg.clock.Now().Sub(s.stepStart)),
+	}
+
+	if command != "" {
+		attrs = append(attrs, slog.String("command", sanitizeResponse(command)))
+	}
+
+	if code := replyCode(s.response); code != "" {
+		attrs = append(attrs, slog.String("reply_code", code))
+	}
+
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+
+	s.cfg.logger.LogAttrs(ctx, slog.LevelDebug, "starttls step", attrs...)
+}
+
+// emit sends an event to NegotiateAsync.
+func (s *session) emit(event Event) {
+	if s.cfg.events != nil {
+		event.Protocol = s.result.Protocol
+		s.cfg.events(event)
+	}
+}
+
+// replyCode returns the status of a server reply: the numeric code of SMTP,
+// LMTP and FTP, +OK or -ERR for POP3, or OK, NO or BAD for IMAP. It
+// returns "" for replies without one.
+func replyCode(response string) string {
+	fields := strings.Fields(response)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	if code := fields[0]; len(code) >= 3 && strings.Trim(code[:3], "0123456789") == "" && (len(code) == 3 || code[3] == '-') {
+		return code[:3]
+	}
+
+	if fields[0] == "+OK" || fields[0] == "-ERR" {
+		return fields[0]
+	}
+
+	if len(fields) > 1 {
+		switch status := strings.ToUpper(fields[1]); status {
+		case "OK", "NO", "BAD":
+			return status
+		}
+	}
+
+	return ""
+}
+
+// sessionFromContext returns the session stored in ctx, or a detached one
+// when the handshake is driven directly rather than through Negotiate.
+func sessionFromContext(ctx context.Context) *session {
+	s, ok := ctx.Value(sessionKey{}).(*session)
+	if !ok {
+		return &session{cfg: newConfig(nil), result: &StartTLSResult{}}
+	}
+
+	return s
+}
@@ -0,0 +1,134 @@
+package starttls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnhancedStatusCode is an RFC 3463 enhanced mail system status code, such
+// as 4.7.0, sent after the reply code by servers that advertise
+// ENHANCEDSTATUSCODES (RFC 2034).
+type EnhancedStatusCode struct {
+	// Class is 2 (success), 4 (persistent transient failure) or 5
+	// (permanent failure).
+	Class int
+	// Subject is the category, e.g. 7 for security or policy status.
+	Subject int
+	// Detail is the specific condition within the subject.
+	Detail int
+}
+
+// IsZero reports whether the reply carried no enhanced status code.
+func (c EnhancedStatusCode) IsZero() bool {
+	return c == EnhancedStatusCode{}
+}
+
+// String returns the code in class.subject.detail form, or an empty string
+// for the zero value.
+func (c EnhancedStatusCode) String() string {
+	if c.IsZero() {
+		return ""
+	}
+
+	return fmt.Sprintf("%d.%d.%d", c.Class, c.Subject, c.Detail)
+}
+
+// parseEnhancedStatusCode splits a leading enhanced status code off the text
+// of a reply line. The class must match the first digit of the reply code,
+// as RFC 3463 requires; otherwise the text is returned unchanged.
+func parseEnhancedStatusCode(replyCode, text string) (EnhancedStatusCode, string) {
+	field, rest, _ := strings.Cut(text, " ")
+
+	parts := strings.Split(field, ".")
+	if len(parts) != 3 || replyCode == "" || parts[0] != replyCode[:1] {
+		return EnhancedStatusCode{}, text
+	}
+
+	var code EnhancedStatusCode
+
+	for i, dst := range []*int{&code.Class, &code.Subject, &code.Detail} {
+		if len(parts[i]) == 0 || len(parts[i]) > 3 {
+			return EnhancedStatusCode{}, text
+		}
+
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 {
+			return EnhancedStatusCode{}, text
+		}
+
+		*dst = n
+	}
+
+	switch code.Class {
+	case 2, 4, 5:
+		return code, strings.TrimSpace(rest)
+	default:
+		return EnhancedStatusCode{}, text
+	}
+}
+
+// SMTPError is returned when an SMTP or LMTP server answers with an
+// unexpected reply code. A rejected STARTTLS, for example "454 4.7.0 TLS not
+// available due to temporary reason", matches ErrStartTLSNotSupported; a
+// refused greeting, EHLO or RSET matches ErrInvalidResponse. Use errors.As
+// to branch on the codes instead of matching the error text.
+type SMTPError struct {
+	// Code is the three-digit reply code, e.g. 454.
+	Code int
+	// EnhancedCode is the RFC 3463 status code, or the zero value when the
+	// reply did not carry one.
+	EnhancedCode EnhancedStatusCode
+	// Message is the reply text without the codes, sanitized. The lines of
+	// a multiline reply are joined with spaces.
+	Message string
+
+	protocol ProtocolID
+	err      error
+}
+
+// newSMTPError builds an SMTPError from a reply of protocol, stripping the
+// enhanced status code from each line. err is the sentinel the error
+// matches.
+func newSMTPError(protocol ProtocolID, reply *codeReply, err error) *SMTPError {
+	smtpErr := &SMTPError{protocol: protocol, err: err}
+	smtpErr.Code, _ = strconv.Atoi(reply.code)
+
+	lines := make([]string, 0, len(reply.lines))
+
+	for i, line := range reply.lines {
+		code, text := parseEnhancedStatusCode(reply.code, line)
+		if i == 0 {
+			smtpErr.EnhancedCode = code
+		}
+
+		lines = append(lines, text)
+	}
+
+	smtpErr.Message = sanitizeResponse(strings.Join(lines, " "))
+
+	return smtpErr
+}
+
+func (e *SMTPError) Error() string {
+	if !e.EnhancedCode.IsZero() {
+		return fmt.Sprintf("%s: %d %s %s", e.err, e.Code, e.EnhancedCode, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %d %s", e.err, e.Code, e.Message)
+}
+
+func (e *SMTPError) Unwrap() error {
+	return e.err
+}
+
+// Protocol returns ProtocolSMTP or ProtocolLMTP.
+func (e *SMTPError) Protocol() ProtocolID {
+	return e.protocol
+}
+
+// Temporary reports whether the reply was a 4yz transient negative
+// completion, after which the command may succeed if retried.
+func (e *SMTPError) Temporary() bool {
+	return e.Code/100 == 4
+}
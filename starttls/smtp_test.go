@@ -0,0 +1,185 @@
+package starttls
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseEnhancedStatusCode(t *testing.T) {
+	tests := []struct {
+		name         string
+		replyCode    string
+		text         string
+		expectedCode EnhancedStatusCode
+		expectedText string
+	}{
+		{
+			name:         "temporary failure",
+			replyCode:    "454",
+			text:         "4.7.0 TLS not available due to temporary reason",
+			expectedCode: EnhancedStatusCode{Class: 4, Subject: 7, Detail: 0},
+			expectedText: "TLS not available due to temporary reason",
+		},
+		{
+			name:         "multi-digit fields",
+			replyCode:    "550",
+			text:         "5.7.26 Unauthenticated email is not accepted",
+			expectedCode: EnhancedStatusCode{Class: 5, Subject: 7, Detail: 26},
+			expectedText: "Unauthenticated email is not accepted",
+		},
+		{
+			name:         "no enhanced code",
+			replyCode:    "454",
+			text:         "TLS not available",
+			expectedText: "TLS not available",
+		},
+		{
+			name:         "class does not match reply code",
+			replyCode:    "454",
+			text:         "5.7.0 TLS not available",
+			expectedText: "5.7.0 TLS not available",
+		},
+		{
+			name:         "success class",
+			replyCode:    "220",
+			text:         "2.6.1 ready",
+			expectedCode: EnhancedStatusCode{Class: 2, Subject: 6, Detail: 1},
+			expectedText: "ready",
+		},
+		{
+			name:         "field too long",
+			replyCode:    "554",
+			text:         "5.7.1000 rejected",
+			expectedText: "5.7.1000 rejected",
+		},
+		{
+			name:         "not numeric",
+			replyCode:    "554",
+			text:         "5.x.1 rejected",
+			expectedText: "5.x.1 rejected",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, text := parseEnhancedStatusCode(tt.replyCode, tt.text)
+
+			if code != tt.expectedCode {
+				t.Errorf("Expected code %v, got %v", tt.expectedCode, code)
+			}
+
+			if text != tt.expectedText {
+				t.Errorf("Expected text %q, got %q", tt.expectedText, text)
+			}
+		})
+	}
+}
+
+func TestSMTPStartTLSRejected(t *testing.T) {
+	tests := []struct {
+		name                 string
+		reply                string
+		expectedCode         int
+		expectedEnhancedCode string
+		expectedMessage      string
+	}{
+		{
+			name:                 "enhanced code",
+			reply:                "454 4.7.0 TLS not available due to temporary reason\r\n",
+			expectedCode:         454,
+			expectedEnhancedCode: "4.7.0",
+			expectedMessage:      "TLS not available due to temporary reason",
+		},
+		{
+			name:            "plain reply",
+			reply:           "502 Command not implemented\r\n",
+			expectedCode:    502,
+			expectedMessage: "Command not implemented",
+		},
+		{
+			name:                 "multiline reply",
+			reply:                "554-5.7.1 TLS is disabled\r\n554 5.7.1 for this listener\r\n",
+			expectedCode:         554,
+			expectedEnhancedCode: "5.7.1",
+			expectedMessage:      "TLS is disabled for this listener",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, "25", []string{
+				serverMessagesStart,
+				serverMessagesSMTP,
+				tt.reply,
+			})
+
+			if !errors.Is(err, ErrStartTLSNotSupported) {
+				t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+			}
+
+			var smtpErr *SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("Expected *SMTPError, got %T: %v", err, err)
+			}
+
+			if smtpErr.Code != tt.expectedCode {
+				t.Errorf("Expected code %d, got %d", tt.expectedCode, smtpErr.Code)
+			}
+
+			if smtpErr.EnhancedCode.String() != tt.expectedEnhancedCode {
+				t.Errorf("Expected enhanced code %q, got %q", tt.expectedEnhancedCode, smtpErr.EnhancedCode)
+			}
+
+			if smtpErr.Message != tt.expectedMessage {
+				t.Errorf("Expected message %q, got %q", tt.expectedMessage, smtpErr.Message)
+			}
+		})
+	}
+}
+
+func TestSMTPErrorReplies(t *testing.T) {
+	tests := []struct {
+		name          string
+		messages      []string
+		expectedCode  int
+		expectedError error
+	}{
+		{
+			name:          "greeting refused",
+			messages:      []string{"554 5.7.1 No SMTP service here\r\n"},
+			expectedCode:  554,
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "ehlo refused",
+			messages:      []string{serverMessagesStart, "500 5.5.1 Command unrecognized\r\n"},
+			expectedCode:  500,
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "starttls refused",
+			messages:      []string{serverMessagesStart, serverMessagesSMTP, serverMessagesNotSupported},
+			expectedCode:  500,
+			expectedError: ErrStartTLSNotSupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, "25", tt.messages)
+
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+			}
+
+			var smtpErr *SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("Expected *SMTPError, got %T: %v", err, err)
+			}
+
+			if smtpErr.Code != tt.expectedCode {
+				t.Errorf("Expected code %d, got %d", tt.expectedCode, smtpErr.Code)
+			}
+		})
+	}
+}
@@ -2,20 +2,59 @@ package starttls
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"maps"
 	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// maxResponseText bounds how much server-controlled text is embedded in
+// errors and findings.
+const maxResponseText = 256
+
 // Protocol specific errors.
 var (
 	ErrStartTLSNotSupported = errors.New("STARTTLS not supported by server")
 	ErrInvalidResponse      = errors.New("invalid server response")
+	// ErrIMAPPreauth is returned when an IMAP server greets with PREAUTH.
+	// The session is already authenticated and RFC 3501 forbids STARTTLS
+	// in that state. It is reported together with ErrStartTLSNotSupported.
+	ErrIMAPPreauth = errors.New("IMAP server sent PREAUTH greeting")
+	// ErrIMAPLoginAccepted is returned when an IMAP server accepts the
+	// placeholder credentials of WithIMAPLoginAudit. The session is then
+	// authenticated, where RFC 3501 forbids STARTTLS, so it is ended with
+	// LOGOUT and the upgrade is not attempted. It is reported together with
+	// ErrStartTLSNotSupported.
+	ErrIMAPLoginAccepted = errors.New("IMAP server accepted LOGIN before STARTTLS")
+	// ErrStartTLSNotAdvertised is returned when an SMTP, LMTP, IMAP or POP3
+	// server does not list STARTTLS (STLS for POP3) in its capabilities, as
+	// opposed to advertising it and then rejecting the command. The
+	// advertised capabilities are available in the result details. It is
+	// reported together with ErrStartTLSNotSupported.
+	ErrStartTLSNotAdvertised = errors.New("STARTTLS not advertised by server")
+	// ErrFTPNotLoggedIn is returned when an FTP server answers AUTH TLS with
+	// 530, typically because it only accepts commands after USER and PASS or
+	// has TLS disabled entirely. It is reported together with
+	// ErrStartTLSNotSupported.
+	ErrFTPNotLoggedIn = errors.New("FTP server requires login before AUTH TLS")
+	// ErrFTPPolicyDenied is returned when an FTP server answers AUTH TLS with
+	// 534, refusing TLS for policy reasons (RFC 4217 section 4), for example
+	// for the client's address. It is reported together with
+	// ErrStartTLSNotSupported.
+	ErrFTPPolicyDenied = errors.New("FTP server denied AUTH TLS by policy")
+	// ErrUnknownProtocol is returned by Protocol for a name that is not a
+	// built-in protocol.
+	ErrUnknownProtocol = errors.New("unknown protocol")
 )
 
 // StartTLSProtocol defines the interface for protocol-specific STARTTLS implementations.
@@ -26,393 +65,2041 @@ type StartTLSProtocol interface {
 	Name() string
 }
 
-// baseProtocol implements common functionality for all STARTTLS protocols.
-type baseProtocol struct {
-	name     string
-	greetMsg *regexp.Regexp
-	authMsg  string
-	respMsg  *regexp.Regexp
-}
-
-func newBaseProtocol(name, greetPattern, auth, respPattern string) baseProtocol {
-	return baseProtocol{
-		name:     name,
-		greetMsg: regexp.MustCompile(greetPattern),
-		authMsg:  auth,
-		respMsg:  regexp.MustCompile(respPattern),
-	}
-}
+// smtpReadyCode is the reply code of both the SMTP greeting and an accepted
+// STARTTLS (RFC 3207 section 4).
+const smtpReadyCode = "220"
 
 // SMTP protocol implementation.
 type smtpProtocol struct {
-	baseProtocol
+	BaseProtocol
+	// helloCmd is EHLO for SMTP and LHLO for LMTP.
+	helloCmd string
+}
+
+// NewSMTPProtocol returns the SMTP protocol registered for ports 25, 26, 587
+// and 2525, for use with StartTLSWithProtocol or to wrap in another
+// StartTLSProtocol. Like every protocol value, it keeps per-connection state.
+func NewSMTPProtocol() StartTLSProtocol {
+	return newSMTPProtocol()
 }
 
 func newSMTPProtocol() *smtpProtocol {
 	return &smtpProtocol{
-		baseProtocol: newBaseProtocol("smtp", "^220 ", "STARTTLS\r\n", "^220 "),
+		BaseProtocol: NewBaseProtocol(ProtocolSMTP, "STARTTLS\r\n"),
+		helloCmd:     "EHLO",
 	}
 }
 
-func (p *smtpProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
-	err := expectGreeting(ctx, rw, p.greetMsg)
-	if err != nil {
-		return fmt.Errorf("smtp: greeting failed: %w", err)
+// newLMTPProtocol returns the LMTP (RFC 2033) variant of SMTP, which greets
+// with LHLO instead of EHLO.
+func newLMTPProtocol() *smtpProtocol {
+	return &smtpProtocol{
+		BaseProtocol: NewBaseProtocol(ProtocolLMTP, "STARTTLS\r\n"),
+		helloCmd:     "LHLO",
 	}
+}
+
+func (p *smtpProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	result := sessionFromContext(ctx).result
+	start := now(ctx)
+
+	// The greeting may span several "220-" lines and must be read in full
+	// before EHLO is sent.
+	stepCtx, cancel := stepContext(ctx, StepGreeting)
+	greeting, err := readCodeGreeting(stepCtx, rw, readSMTPReply, smtpReadyCode)
+	cancel()
 
-	err = p.sendEHLO(ctx, rw)
 	if err != nil {
-		return fmt.Errorf("smtp: EHLO failed: %w", err)
+		return fmt.Errorf("%s: greeting failed: %w", p.name, err)
 	}
 
-	err = sendStartTLS(ctx, rw, p.authMsg, p.respMsg)
-	if err != nil {
-		return fmt.Errorf("smtp: STARTTLS failed: %w", err)
+	result.Banner = strings.Join(greeting.raw, "\n")
+	result.addTiming(StepGreeting, start, now(ctx))
+
+	if greeting.code != smtpReadyCode {
+		return fmt.Errorf("%s: greeting failed: %w", p.name, newSMTPError(ProtocolID(p.name), greeting, ErrInvalidResponse))
 	}
 
-	return nil
-}
+	start = now(ctx)
 
-func (p *smtpProtocol) Name() string {
-	return p.name
-}
+	stepCtx, cancel = stepContext(ctx, StepCapabilities)
+	caps, err := p.sendEHLO(stepCtx, rw)
+	cancel()
 
-func (p *smtpProtocol) sendEHLO(ctx context.Context, rw *bufio.ReadWriter) error {
-	_, err := rw.WriteString("EHLO tlstools.com\r\n")
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %s failed: %w", p.name, p.helloCmd, err)
 	}
 
-	err = rw.Flush()
-	if err != nil {
-		return err
+	result.addTiming(StepCapabilities, start, now(ctx))
+
+	cfg := sessionFromContext(ctx).cfg
+
+	command := p.authMsg
+	anonymous := cfg.smtpAnonymousTLS && caps.AnonymousTLS
+
+	if anonymous {
+		command = "X-ANONYMOUSTLS\r\n"
 	}
 
-	for {
-		line, err := readLine(ctx, rw.Reader)
+	advertised := anonymous || caps.Has("STARTTLS")
+
+	// The audit commands can share a group with the upgrade command, which
+	// must end it (RFC 2920 section 3.1), once the server has advertised
+	// PIPELINING and the upgrade is going to be sent.
+	pipelined := cfg.smtpPipelining && cfg.smtpMailAudit && advertised && caps.Has("PIPELINING") && !stopBeforeUpgrade(ctx)
+
+	if cfg.smtpMailAudit && !pipelined {
+		err = p.auditPlaintextMail(ctx, rw)
 		if err != nil {
-			return err
+			return fmt.Errorf("%s: MAIL FROM audit failed: %w", p.name, err)
 		}
+	}
 
-		if !strings.HasPrefix(line, "250") {
-			return fmt.Errorf("%w: unexpected EHLO response: %s", ErrInvalidResponse, line)
-		}
+	if !advertised {
+		return fmt.Errorf("%s: %w: %w: extensions: %s", p.name, ErrStartTLSNotAdvertised, ErrStartTLSNotSupported,
+			sanitizeResponse(strings.Join(caps.Extensions, ", ")))
+	}
 
-		if rw.Reader.Buffered() == 0 {
-			break
+	if stopBeforeUpgrade(ctx) {
+		return errProbeStopped
+	}
+
+	result.UpgradeCommand = strings.TrimSpace(command)
+	start = now(ctx)
+
+	stepCtx, cancel = stepContext(ctx, StepUpgrade)
+
+	if pipelined {
+		err = p.pipelinedAuditUpgrade(stepCtx, rw, command)
+	} else if match := cfg.responseMatcher; match != nil {
+		err = sendStartTLS(stepCtx, rw, command, match)
+	} else {
+		var reply *codeReply
+
+		reply, err = p.command(stepCtx, rw, command)
+		if err == nil {
+			err = p.checkStartTLSReply(stepCtx, reply)
 		}
 	}
 
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("%s: %s failed: %w", p.name, strings.TrimSpace(command), err)
+	}
+
+	result.addTiming(StepUpgrade, start, now(ctx))
+
 	return nil
 }
 
-// IMAP protocol implementation.
-type imapProtocol struct {
-	baseProtocol
+// checkStartTLSReply returns an *SMTPError when the server rejected STARTTLS.
+// With WithStrictMatching, only a negative reply is a rejection and any other
+// reply but 220 is invalid.
+func (p *smtpProtocol) checkStartTLSReply(ctx context.Context, reply *codeReply) error {
+	switch {
+	case reply.code == smtpReadyCode:
+		return nil
+	case sessionFromContext(ctx).cfg.strictMatching && !reply.negative():
+		return newSMTPError(ProtocolID(p.name), reply, ErrInvalidResponse)
+	default:
+		return newSMTPError(ProtocolID(p.name), reply, ErrStartTLSNotSupported)
+	}
 }
 
-func newIMAPProtocol() *imapProtocol {
-	return &imapProtocol{
-		baseProtocol: newBaseProtocol("imap", "^\\* ", "a001 STARTTLS\r\n", "^a001 OK "),
-	}
+// codeReply is a complete, possibly multiline, reply of a protocol with
+// three-digit reply codes, such as SMTP or FTP.
+type codeReply struct {
+	code string
+	// lines holds the text of each line without the reply code.
+	lines []string
+	// raw holds the lines as received, without line terminators.
+	raw []string
 }
 
-func (p *imapProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
-	err := expectGreeting(ctx, rw, p.greetMsg)
-	if err != nil {
-		return fmt.Errorf("imap: greeting failed: %w", err)
+// String returns the reply text, sanitized for use in errors.
+func (r *codeReply) String() string {
+	return sanitizeResponse(r.code + " " + strings.Join(r.lines, " "))
+}
+
+// readCodeGreeting reads a greeting with readReply or, with
+// WithGreetingMatcher, up to the line the matcher accepts, which is taken as
+// a reply with the ready code.
+func readCodeGreeting(ctx context.Context, rw *bufio.ReadWriter,
+	readReply func(context.Context, *bufio.Reader) (*codeReply, error), code string,
+) (*codeReply, error) {
+	match := sessionFromContext(ctx).cfg.greetingMatcher
+	if match == nil {
+		return readReply(ctx, rw.Reader)
 	}
 
-	err = sendStartTLS(ctx, rw, p.authMsg, p.respMsg)
+	line, err := expectGreeting(ctx, rw, match)
 	if err != nil {
-		return fmt.Errorf("imap: STARTTLS failed: %w", err)
+		return nil, err
 	}
 
-	return nil
+	text, _ := strings.CutPrefix(line, code)
+
+	return &codeReply{code: code, lines: []string{strings.TrimSpace(strings.TrimPrefix(text, "-"))}, raw: []string{line}}, nil
 }
 
-func (p *imapProtocol) Name() string {
-	return p.name
+// negative reports whether the reply is a transient or permanent negative
+// completion, 4yz or 5yz, the replies that refuse a command.
+func (r *codeReply) negative() bool {
+	return r.code[0] == '4' || r.code[0] == '5'
 }
 
-// POP3 protocol implementation.
-type pop3Protocol struct {
-	baseProtocol
+// checkReplyCode returns ErrInvalidResponse with WithStrictMatching when line
+// does not start with a reply code, three digits from 100 to 559 followed by
+// a space, a hyphen or the end of the line (RFC 5321 section 4.2, RFC 959
+// section 4.2).
+func checkReplyCode(ctx context.Context, line string) error {
+	if !sessionFromContext(ctx).cfg.strictMatching {
+		return nil
+	}
+
+	text := strings.TrimRight(line, "\r\n")
+
+	valid := len(text) >= 3 &&
+		text[0] >= '1' && text[0] <= '5' &&
+		text[1] >= '0' && text[1] <= '5' &&
+		text[2] >= '0' && text[2] <= '9' &&
+		(len(text) == 3 || text[3] == ' ' || text[3] == '-')
+	if !valid {
+		return fmt.Errorf("%w: malformed reply code: %s", ErrInvalidResponse, sanitizeResponse(line))
+	}
+
+	return nil
 }
 
-func newPOP3Protocol() *pop3Protocol {
-	return &pop3Protocol{
-		baseProtocol: newBaseProtocol("pop3", "^\\+OK ", "STLS\r\n", "^\\+OK "),
+// readSMTPReply reads a reply up to its last line. Every line but the last
+// has a hyphen after the reply code (RFC 5321 section 4.2.1), so the end of
+// the reply does not depend on how it was split into TCP segments.
+func readSMTPReply(ctx context.Context, r *bufio.Reader) (*codeReply, error) {
+	reply := &codeReply{}
+
+	for {
+		line, err := readLine(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) < 3 || reply.code != "" && line[:3] != reply.code {
+			return nil, fmt.Errorf("%w: malformed reply line: %s", ErrInvalidResponse, sanitizeResponse(line))
+		}
+
+		err = checkReplyCode(ctx, line)
+		if err != nil {
+			return nil, err
+		}
+
+		reply.code = line[:3]
+		reply.lines = append(reply.lines, strings.TrimSpace(line[min(len(line), 4):]))
+		reply.raw = append(reply.raw, strings.TrimRight(line, "\r\n"))
+
+		if len(line) < 4 || line[3] != '-' {
+			sessionFromContext(ctx).response = strings.Join(reply.raw, "\n")
+
+			return reply, nil
+		}
 	}
 }
 
-func (p *pop3Protocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
-	err := expectGreeting(ctx, rw, p.greetMsg)
+func (p *smtpProtocol) noopCommand() string {
+	return "NOOP\r\n"
+}
+
+func (p *smtpProtocol) quitCommand() string {
+	return "QUIT\r\n"
+}
+
+func (p *smtpProtocol) requestPostTLSCapabilities(ctx context.Context, rw *bufio.ReadWriter) error {
+	_, err := p.sendEHLO(ctx, rw)
+
+	return err
+}
+
+func (p *smtpProtocol) helloCommand() string {
+	return p.helloCmd + " tlstools.com\r\n"
+}
+
+func (p *smtpProtocol) sendEHLO(ctx context.Context, rw *bufio.ReadWriter) (*SMTPCapabilities, error) {
+	_, err := rw.WriteString(p.helloCommand())
 	if err != nil {
-		return fmt.Errorf("pop3: greeting failed: %w", err)
+		return nil, err
 	}
 
-	err = sendStartTLS(ctx, rw, p.authMsg, p.respMsg)
+	err = rw.Flush()
 	if err != nil {
-		return fmt.Errorf("pop3: STARTTLS failed: %w", err)
+		return nil, err
 	}
 
-	return nil
-}
-
-func (p *pop3Protocol) Name() string {
-	return p.name
+	return p.readEHLO(ctx, rw)
 }
 
-// FTP protocol implementation.
-type ftpProtocol struct {
-	baseProtocol
-}
+// readEHLO reads the EHLO reply and records the advertised extensions.
+func (p *smtpProtocol) readEHLO(ctx context.Context, rw *bufio.ReadWriter) (*SMTPCapabilities, error) {
+	reply, err := readSMTPReply(ctx, rw.Reader)
+	if err != nil {
+		return nil, err
+	}
 
-func newFTPProtocol() *ftpProtocol {
-	return &ftpProtocol{
-		baseProtocol: newBaseProtocol("ftp", "^220 ", "AUTH TLS\r\n", "^234 "),
+	if reply.code != "250" {
+		return nil, newSMTPError(ProtocolID(p.name), reply, ErrInvalidResponse)
 	}
+
+	// The first line of the reply carries the server domain, the rest
+	// are extension keywords.
+	caps := &SMTPCapabilities{Extensions: reply.lines[1:]}
+	caps.Domain, _, _ = strings.Cut(reply.lines[0], " ")
+
+	caps.RequireTLS = caps.Has("REQUIRETLS")
+	caps.AnonymousTLS = caps.Has("X-ANONYMOUSTLS")
+
+	result := sessionFromContext(ctx).result
+	result.Capabilities = caps.Extensions
+	result.Details = caps
+
+	return caps, nil
 }
 
-func (p *ftpProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
-	err := expectGreeting(ctx, rw, p.greetMsg)
+// auditPlaintextMail sends MAIL FROM with the null reverse-path before
+// STARTTLS and records whether the server refuses it with 530 (RFC 3207
+// section 4). An accepted transaction is aborted with RSET so that STARTTLS
+// is not issued in the middle of it.
+func (p *smtpProtocol) auditPlaintextMail(ctx context.Context, rw *bufio.ReadWriter) error {
+	reply, err := p.command(ctx, rw, "MAIL FROM:<>\r\n")
 	if err != nil {
-		return fmt.Errorf("ftp: greeting failed: %w", err)
+		return err
 	}
 
-	err = sendStartTLS(ctx, rw, p.authMsg, p.respMsg)
+	if !p.recordMailAudit(ctx, reply) {
+		return nil
+	}
+
+	reply, err = p.command(ctx, rw, "RSET\r\n")
 	if err != nil {
-		return fmt.Errorf("ftp: AUTH TLS failed: %w", err)
+		return err
+	}
+
+	if reply.code != "250" {
+		return fmt.Errorf("RSET failed: %w", newSMTPError(ProtocolID(p.name), reply, ErrInvalidResponse))
 	}
 
 	return nil
 }
 
-func (p *ftpProtocol) Name() string {
-	return p.name
-}
+// recordMailAudit records the finding for the reply to MAIL FROM:<> and
+// reports whether the server accepted it.
+func (p *smtpProtocol) recordMailAudit(ctx context.Context, reply *codeReply) bool {
+	result := sessionFromContext(ctx).result
 
-// MySQL protocol implementation.
-type mysqlProtocol struct {
-	name string
-}
+	switch reply.code {
+	case "530":
+		result.addFinding(FindingMailRequiresTLS, SeverityInfo,
+			"server refuses MAIL FROM before STARTTLS: "+reply.String())
+	case "250":
+		result.addFinding(FindingPlaintextMailAccepted, SeverityMedium,
+			"server accepts MAIL FROM without TLS, so mail can be submitted in plaintext")
 
-func newMySQLProtocol() *mysqlProtocol {
-	return &mysqlProtocol{
-		name: "mysql",
+		return true
 	}
+
+	return false
 }
 
-// MySQL protocol constants.
-const (
-	clientSSL            = 0x800
-	clientProtocol41     = 0x00000200
-	clientSecureConn     = 0x00008000
-	mysqlProtocolVersion = 10
-	maxMySQLPacketSize   = 16777215
-	utf8GeneralCI        = 33
-)
+// pipelinedAuditUpgrade sends the MAIL FROM audit, RSET and the upgrade
+// command as one group (RFC 2920), saving the round trips of the audit, and
+// then reads the three replies. RSET is sent whatever the reply to MAIL
+// FROM; its reply only matters when MAIL FROM was accepted.
+func (p *smtpProtocol) pipelinedAuditUpgrade(ctx context.Context, rw *bufio.ReadWriter, command string) error {
+	_, err := rw.WriteString("MAIL FROM:<>\r\nRSET\r\n" + command)
+	if err == nil {
+		err = rw.Flush()
+	}
 
-func (p *mysqlProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
-	// Read and parse handshake packet
-	body, err := p.readMySQLPacket(rw)
 	if err != nil {
 		return err
 	}
 
-	capabilities, err := p.parseHandshakePacket(body)
+	mail, err := readSMTPReply(ctx, rw.Reader)
 	if err != nil {
-		return err
+		return fmt.Errorf("MAIL FROM audit failed: %w", err)
 	}
 
-	// Check if server supports SSL
-	if capabilities&clientSSL == 0 {
-		return fmt.Errorf("%w: MySQL server does not support SSL", ErrStartTLSNotSupported)
+	reset, err := readSMTPReply(ctx, rw.Reader)
+	if err != nil {
+		return fmt.Errorf("RSET failed: %w", err)
 	}
 
-	// Send SSL request
-	sslRequest := p.createSSLRequestPacket()
+	if p.recordMailAudit(ctx, mail) && reset.code != "250" {
+		return fmt.Errorf("RSET failed: %w", newSMTPError(ProtocolID(p.name), reset, ErrInvalidResponse))
+	}
 
-	_, err = rw.Write(sslRequest)
+	if match := sessionFromContext(ctx).cfg.responseMatcher; match != nil {
+		return expectStartTLSResponse(ctx, rw, match)
+	}
+
+	reply, err := readSMTPReply(ctx, rw.Reader)
 	if err != nil {
-		return fmt.Errorf("mysql: failed to write SSL request: %w", err)
+		return err
+	}
+
+	return p.checkStartTLSReply(ctx, reply)
+}
+
+// command sends a single SMTP command and reads its reply.
+func (p *smtpProtocol) command(ctx context.Context, rw *bufio.ReadWriter, command string) (*codeReply, error) {
+	_, err := rw.WriteString(command)
+	if err != nil {
+		return nil, err
 	}
 
 	err = rw.Flush()
 	if err != nil {
-		return fmt.Errorf("mysql: failed to flush SSL request: %w", err)
+		return nil, err
 	}
 
-	return nil
+	return readSMTPReply(ctx, rw.Reader)
 }
 
-func (p *mysqlProtocol) Name() string {
-	return p.name
+// IMAP protocol implementation.
+type imapProtocol struct {
+	BaseProtocol
+	tagPrefix string
+	tagCount  int
 }
 
-// readMySQLPacket reads a MySQL packet and returns its body.
-func (p *mysqlProtocol) readMySQLPacket(rw *bufio.ReadWriter) ([]byte, error) {
-	header := make([]byte, 4)
+// defaultIMAPTagPrefix prefixes the command tags, which are numbered from
+// 001 within each handshake.
+const defaultIMAPTagPrefix = "a"
+
+// NewIMAPProtocol returns the IMAP protocol registered for port 143. See
+// NewSMTPProtocol.
+func NewIMAPProtocol() StartTLSProtocol {
+	return newIMAPProtocol()
+}
+
+func newIMAPProtocol() *imapProtocol {
+	return &imapProtocol{
+		BaseProtocol: NewBaseProtocol(ProtocolIMAP, "STARTTLS"),
+		tagPrefix:    defaultIMAPTagPrefix,
+	}
+}
 
-	_, err := io.ReadFull(rw.Reader, header)
+func (p *imapProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	err := p.applyTagPrefix(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: failed to read packet header: %w", err)
+		return err
 	}
 
-	// Get packet length (3 bytes, little-endian)
-	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	result := sessionFromContext(ctx).result
+	defer func() { result.imapTags = p.tagCount }()
 
-	body := make([]byte, length)
+	start := now(ctx)
+
+	stepCtx, cancel := stepContext(ctx, StepGreeting)
+
+	// A greeting accepted by the matcher counts as OK.
+	status, greeting := "OK", ""
+
+	if match := sessionFromContext(ctx).cfg.greetingMatcher; match != nil {
+		greeting, err = expectGreeting(stepCtx, rw, match)
+	} else {
+		status, greeting, err = readIMAPGreeting(stepCtx, rw.Reader)
+	}
+
+	cancel()
 
-	_, err = io.ReadFull(rw.Reader, body)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: failed to read packet body: %w", err)
+		return fmt.Errorf("imap: greeting failed: %w", err)
 	}
 
-	return body, nil
-}
+	result.Banner = strings.TrimRight(greeting, "\r\n")
+	result.addTiming(StepGreeting, start, now(ctx))
 
-// parseHandshakePacket parses the initial handshake packet and returns server capabilities.
-func (p *mysqlProtocol) parseHandshakePacket(body []byte) (uint32, error) {
-	if len(body) == 0 || body[0] != mysqlProtocolVersion {
-		return 0, fmt.Errorf("mysql: unsupported protocol version: %d", body[0])
+	switch status {
+	case "PREAUTH":
+		return fmt.Errorf("imap: %w: %w", ErrIMAPPreauth, ErrStartTLSNotSupported)
+	case "BYE":
+		return fmt.Errorf("imap: server refused the connection: %w", newIMAPError(greeting, ErrInvalidResponse))
 	}
 
-	// Skip server version string and other fields
-	pos := 1
-	// Skip to end of server version (null-terminated)
-	for pos < len(body) && body[pos] != 0 {
-		pos++
+	caps := &IMAPCapabilities{Capabilities: parseIMAPGreetingCapabilities(greeting)}
+	if caps.Capabilities == nil {
+		start = now(ctx)
+
+		stepCtx, cancel = stepContext(ctx, StepCapabilities)
+		caps.Capabilities, err = p.requestCapabilities(stepCtx, rw)
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("imap: CAPABILITY failed: %w", err)
+		}
+
+		result.addTiming(StepCapabilities, start, now(ctx))
 	}
 
-	pos++ // skip null terminator
+	result.Capabilities = caps.Capabilities
+	result.Details = caps
 
-	// Skip thread ID and auth data
-	pos += 4 // thread ID
-	pos += 8 // auth plugin data part 1
+	if sessionFromContext(ctx).cfg.imapLoginAudit {
+		err = p.auditPlaintextLogin(ctx, rw)
+		if errors.Is(err, ErrIMAPLoginAccepted) {
+			return fmt.Errorf("imap: %w", err)
+		}
 
-	for pos < len(body) && body[pos] != 0 {
-		pos++
+		if err != nil {
+			return fmt.Errorf("imap: LOGIN audit failed: %w", err)
+		}
 	}
 
-	pos++ // null terminator
-	pos++ // filler
+	if !caps.Has("STARTTLS") {
+		return fmt.Errorf("imap: %w: %w: capabilities: %s", ErrStartTLSNotAdvertised, ErrStartTLSNotSupported,
+			sanitizeResponse(strings.Join(caps.Capabilities, " ")))
+	}
 
-	// Read capability flags
-	if pos+2 > len(body) {
-		return 0, fmt.Errorf("mysql: packet too short for capability flags")
+	if stopBeforeUpgrade(ctx) {
+		return errProbeStopped
 	}
 
-	return uint32(body[pos]) | uint32(body[pos+1])<<8, nil
-}
+	result.UpgradeCommand = p.authMsg
+	start = now(ctx)
 
-// createSSLRequestPacket creates the SSL request packet.
-func (p *mysqlProtocol) createSSLRequestPacket() []byte {
-	clientFlags := uint32(clientSSL | clientProtocol41 | clientSecureConn)
-	packet := make([]byte, 4+32) // Header + SSL request packet
+	stepCtx, cancel = stepContext(ctx, StepUpgrade)
+	resp, err := p.command(stepCtx, rw, p.authMsg)
+	cancel()
 
-	// Packet header
-	packet[0] = 32 // payload length
-	packet[3] = 1  // sequence number
+	if err != nil {
+		return fmt.Errorf("imap: STARTTLS failed: %w", err)
+	}
 
-	// Client flags (4 bytes)
-	binary.LittleEndian.PutUint32(packet[4:8], clientFlags)
+	match := sessionFromContext(ctx).cfg.responseMatcher
 
-	// Max packet size (4 bytes)
-	maxSize := uint32(maxMySQLPacketSize)
-	binary.LittleEndian.PutUint32(packet[8:12], maxSize)
+	switch {
+	case match != nil && match(resp.line):
+		result.addTiming(StepUpgrade, start, now(ctx))
 
-	// Character set
-	packet[12] = utf8GeneralCI
+		return nil
+	case match != nil:
+		return fmt.Errorf("%w: imap: %s", ErrStartTLSNotSupported, sanitizeResponse(resp.line))
+	case resp.status == "OK":
+		result.addTiming(StepUpgrade, start, now(ctx))
 
-	return packet
+		return nil
+	case resp.status == "NO" || resp.status == "BAD":
+		return newIMAPError(resp.line, ErrStartTLSNotSupported)
+	default:
+		return fmt.Errorf("%w: imap: STARTTLS: %s", ErrInvalidResponse, sanitizeResponse(resp.line))
+	}
 }
 
-// Helper functions.
-func expectGreeting(ctx context.Context, rw *bufio.ReadWriter, pattern *regexp.Regexp) error {
-	for {
-		line, err := readLine(ctx, rw.Reader)
-		if err != nil {
-			return err
-		}
+func (p *imapProtocol) noopCommand() string {
+	return p.nextTag() + " NOOP\r\n"
+}
 
-		if pattern.MatchString(line) {
-			return nil
-		}
-	}
+func (p *imapProtocol) quitCommand() string {
+	return p.nextTag() + " LOGOUT\r\n"
 }
 
-func sendStartTLS(ctx context.Context, rw *bufio.ReadWriter, authMsg string, respPattern *regexp.Regexp) error {
-	_, err := rw.WriteString(authMsg)
+func (p *imapProtocol) requestPostTLSCapabilities(ctx context.Context, rw *bufio.ReadWriter) error {
+	err := p.applyTagPrefix(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = rw.Flush()
+	// The session continues after TLS, so its tags must stay unique.
+	result := sessionFromContext(ctx).result
+	p.tagCount = result.imapTags
+
+	capabilities, err := p.requestCapabilities(ctx, rw)
+	result.imapTags = p.tagCount
+
 	if err != nil {
 		return err
 	}
+	result.Capabilities = capabilities
+	result.Details = &IMAPCapabilities{Capabilities: capabilities}
 
-	line, err := readLine(ctx, rw.Reader)
-	if err != nil {
-		return err
+	return nil
+}
+
+// taggedCommand returns the next tag and the line sending command with it.
+func (p *imapProtocol) taggedCommand(command string) (string, string) {
+	tag := p.nextTag()
+
+	return tag, tag + " " + command + "\r\n"
+}
+
+// applyTagPrefix uses the prefix of WithIMAPTagPrefix for the tags, if set.
+func (p *imapProtocol) applyTagPrefix(ctx context.Context) error {
+	prefix := sessionFromContext(ctx).cfg.imapTagPrefix
+	if prefix == "" {
+		return nil
 	}
 
-	if !respPattern.MatchString(line) {
-		return fmt.Errorf("%w: %s", ErrStartTLSNotSupported, strings.TrimSpace(line))
+	if strings.ContainsAny(prefix, " (){%*\"\\+]") || strings.ContainsFunc(prefix, unicode.IsControl) {
+		return fmt.Errorf("imap: invalid tag prefix %q", prefix)
 	}
 
+	p.tagPrefix = prefix
+
 	return nil
 }
 
-func readLine(ctx context.Context, r *bufio.Reader) (string, error) {
-	// Create a channel for the read operation
-	lineCh := make(chan string, 1)
-	errCh := make(chan error, 1)
+// nextTag returns a tag that is unique within the session.
+func (p *imapProtocol) nextTag() string {
+	p.tagCount++
 
-	go func() {
-		line, err := r.ReadString('\n')
-		if err != nil {
-			errCh <- err
-			return
-		}
+	return fmt.Sprintf("%s%03d", p.tagPrefix, p.tagCount)
+}
 
-		lineCh <- line
-	}()
+// requestCapabilities issues CAPABILITY, for servers that do not include
+// their capabilities in the greeting.
+func (p *imapProtocol) requestCapabilities(ctx context.Context, rw *bufio.ReadWriter) ([]string, error) {
+	resp, err := p.command(ctx, rw, "CAPABILITY")
+	if err != nil {
+		return nil, err
+	}
 
-	// Wait for either the context to be done or the read to complete
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	case err := <-errCh:
-		return "", err
-	case line := <-lineCh:
-		return line, nil
+	if resp.status != "OK" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidResponse, sanitizeResponse(resp.line))
 	}
-}
 
-// Protocol registry.
-var protocols = map[string]func() StartTLSProtocol{
-	"21":   func() StartTLSProtocol { return newFTPProtocol() },
-	"25":   func() StartTLSProtocol { return newSMTPProtocol() },
-	"587":  func() StartTLSProtocol { return newSMTPProtocol() },
-	"110":  func() StartTLSProtocol { return newPOP3Protocol() },
-	"143":  func() StartTLSProtocol { return newIMAPProtocol() },
-	"3306": func() StartTLSProtocol { return newMySQLProtocol() },
-}
+	var capabilities []string
+
+	for _, data := range resp.untagged {
+		if atoms, ok := strings.CutPrefix(data, "CAPABILITY "); ok {
+			capabilities = append(capabilities, strings.Fields(atoms)...)
+		}
+	}
+
+	return capabilities, nil
+}
+
+// Credentials sent by the LOGIN audit. They are not expected to be valid;
+// only whether the server evaluates them before TLS is of interest.
+const (
+	imapAuditUser     = "starttls-audit"
+	imapAuditPassword = "invalid"
+)
+
+// auditPlaintextLogin sends LOGIN with placeholder credentials before
+// STARTTLS and records whether the server refuses it outright, with BAD or
+// NO [PRIVACYREQUIRED] (RFC 5530), or evaluates the credentials in plaintext.
+func (p *imapProtocol) auditPlaintextLogin(ctx context.Context, rw *bufio.ReadWriter) error {
+	resp, err := p.command(ctx, rw, "LOGIN "+imapAuditUser+" "+imapAuditPassword)
+	if err != nil {
+		return err
+	}
+
+	result := sessionFromContext(ctx).result
+
+	if resp.status == "BAD" || resp.status == "NO" && strings.Contains(strings.ToUpper(resp.line), "[PRIVACYREQUIRED]") {
+		result.addFinding(FindingLoginRequiresTLS, SeverityInfo,
+			"server refuses LOGIN before STARTTLS: "+sanitizeResponse(resp.line))
+
+		return nil
+	}
+
+	if resp.status == "OK" {
+		result.addFinding(FindingPlaintextLoginAccepted, SeverityHigh,
+			"server accepted LOGIN without TLS: "+sanitizeResponse(resp.line))
+
+		// STARTTLS is only allowed before authentication (RFC 3501
+		// section 6.2.1), so the session can only be ended.
+		s := sessionFromContext(ctx)
+		sendQuit(ctx, s.cfg.clock, rw, p.quitCommand())
+		s.ended = true
+
+		return fmt.Errorf("%w: %w", ErrIMAPLoginAccepted, ErrStartTLSNotSupported)
+	}
+
+	result.addFinding(FindingPlaintextLoginAccepted, SeverityMedium,
+		"server evaluates LOGIN credentials without TLS: "+sanitizeResponse(resp.line))
+
+	return nil
+}
+
+// readIMAPGreeting reads the server greeting (RFC 3501 section 7.1.1) and
+// returns its upper-cased status, OK, PREAUTH or BYE, and the line itself.
+func readIMAPGreeting(ctx context.Context, r *bufio.Reader) (string, string, error) {
+	line, err := readLine(ctx, r)
+	if err != nil {
+		return "", "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+
+	status, err := parseIMAPGreeting(line)
+	if err != nil {
+		return "", "", err
+	}
+
+	return status, line, nil
+}
+
+// parseIMAPGreeting returns the upper-cased status of a greeting line.
+func parseIMAPGreeting(line string) (string, error) {
+	data, ok := strings.CutPrefix(line, "* ")
+	if !ok {
+		return "", fmt.Errorf("%w: malformed greeting: %s", ErrInvalidResponse, sanitizeResponse(line))
+	}
+
+	status, _, _ := strings.Cut(data, " ")
+	status = strings.ToUpper(status)
+
+	switch status {
+	case "OK", "PREAUTH", "BYE":
+		return status, nil
+	default:
+		return "", fmt.Errorf("%w: malformed greeting: %s", ErrInvalidResponse, sanitizeResponse(line))
+	}
+}
+
+// imapResponse is the complete response to a tagged command.
+type imapResponse struct {
+	// untagged holds the untagged data sent before the tagged status,
+	// without the "* " prefix.
+	untagged []string
+	// status is the upper-cased tagged status: OK, NO or BAD.
+	status string
+	// line is the tagged status line.
+	line string
+}
+
+// command sends a tagged command and reads up to its tagged status,
+// collecting the untagged responses in between, such as ALERT or
+// CAPABILITY updates.
+func (p *imapProtocol) command(ctx context.Context, rw *bufio.ReadWriter, command string) (*imapResponse, error) {
+	tag, line := p.taggedCommand(command)
+
+	_, err := rw.WriteString(line)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &imapResponse{}
+
+	for {
+		line, err := readLine(ctx, rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if data, ok := strings.CutPrefix(line, "* "); ok {
+			resp.untagged = append(resp.untagged, data)
+
+			continue
+		}
+
+		status, ok := strings.CutPrefix(line, tag+" ")
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected response to %s: %s", ErrInvalidResponse, tag, sanitizeResponse(line))
+		}
+
+		status, _, _ = strings.Cut(status, " ")
+		resp.status = strings.ToUpper(status)
+		resp.line = line
+
+		return resp, nil
+	}
+}
+
+// parseIMAPGreetingCapabilities extracts the capabilities from a greeting
+// carrying a CAPABILITY response code, e.g. "* OK [CAPABILITY IMAP4rev1 STARTTLS] ready".
+func parseIMAPGreetingCapabilities(greeting string) []string {
+	_, rest, ok := strings.Cut(greeting, "[CAPABILITY ")
+	if !ok {
+		return nil
+	}
+
+	list, _, ok := strings.Cut(rest, "]")
+	if !ok {
+		return nil
+	}
+
+	return strings.Fields(list)
+}
+
+// POP3 protocol implementation.
+type pop3Protocol struct {
+	BaseProtocol
+}
+
+// NewPOP3Protocol returns the POP3 protocol registered for port 110. See
+// NewSMTPProtocol.
+func NewPOP3Protocol() StartTLSProtocol {
+	return newPOP3Protocol()
+}
+
+func newPOP3Protocol() *pop3Protocol {
+	return &pop3Protocol{
+		BaseProtocol: NewBaseProtocol(ProtocolPOP3, "STLS\r\n"),
+	}
+}
+
+func (p *pop3Protocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	result := sessionFromContext(ctx).result
+	start := now(ctx)
+
+	stepCtx, cancel := stepContext(ctx, StepGreeting)
+
+	// A greeting accepted by the matcher counts as +OK.
+	ok, greeting := true, ""
+
+	var err error
+
+	if match := sessionFromContext(ctx).cfg.greetingMatcher; match != nil {
+		greeting, err = expectGreeting(stepCtx, rw, match)
+	} else {
+		ok, greeting, err = readPOP3Reply(stepCtx, rw.Reader)
+	}
+
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("pop3: greeting failed: %w", err)
+	}
+
+	result.Banner = greeting
+	result.addTiming(StepGreeting, start, now(ctx))
+
+	if !ok {
+		return fmt.Errorf("pop3: server refused the connection: %w", newPOP3Error(greeting, ErrInvalidResponse))
+	}
+
+	info := &POP3Info{APOPTimestamp: apopTimestampPattern.FindString(greeting)}
+	result.Details = info
+	start = now(ctx)
+
+	// Servers that do not know STLS may drop the connection when sent
+	// it, so only send it when CAPA advertises it (RFC 2595 section 4).
+	stepCtx, cancel = stepContext(ctx, StepCapabilities)
+	info.Capabilities, err = p.requestCapabilities(stepCtx, rw)
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("pop3: CAPA failed: %w", err)
+	}
+
+	result.addTiming(StepCapabilities, start, now(ctx))
+	result.Capabilities = info.Capabilities
+
+	if !info.Has("STLS") {
+		return fmt.Errorf("pop3: %w: %w: capabilities: %s", ErrStartTLSNotAdvertised, ErrStartTLSNotSupported,
+			sanitizeResponse(strings.Join(info.Capabilities, ", ")))
+	}
+
+	if stopBeforeUpgrade(ctx) {
+		return errProbeStopped
+	}
+
+	result.UpgradeCommand = strings.TrimSpace(p.authMsg)
+	start = now(ctx)
+
+	stepCtx, cancel = stepContext(ctx, StepUpgrade)
+
+	var reply string
+
+	if match := sessionFromContext(ctx).cfg.responseMatcher; match != nil {
+		err = sendStartTLS(stepCtx, rw, p.authMsg, match)
+	} else {
+		ok, reply, err = p.command(stepCtx, rw, p.authMsg)
+	}
+
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("pop3: STARTTLS failed: %w", err)
+	}
+
+	if !ok {
+		return fmt.Errorf("pop3: STARTTLS failed: %w", newPOP3Error(reply, ErrStartTLSNotSupported))
+	}
+
+	result.addTiming(StepUpgrade, start, now(ctx))
+
+	return nil
+}
+
+// command sends a single POP3 command and reads its status line.
+func (p *pop3Protocol) command(ctx context.Context, rw *bufio.ReadWriter, command string) (bool, string, error) {
+	_, err := rw.WriteString(command)
+	if err != nil {
+		return false, "", err
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return false, "", err
+	}
+
+	return readPOP3Reply(ctx, rw.Reader)
+}
+
+// readPOP3Reply reads a status line (RFC 1939 section 3), reporting whether
+// it is +OK rather than -ERR, and returns the line without its terminator.
+func readPOP3Reply(ctx context.Context, r *bufio.Reader) (bool, string, error) {
+	line, err := readLine(ctx, r)
+	if err != nil {
+		return false, "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+
+	ok, err := parsePOP3Status(line)
+	if err != nil {
+		return false, "", err
+	}
+
+	return ok, line, nil
+}
+
+// parsePOP3Status reports whether a status line is +OK rather than -ERR.
+func parsePOP3Status(line string) (bool, error) {
+	status, _, _ := strings.Cut(line, " ")
+
+	switch status {
+	case "+OK":
+		return true, nil
+	case "-ERR":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: malformed status line: %s", ErrInvalidResponse, sanitizeResponse(line))
+	}
+}
+
+// pop3CapaCommand requests the capabilities (RFC 2449).
+const pop3CapaCommand = "CAPA\r\n"
+
+// requestCapabilities issues CAPA (RFC 2449) and returns the capability
+// lines, e.g. "TOP", "SASL PLAIN LOGIN" or "STLS".
+func (p *pop3Protocol) requestCapabilities(ctx context.Context, rw *bufio.ReadWriter) ([]string, error) {
+	ok, reply, err := p.command(ctx, rw, pop3CapaCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %w: CAPA not supported: %s", ErrStartTLSNotAdvertised, ErrStartTLSNotSupported,
+			sanitizeResponse(reply))
+	}
+
+	var capabilities []string
+
+	for {
+		line, err := readLine(ctx, rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			return capabilities, nil
+		}
+
+		// Undo byte-stuffing of lines starting with a dot.
+		capabilities = append(capabilities, strings.TrimPrefix(line, "."))
+	}
+}
+
+func (p *pop3Protocol) requestPostTLSCapabilities(ctx context.Context, rw *bufio.ReadWriter) error {
+	capabilities, err := p.requestCapabilities(ctx, rw)
+	if err != nil {
+		return err
+	}
+
+	result := sessionFromContext(ctx).result
+	result.Capabilities = capabilities
+	result.Details = &POP3Info{Capabilities: capabilities}
+
+	return nil
+}
+
+func (p *pop3Protocol) noopCommand() string {
+	return "NOOP\r\n"
+}
+
+func (p *pop3Protocol) quitCommand() string {
+	return "QUIT\r\n"
+}
+
+// apopTimestampPattern matches the RFC 1939 APOP timestamp in a POP3
+// greeting, e.g. "<1896.697170952@dbc.mtview.ca.us>".
+var apopTimestampPattern = regexp.MustCompile(`<[^<>\s]+@[^<>\s]+>`)
+
+// FTP protocol implementation.
+type ftpProtocol struct {
+	BaseProtocol
+}
+
+// NewFTPProtocol returns the FTP protocol registered for port 21. See
+// NewSMTPProtocol.
+func NewFTPProtocol() StartTLSProtocol {
+	return newFTPProtocol()
+}
+
+func newFTPProtocol() *ftpProtocol {
+	return &ftpProtocol{
+		BaseProtocol: NewBaseProtocol(ProtocolFTP, "AUTH TLS\r\n"),
+	}
+}
+
+func (p *ftpProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	result := sessionFromContext(ctx).result
+	start := now(ctx)
+
+	stepCtx, cancel := stepContext(ctx, StepGreeting)
+	greeting, err := readCodeGreeting(stepCtx, rw, readFTPReply, "220")
+
+	// A 120 reply announces a delay and is followed by the 220 greeting.
+	for err == nil && greeting.code == "120" {
+		greeting, err = readFTPReply(stepCtx, rw.Reader)
+	}
+
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("ftp: greeting failed: %w", err)
+	}
+
+	result.Banner = strings.Join(greeting.raw, "\n")
+	result.addTiming(StepGreeting, start, now(ctx))
+
+	if greeting.code != "220" {
+		return fmt.Errorf("ftp: unexpected greeting: %w", newFTPError(greeting, ErrInvalidResponse))
+	}
+
+	if sessionFromContext(ctx).cfg.ftpFeatures {
+		start = now(ctx)
+
+		stepCtx, cancel = stepContext(ctx, StepCapabilities)
+		err = p.requestFeatures(stepCtx, rw)
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("ftp: FEAT failed: %w", err)
+		}
+
+		result.addTiming(StepCapabilities, start, now(ctx))
+
+		// Only a server that lists AUTH TLS has advertised it; others are
+		// sent the command even when probing.
+		if info, ok := ResultDetails[*FTPInfo](result); ok && info.Has("AUTH TLS") && stopBeforeUpgrade(ctx) {
+			return errProbeStopped
+		}
+	}
+
+	result.UpgradeCommand = strings.TrimSpace(p.authMsg)
+	start = now(ctx)
+
+	_, err = rw.WriteString(p.authMsg)
+	if err != nil {
+		return fmt.Errorf("ftp: AUTH TLS failed: %w", err)
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return fmt.Errorf("ftp: AUTH TLS failed: %w", err)
+	}
+
+	stepCtx, cancel = stepContext(ctx, StepUpgrade)
+
+	if match := sessionFromContext(ctx).cfg.responseMatcher; match != nil {
+		err = expectStartTLSResponse(stepCtx, rw, match)
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("ftp: AUTH TLS failed: %w", err)
+		}
+
+		result.addTiming(StepUpgrade, start, now(ctx))
+
+		return nil
+	}
+
+	reply, err := readFTPReply(stepCtx, rw.Reader)
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("ftp: AUTH TLS failed: %w", err)
+	}
+
+	switch {
+	case reply.code == "234":
+		result.addTiming(StepUpgrade, start, now(ctx))
+
+		return nil
+	case sessionFromContext(ctx).cfg.strictMatching && !reply.negative():
+		return fmt.Errorf("%w: ftp: AUTH TLS: %s", ErrInvalidResponse, reply)
+	default:
+		return fmt.Errorf("ftp: AUTH TLS failed: %w", newFTPError(reply, ftpAuthTLSError(reply.code)))
+	}
+}
+
+// ftpAuthTLSError returns the error matched by a refusal of AUTH TLS with
+// code: ErrStartTLSNotSupported, together with ErrFTPNotLoggedIn for 530
+// and ErrFTPPolicyDenied for 534.
+func ftpAuthTLSError(code string) error {
+	switch code {
+	case "530":
+		return fmt.Errorf("%w: %w", ErrFTPNotLoggedIn, ErrStartTLSNotSupported)
+	case "534":
+		return fmt.Errorf("%w: %w", ErrFTPPolicyDenied, ErrStartTLSNotSupported)
+	default:
+		return ErrStartTLSNotSupported
+	}
+}
+
+// requestFeatures issues FEAT (RFC 2389) and records the feature list. A
+// server that does not implement FEAT is recorded with no features.
+func (p *ftpProtocol) requestFeatures(ctx context.Context, rw *bufio.ReadWriter) error {
+	_, err := rw.WriteString("FEAT\r\n")
+	if err != nil {
+		return err
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return err
+	}
+
+	reply, err := readFTPReply(ctx, rw.Reader)
+	if err != nil {
+		return err
+	}
+
+	info := &FTPInfo{}
+
+	// The features are listed between the "211-" and "211 " lines.
+	if reply.code == "211" && len(reply.lines) > 2 {
+		info.Features = reply.lines[1 : len(reply.lines)-1]
+	}
+
+	result := sessionFromContext(ctx).result
+	result.Capabilities = info.Features
+	result.Details = info
+
+	return nil
+}
+
+func (p *ftpProtocol) requestPostTLSCapabilities(ctx context.Context, rw *bufio.ReadWriter) error {
+	return p.requestFeatures(ctx, rw)
+}
+
+func (p *ftpProtocol) noopCommand() string {
+	return "NOOP\r\n"
+}
+
+func (p *ftpProtocol) quitCommand() string {
+	return "QUIT\r\n"
+}
+
+// readFTPReply reads a reply up to its last line (RFC 959 section 4.2). A
+// multiline reply starts with "xyz-" and ends with a line starting with the
+// same code followed by a space; the lines in between may contain anything,
+// including other numbers.
+func readFTPReply(ctx context.Context, r *bufio.Reader) (*codeReply, error) {
+	line, err := readLine(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 {
+		return nil, fmt.Errorf("%w: malformed reply line: %s", ErrInvalidResponse, sanitizeResponse(line))
+	}
+
+	err = checkReplyCode(ctx, line)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &codeReply{
+		code:  line[:3],
+		lines: []string{strings.TrimSpace(line[min(len(line), 4):])},
+		raw:   []string{strings.TrimRight(line, "\r\n")},
+	}
+
+	if len(line) < 4 || line[3] != '-' {
+		return reply, nil
+	}
+
+	for {
+		line, err = readLine(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+
+		reply.raw = append(reply.raw, strings.TrimRight(line, "\r\n"))
+
+		if text, ok := strings.CutPrefix(line, reply.code+" "); ok {
+			reply.lines = append(reply.lines, strings.TrimSpace(text))
+			sessionFromContext(ctx).response = strings.Join(reply.raw, "\n")
+
+			return reply, nil
+		}
+
+		reply.lines = append(reply.lines, strings.TrimSpace(line))
+	}
+}
+
+// MySQL protocol implementation.
+type mysqlProtocol struct {
+	name string
+	// sequence is the sequence number of the last packet read; the SSL
+	// request continues from it.
+	sequence byte
+}
+
+// NewMySQLProtocol returns the MySQL protocol registered for port 3306. See
+// NewSMTPProtocol.
+func NewMySQLProtocol() StartTLSProtocol {
+	return newMySQLProtocol()
+}
+
+func newMySQLProtocol() *mysqlProtocol {
+	return &mysqlProtocol{
+		name: string(ProtocolMySQL),
+	}
+}
+
+// MySQL protocol constants.
+const (
+	clientMySQL          = 0x00000001
+	clientSSL            = 0x800
+	clientProtocol41     = 0x00000200
+	clientSecureConn     = 0x00008000
+	clientPluginAuth     = 0x00080000
+	clientConnectAttrs   = 0x00100000
+	mysqlProtocolVersion = 10
+	mysqlLegacyVersion   = 9
+	mysqlErrPacket       = 0xff
+	maxMySQLPacketSize   = 16777215
+	maxMySQLPayloadSize  = 2 * maxMySQLPacketSize
+	utf8GeneralCI        = 33
+	mariaDBVersionPrefix = "5.5.5-"
+)
+
+func (p *mysqlProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	result := sessionFromContext(ctx).result
+	start := now(ctx)
+
+	// Read and parse handshake packet
+	stepCtx, cancel := stepContext(ctx, StepGreeting)
+	body, err := readContext(stepCtx, func() ([]byte, error) {
+		return p.readMySQLPacket(rw, 0)
+	})
+	cancel()
+
+	if err != nil {
+		return err
+	}
+
+	if len(body) > 0 && body[0] == mysqlErrPacket {
+		return parseMySQLErrPacket(body)
+	}
+
+	info, err := p.parseHandshakePacket(body)
+	if err != nil {
+		return err
+	}
+
+	// The handshake packet is binary, so the server version stands in for
+	// the banner.
+	result.Banner = info.ServerVersion
+	result.Details = info
+	result.addTiming(StepGreeting, start, now(ctx))
+
+	// The SSL request is a 4.1 handshake response, which older servers do
+	// not understand.
+	if info.ProtocolVersion != mysqlProtocolVersion || info.Capabilities&clientProtocol41 == 0 {
+		return &MySQLLegacyServerError{ProtocolVersion: info.ProtocolVersion, ServerVersion: info.ServerVersion}
+	}
+
+	// Check if server supports SSL
+	if info.Capabilities&clientSSL == 0 {
+		return fmt.Errorf("%w: MySQL server does not support SSL", ErrStartTLSNotSupported)
+	}
+
+	if stopBeforeUpgrade(ctx) {
+		return errProbeStopped
+	}
+
+	// Send SSL request
+	start = now(ctx)
+	sslRequest := p.createSSLRequestPacket(sessionFromContext(ctx).cfg)
+
+	_, cancel = stepContext(ctx, StepUpgrade)
+	defer cancel()
+
+	_, err = rw.Write(sslRequest)
+	if err != nil {
+		return fmt.Errorf("mysql: failed to write SSL request: %w", err)
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return fmt.Errorf("mysql: failed to flush SSL request: %w", err)
+	}
+
+	result.addTiming(StepUpgrade, start, now(ctx))
+
+	return nil
+}
+
+func (p *mysqlProtocol) Name() string {
+	return p.name
+}
+
+// readMySQLPacket reads a MySQL packet and returns its body. A packet with
+// the maximum length of 0xffffff is continued in the next packet, so the
+// bodies are joined until a shorter packet ends the payload. Sequence
+// numbers must increase from first and every packet must be as long as its
+// header declares, otherwise a *MySQLFramingError is returned.
+func (p *mysqlProtocol) readMySQLPacket(rw *bufio.ReadWriter, first byte) ([]byte, error) {
+	var body []byte
+
+	header := make([]byte, 4)
+
+	for seq := first; ; seq++ {
+		_, err := io.ReadFull(rw.Reader, header)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: failed to read packet header: %w", err)
+		}
+
+		// Get packet length (3 bytes, little-endian)
+		length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+
+		if header[3] != seq {
+			return nil, &MySQLFramingError{Sequence: header[3], ExpectedSequence: seq, Length: length}
+		}
+
+		if len(body)+length > maxMySQLPayloadSize {
+			return nil, fmt.Errorf("%w: mysql: payload exceeds %d bytes", ErrInvalidResponse, maxMySQLPayloadSize)
+		}
+
+		start := len(body)
+		body = append(body, make([]byte, length)...)
+
+		n, err := io.ReadFull(rw.Reader, body[start:])
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) && length > 0 {
+			return nil, &MySQLFramingError{Sequence: seq, ExpectedSequence: seq, Length: length, Read: n}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("mysql: failed to read packet body: %w", err)
+		}
+
+		p.sequence = seq
+
+		if length < maxMySQLPacketSize {
+			return body, nil
+		}
+	}
+}
+
+// MySQLFramingError is returned when a MySQL packet does not match its
+// header: its sequence number is out of order, or the connection ended
+// before the declared payload length was read. This usually means a
+// middlebox is interfering. It matches ErrInvalidResponse.
+type MySQLFramingError struct {
+	// Sequence is the sequence number of the packet and ExpectedSequence
+	// the one that should have followed the previous packet.
+	Sequence         byte
+	ExpectedSequence byte
+	// Length is the payload length declared in the header and Read the
+	// number of payload bytes received.
+	Length int
+	Read   int
+}
+
+func (e *MySQLFramingError) Error() string {
+	if e.Sequence != e.ExpectedSequence {
+		return fmt.Sprintf("%s: mysql: packet sequence %d, expected %d", ErrInvalidResponse, e.Sequence, e.ExpectedSequence)
+	}
+
+	return fmt.Sprintf("%s: mysql: packet declares %d bytes but only %d were received", ErrInvalidResponse, e.Length, e.Read)
+}
+
+func (e *MySQLFramingError) Unwrap() error {
+	return ErrInvalidResponse
+}
+
+// parseHandshakePacket parses the initial handshake packet.
+func (p *mysqlProtocol) parseHandshakePacket(body []byte) (*MySQLHandshakeInfo, error) {
+	if len(body) == 0 {
+		return nil, fmt.Errorf("mysql: empty handshake packet")
+	}
+
+	if body[0] != mysqlProtocolVersion && body[0] != mysqlLegacyVersion {
+		return nil, fmt.Errorf("mysql: unsupported protocol version: %d", body[0])
+	}
+
+	info := &MySQLHandshakeInfo{ProtocolVersion: body[0]}
+
+	// Read server version (null-terminated)
+	pos := 1
+	for pos < len(body) && body[pos] != 0 {
+		pos++
+	}
+
+	if pos == len(body) {
+		return nil, fmt.Errorf("%w: mysql: server version is not terminated within the packet", ErrInvalidResponse)
+	}
+
+	info.ServerVersion = string(body[1:pos])
+	pos++ // skip null terminator
+
+	if pos+4 <= len(body) {
+		info.ThreadID = binary.LittleEndian.Uint32(body[pos:])
+	}
+
+	// Protocol 9 handshakes carry no capability flags.
+	if info.ProtocolVersion == mysqlLegacyVersion {
+		return info, nil
+	}
+
+	pos += 4 // thread ID
+
+	if pos+8 <= len(body) {
+		info.scramble = string(body[pos : pos+8])
+	}
+
+	pos += 8 // auth plugin data part 1
+	pos++    // filler
+
+	// Read capability flags
+	if pos+2 > len(body) {
+		return nil, fmt.Errorf("mysql: packet too short for capability flags")
+	}
+
+	info.Capabilities = uint32(binary.LittleEndian.Uint16(body[pos:]))
+	pos += 2
+
+	// The remaining fields are optional in the protocol.
+	if pos+16 > len(body) {
+		p.detectMariaDB(info)
+
+		return info, nil
+	}
+
+	info.CharacterSet = body[pos]
+	pos++
+	info.StatusFlags = binary.LittleEndian.Uint16(body[pos:])
+	pos += 2
+	info.Capabilities |= uint32(binary.LittleEndian.Uint16(body[pos:])) << 16
+	pos += 2
+	authDataLen := int(body[pos])
+	pos++
+
+	// MariaDB clears CLIENT_MYSQL and stores its extended capabilities in
+	// the last 4 of the 10 reserved bytes.
+	if info.Capabilities&clientMySQL == 0 {
+		info.MariaDBCapabilities = binary.LittleEndian.Uint32(body[pos+6:])
+	}
+
+	pos += 10 // reserved
+
+	// The second part of the auth plugin data is at least 13 bytes long,
+	// ends with a null byte, and is followed by the null-terminated auth
+	// plugin name.
+	if info.Capabilities&clientSecureConn != 0 {
+		part2Len := max(13, authDataLen-8)
+		if pos+part2Len <= len(body) {
+			part2, _, _ := bytes.Cut(body[pos:pos+part2Len], []byte{0})
+			info.scramble += string(part2)
+		}
+
+		pos += part2Len
+	}
+
+	if info.Capabilities&clientPluginAuth != 0 && pos < len(body) {
+		name, _, _ := bytes.Cut(body[pos:], []byte{0})
+		info.AuthPluginName = string(name)
+	}
+
+	p.detectMariaDB(info)
+
+	return info, nil
+}
+
+// MySQLServerError is returned when a MySQL server answers the connection
+// with an ERR packet instead of a handshake, for example when the client host
+// is not allowed to connect or the server has too many connections.
+type MySQLServerError struct {
+	// Code is the MySQL error number, e.g. 1130 (ER_HOST_NOT_PRIVILEGED).
+	Code uint16
+	// SQLState is the five character SQL state, empty when the server did
+	// not send one.
+	SQLState string
+	// Message is the error message sent by the server, sanitized.
+	Message string
+}
+
+// Protocol returns ProtocolMySQL.
+func (e *MySQLServerError) Protocol() ProtocolID {
+	return ProtocolMySQL
+}
+
+// Temporary reports whether the error is one that clears by itself: too
+// many connections (1040), out of resources (1041), too many connections
+// for the user (1203) or a user resource limit reached (1226).
+func (e *MySQLServerError) Temporary() bool {
+	switch e.Code {
+	case 1040, 1041, 1203, 1226:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *MySQLServerError) Error() string {
+	if e.SQLState != "" {
+		return fmt.Sprintf("mysql: server error %d (%s): %s", e.Code, e.SQLState, e.Message)
+	}
+
+	return fmt.Sprintf("mysql: server error %d: %s", e.Code, e.Message)
+}
+
+// MySQLLegacyServerError is returned for servers older than MySQL 4.1, which
+// speak handshake protocol version 9 or lack CLIENT_PROTOCOL_41 and cannot
+// process the SSL request. It matches ErrStartTLSNotSupported. The
+// handshake details are still available in the result.
+type MySQLLegacyServerError struct {
+	ProtocolVersion uint8
+	// ServerVersion is the version string the server reported.
+	ServerVersion string
+}
+
+func (e *MySQLLegacyServerError) Error() string {
+	return fmt.Sprintf("%s: mysql: server %s uses the pre-4.1 protocol (version %d)",
+		ErrStartTLSNotSupported, sanitizeResponse(e.ServerVersion), e.ProtocolVersion)
+}
+
+func (e *MySQLLegacyServerError) Unwrap() error {
+	return ErrStartTLSNotSupported
+}
+
+// parseMySQLErrPacket decodes an ERR packet into a *MySQLServerError.
+func parseMySQLErrPacket(body []byte) error {
+	if len(body) < 3 {
+		return fmt.Errorf("%w: mysql: truncated ERR packet", ErrInvalidResponse)
+	}
+
+	serverErr := &MySQLServerError{Code: binary.LittleEndian.Uint16(body[1:3])}
+	message := body[3:]
+
+	// The SQL state marker is only present once CLIENT_PROTOCOL_41 is in
+	// effect, which is usually not the case before the handshake.
+	if len(message) >= 6 && message[0] == '#' {
+		serverErr.SQLState = string(message[1:6])
+		message = message[6:]
+	}
+
+	serverErr.Message = sanitizeResponse(string(message))
+
+	return serverErr
+}
+
+// detectMariaDB flags MariaDB servers and strips the "5.5.5-" version prefix
+// MariaDB 10.x sends for compatibility with old replication clients.
+func (p *mysqlProtocol) detectMariaDB(info *MySQLHandshakeInfo) {
+	if !strings.Contains(strings.ToLower(info.ServerVersion), "mariadb") {
+		return
+	}
+
+	info.MariaDB = true
+	info.ServerVersion = strings.TrimPrefix(info.ServerVersion, mariaDBVersionPrefix)
+}
+
+// createSSLRequestPacket creates the SSL request packet. CLIENT_SSL and
+// CLIENT_PROTOCOL_41 are always requested on top of the configured flags.
+func (p *mysqlProtocol) createSSLRequestPacket(cfg *config) []byte {
+	packet := make([]byte, 4, 4+32) // Header + SSL request packet
+
+	// Packet header
+	packet[0] = 32             // payload length
+	packet[3] = p.sequence + 1 // sequence number
+
+	return appendMySQLClientHeader(packet, cfg)
+}
+
+// mysqlClientFlags returns the capability flags the client announces, in
+// the SSL request and in the handshake response that follows it.
+func mysqlClientFlags(cfg *config) uint32 {
+	clientFlags := uint32(clientSecureConn)
+	if cfg.mysqlClientFlags != 0 {
+		clientFlags = cfg.mysqlClientFlags
+	}
+
+	clientFlags |= clientSSL | clientProtocol41
+
+	if len(cfg.mysqlConnectAttrs) > 0 {
+		clientFlags |= clientConnectAttrs
+	}
+
+	return clientFlags
+}
+
+// appendMySQLClientHeader appends the 32 bytes shared by the SSL request and
+// the handshake response: client flags, max packet size, character set and
+// 23 bytes of filler.
+func appendMySQLClientHeader(b []byte, cfg *config) []byte {
+	maxSize := uint32(maxMySQLPacketSize)
+	if cfg.mysqlMaxPacketSize != 0 {
+		maxSize = cfg.mysqlMaxPacketSize
+	}
+
+	charset := byte(utf8GeneralCI)
+	if cfg.mysqlCharset != 0 {
+		charset = cfg.mysqlCharset
+	}
+
+	b = binary.LittleEndian.AppendUint32(b, mysqlClientFlags(cfg))
+	b = binary.LittleEndian.AppendUint32(b, maxSize)
+	b = append(b, charset)
+
+	return append(b, make([]byte, 23)...)
+}
+
+// appendMySQLConnectAttrs appends the connection attributes block of a
+// HandshakeResponse41: the total length followed by length-encoded key and
+// value strings, sorted by key.
+func appendMySQLConnectAttrs(b []byte, attrs map[string]string) []byte {
+	var block []byte
+
+	for _, key := range slices.Sorted(maps.Keys(attrs)) {
+		block = appendMySQLLengthEncodedString(block, key)
+		block = appendMySQLLengthEncodedString(block, attrs[key])
+	}
+
+	b = appendMySQLLengthEncodedInt(b, uint64(len(block)))
+
+	return append(b, block...)
+}
+
+// appendMySQLLengthEncodedInt appends n as a MySQL length-encoded integer.
+func appendMySQLLengthEncodedInt(b []byte, n uint64) []byte {
+	switch {
+	case n < 0xfb:
+		return append(b, byte(n))
+	case n <= 0xffff:
+		return append(b, 0xfc, byte(n), byte(n>>8))
+	case n <= 0xffffff:
+		return append(b, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		return binary.LittleEndian.AppendUint64(append(b, 0xfe), n)
+	}
+}
+
+// appendMySQLLengthEncodedString appends s prefixed with its length-encoded length.
+func appendMySQLLengthEncodedString(b []byte, s string) []byte {
+	return append(appendMySQLLengthEncodedInt(b, uint64(len(s))), s...)
+}
+
+// Helper functions.
+
+// sanitizeResponse makes server-controlled text safe to embed in errors and
+// logs: control characters and invalid UTF-8 are dropped so banners cannot
+// inject terminal escape sequences, and the text is truncated to
+// maxResponseText bytes.
+func sanitizeResponse(s string) string {
+	var b strings.Builder
+
+	for _, r := range strings.TrimSpace(s) {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			continue
+		}
+
+		if b.Len()+utf8.RuneLen(r) > maxResponseText {
+			b.WriteString("...")
+
+			break
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// containsFold reports whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// noopCommander is implemented by protocols that have a harmless command
+// which can be used to probe the server after a rejected STARTTLS.
+type noopCommander interface {
+	noopCommand() string
+}
+
+// quitCommander is implemented by protocols that have a command to end the
+// session politely.
+type quitCommander interface {
+	quitCommand() string
+}
+
+// errProbeStopped is returned by a Handshake that WithProbeOnly stopped
+// after the server advertised STARTTLS, before the upgrade command.
+var errProbeStopped = errors.New("probe stopped before the upgrade")
+
+// stopBeforeUpgrade reports whether the handshake should return
+// errProbeStopped instead of sending the upgrade command once the server
+// has advertised STARTTLS.
+func stopBeforeUpgrade(ctx context.Context) bool {
+	cfg := sessionFromContext(ctx).cfg
+
+	return cfg.probeOnly && !cfg.probeConfirm
+}
+
+// quitReplyWait bounds how long the server's reply to the quit command is
+// awaited.
+const quitReplyWait = time.Second
+
+// sendQuit ends the session with command and waits briefly for the reply.
+// Errors are ignored: the connection is about to be closed anyway.
+func sendQuit(ctx context.Context, clock Clock, rw *bufio.ReadWriter, command string) {
+	ctx, cancel := withTimeout(ctx, clock, quitReplyWait)
+	defer cancel()
+
+	_, err := rw.WriteString(command)
+	if err == nil {
+		err = rw.Flush()
+	}
+
+	if err == nil {
+		_, _ = readLine(ctx, rw.Reader)
+	}
+}
+
+// observeRejection sends a harmless command after STARTTLS was rejected and
+// classifies how the server reacts within wait.
+func observeRejection(ctx context.Context, clock Clock, rw *bufio.ReadWriter, command string, wait time.Duration) RejectionBehavior {
+	ctx, cancel := withTimeout(ctx, clock, wait)
+	defer cancel()
+
+	_, err := rw.WriteString(command)
+	if err == nil {
+		err = rw.Flush()
+	}
+
+	if err != nil {
+		return RejectionClosed
+	}
+
+	_, err = readLine(ctx, rw.Reader)
+
+	switch {
+	case err == nil:
+		return RejectionOpen
+	case errors.Is(err, context.DeadlineExceeded):
+		return RejectionHang
+	default:
+		return RejectionClosed
+	}
+}
+
+// readContext runs a blocking read in a goroutine so that it can be abandoned
+// when ctx is done.
+func readContext[T any](ctx context.Context, read func() (T, error)) (T, error) {
+	type readResult struct {
+		value T
+		err   error
+	}
+
+	resultCh := make(chan readResult, 1)
+
+	go func() {
+		value, err := read()
+		resultCh <- readResult{value: value, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		var zero T
+
+		return zero, ctx.Err()
+	case res := <-resultCh:
+		return res.value, res.err
+	}
+}
+
+func readLine(ctx context.Context, r *bufio.Reader) (string, error) {
+	s := sessionFromContext(ctx)
+
+	// Create a channel for the read operation
+	lineCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		line, err := readLimitedLine(r, s.cfg.maxLineBytes)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		lineCh <- line
+	}()
+
+	// Wait for either the context to be done or the read to complete
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case err := <-errCh:
+		return "", err
+	case line := <-lineCh:
+		s.response = strings.TrimRight(line, "\r\n")
+
+		if s.cfg.strictCRLF && !strings.HasSuffix(line, "\r\n") {
+			return "", fmt.Errorf("%w: line not terminated by CRLF: %s", ErrInvalidResponse, sanitizeResponse(line))
+		}
+
+		return line, nil
+	}
+}
+
+// readLimitedLine reads a line like ReadString, but returns a *LimitError
+// once the line exceeds limit bytes. A limit of 0 does not bound the line.
+func readLimitedLine(r *bufio.Reader, limit int) (string, error) {
+	if limit <= 0 {
+		return r.ReadString('\n')
+	}
+
+	var line []byte
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if len(line) > limit {
+			return "", &LimitError{Limit: "line", Max: limit}
+		}
+
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return string(line), err
+		}
+	}
+}
+
+// countingConn counts the bytes exchanged over a connection. The counters
+// are atomic because readContext may leave a read running after it returns.
+type countingConn struct {
+	io.ReadWriter
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriter.Read(b)
+	c.received.Add(int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriter.Write(b)
+	c.sent.Add(int64(n))
+
+	return n, err
+}
+
+// report records the byte counts and the time elapsed on clock since start
+// in result.
+func (c *countingConn) report(result *StartTLSResult, clock Clock, start time.Time) {
+	result.Duration = clock.Now().Sub(start)
+	result.BytesSent = c.sent.Load()
+	result.BytesReceived = c.received.Load()
+}
 
 // StartTLS initiates a STARTTLS handshake for supported protocols.
-func StartTLS(ctx context.Context, conn net.Conn, port string) error {
-	// Check if this is a STARTTLS protocol
-	protocolFactory, ok := protocols[port]
+//
+// port selects the protocol and may be a number, such as 25, a string such
+// as "25", or the "host:port" address that was dialed.
+//
+// conn may be any net.Conn, including a *tls.Conn when the plaintext protocol
+// itself runs inside an outer TLS session, as happens behind TLS-terminating
+// load balancers. The second TLS handshake is then layered on the same conn.
+// Any other io.ReadWriter, such as a tunnel or an in-memory pipe, works as
+// well; features that need more than reads and writes use them when conn
+// has them: WithAutoDetect requires SetReadDeadline, and WithLogger reports
+// RemoteAddr when conn provides it.
+//
+// StartTLS never falls back silently: with WithOpportunistic the reason
+// STARTTLS was not established is still returned as the error.
+//
+// The caller runs the TLS handshake on conn itself, so StartTLS returns
+// ErrInvalidResponse when the server sent data after accepting the upgrade
+// that the negotiation had already read; such bytes would otherwise be lost
+// and break the handshake. Use UpgradeTLS, or Negotiate and
+// StartTLSResult.Conn, to hand them to the TLS client instead.
+func StartTLS[P Port](ctx context.Context, conn io.ReadWriter, port P, opts ...Option) error {
+	result, err := Negotiate(ctx, conn, port, opts...)
+	if err != nil {
+		return err
+	}
+
+	if len(result.pending) > 0 {
+		return fmt.Errorf("%w: %s: %d bytes received before the TLS handshake",
+			ErrInvalidResponse, result.Protocol, len(result.pending))
+	}
+
+	return result.FallbackReason
+}
+
+// Negotiate performs the same handshake as StartTLS and additionally reports
+// what was learned about the server. The result is returned even when the
+// negotiation fails so that partial observations are not lost.
+func Negotiate[P Port](ctx context.Context, conn io.ReadWriter, p P, opts ...Option) (*StartTLSResult, error) {
+	cfg := newConfig(opts)
+	result := &StartTLSResult{}
+
+	port, err := servicePort(cfg, portString(p))
+	if err != nil {
+		return result, err
+	}
+
+	protocolFactory, ok, err := resolvePort(cfg, port)
+	if err != nil {
+		return result, err
+	}
+
+	if isDirectTLS(cfg, port) {
+		result.ImplicitTLS = true
+
+		return result, nil
+	}
+
+	counter := &countingConn{ReadWriter: conn}
+	defer counter.report(result, cfg.clock, cfg.clock.Now())
+
+	s := newSession(cfg, result, conn)
+	rw := s.readWriter(counter)
+
+	if !ok && cfg.autoDetectWait > 0 {
+		protocolFactory, err = detectProtocol(ctx, conn, rw.Reader, cfg.autoDetectWait)
+		if err != nil {
+			return result, err
+		}
+
+		ok = protocolFactory != nil
+	}
+
 	if !ok {
 		// If the port is not recognized, we assume STARTTLS not required and return nil.
-		return nil
+		return result, nil
+	}
+
+	return negotiate(ctx, rw, protocolFactory(), s)
+}
+
+// StartTLSWithProtocol is like StartTLS but negotiates the given protocol
+// instead of looking it up by port, for services on non-standard ports such
+// as SMTP on 10025. Obtain protocol from Protocol, NewLineProtocol or
+// NewHTTPProtocol; a protocol value keeps per-connection state and must not
+// be reused for another connection.
+func StartTLSWithProtocol(ctx context.Context, conn io.ReadWriter, protocol StartTLSProtocol, opts ...Option) error {
+	result, err := NegotiateWithProtocol(ctx, conn, protocol, opts...)
+	if err != nil {
+		return err
+	}
+
+	return result.FallbackReason
+}
+
+// NegotiateWithProtocol is like Negotiate but negotiates the given protocol
+// instead of looking it up by port. See StartTLSWithProtocol.
+func NegotiateWithProtocol(ctx context.Context, conn io.ReadWriter, protocol StartTLSProtocol, opts ...Option) (*StartTLSResult, error) {
+	cfg := newConfig(opts)
+	result := &StartTLSResult{}
+
+	counter := &countingConn{ReadWriter: conn}
+	defer counter.report(result, cfg.clock, cfg.clock.Now())
+
+	s := newSession(cfg, result, conn)
+
+	return negotiate(ctx, s.readWriter(counter), protocol, s)
+}
+
+// negotiate runs the handshake of protocol, wrapped in the middleware, and
+// applies the options that act on its outcome.
+func negotiate(ctx context.Context, rw *bufio.ReadWriter, protocol StartTLSProtocol, s *session) (*StartTLSResult, error) {
+	cfg, result := s.cfg, s.result
+	result.Protocol = ProtocolID(protocol.Name())
+
+	err := applyMiddleware(cfg, protocol).Handshake(withSession(ctx, s), rw)
+
+	stepErr := err
+	if errors.Is(err, errProbeStopped) {
+		stepErr = nil
+	}
+
+	s.endStep(ctx, stepErr)
+
+	if stepErr != nil {
+		negErr := &NegotiationError{Protocol: result.Protocol, Step: s.step, Response: s.response, Err: err}
+		if cfg.transcript {
+			negErr.Transcript = s.transcript.snapshot()
+		}
+
+		err = negErr
+	}
+
+	result.auditCapabilities()
+
+	if cfg.probeOnly && (err == nil || errors.Is(err, errProbeStopped)) {
+		result.Probed = true
+
+		// After an accepted upgrade command the server expects a TLS
+		// handshake, so only a session stopped before it can be ended.
+		if q, ok := protocol.(quitCommander); ok && err != nil && !s.ended {
+			sendQuit(ctx, cfg.clock, rw, q.quitCommand())
+		}
+
+		return result, nil
+	}
+
+	if errors.Is(err, ErrStartTLSNotSupported) && cfg.observeRejection > 0 && !s.ended {
+		if n, ok := protocol.(noopCommander); ok {
+			result.RejectionBehavior = observeRejection(ctx, cfg.clock, rw, n.noopCommand(), cfg.observeRejection)
+		}
 	}
 
-	protocol := protocolFactory()
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if errors.Is(err, ErrStartTLSNotSupported) && cfg.opportunistic {
+		result.FallbackReason = err
+
+		return result, nil
+	}
+
+	if errors.Is(err, ErrStartTLSNotSupported) && (cfg.gracefulQuit || cfg.probeOnly) && !s.ended &&
+		result.RejectionBehavior != RejectionClosed && result.RejectionBehavior != RejectionHang {
+		if q, ok := protocol.(quitCommander); ok {
+			sendQuit(ctx, cfg.clock, rw, q.quitCommand())
+		}
+	}
+
+	result.TLSEstablished = err == nil
+
+	// Bytes the server sent after accepting the upgrade may already sit in
+	// the reader; keep them for StartTLSResult.Conn.
+	if result.TLSEstablished && rw.Reader.Buffered() > 0 {
+		pending, _ := rw.Reader.Peek(rw.Reader.Buffered())
+		result.pending = bytes.Clone(pending)
+	}
 
-	return protocol.Handshake(ctx, rw)
+	return result, err
 }
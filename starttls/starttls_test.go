@@ -2,11 +2,24 @@ package starttls
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/big"
 	"net"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,10 +39,12 @@ type testServer struct {
 // portMap maps protocol ports to high-numbered ports for testing.
 var portMap = map[string]string{
 	"21":   "10021", // FTP
+	"24":   "10024", // LMTP
 	"25":   "10025", // SMTP
 	"110":  "10110", // POP3
 	"143":  "10143", // IMAP
 	"3306": "13306", // MySQL
+	"4222": "14222", // NATS
 }
 
 func newTestServer(ctx context.Context, port string, messages []string) (*testServer, error) {
@@ -133,15 +148,17 @@ func (s *testServer) addr() string {
 }
 
 const (
-	serverMessagesStart        = "220 test.test.test server\r\n"
-	serverMessagesFTP          = "234 ready\r\n"
-	serverMessagesSMTP         = "250-test.test.test\r\n250 STARTTLS\r\n"
-	serverMessagesSMTPNoTLS    = "250-test.test.test\r\n250 NO-STARTTLS\r\n"
-	serverMessagesIMAP         = "* OK IMAP server ready\r\n"
-	serverMessagesIMAPSuccess  = "a001 OK Begin TLS negotiation now\r\n"
-	serverMessagesPOP3         = "+OK POP3 server ready\r\n"
-	serverMessagesPOP3Success  = "+OK Begin TLS negotiation\r\n"
-	serverMessagesNotSupported = "500 Not supported\r\n"
+	serverMessagesStart          = "220 test.test.test server\r\n"
+	serverMessagesFTP            = "234 ready\r\n"
+	serverMessagesSMTP           = "250-test.test.test\r\n250 STARTTLS\r\n"
+	serverMessagesSMTPNoTLS      = "250-test.test.test\r\n250 NO-STARTTLS\r\n"
+	serverMessagesIMAP           = "* OK IMAP server ready\r\n"
+	serverMessagesIMAPSuccess    = "a001 OK Begin TLS negotiation now\r\n"
+	serverMessagesIMAPCapability = "* CAPABILITY IMAP4rev1 STARTTLS\r\na001 OK CAPABILITY completed\r\n"
+	serverMessagesPOP3           = "+OK POP3 server ready\r\n"
+	serverMessagesPOP3Success    = "+OK Begin TLS negotiation\r\n"
+	serverMessagesPOP3Capa       = "+OK Capability list follows\r\nTOP\r\nUIDL\r\nSASL PLAIN\r\nSTLS\r\n.\r\n"
+	serverMessagesNotSupported   = "500 Not supported\r\n"
 )
 
 func TestStartTLS(t *testing.T) {
@@ -177,7 +194,8 @@ func TestStartTLS(t *testing.T) {
 			port: "143",
 			serverMessages: []string{
 				serverMessagesIMAP,
-				serverMessagesIMAPSuccess,
+				serverMessagesIMAPCapability,
+				"a002 OK Begin TLS negotiation now\r\n",
 			},
 			timeout: 2 * time.Second,
 		},
@@ -186,6 +204,7 @@ func TestStartTLS(t *testing.T) {
 			port: "110",
 			serverMessages: []string{
 				serverMessagesPOP3,
+				serverMessagesPOP3Capa,
 				serverMessagesPOP3Success,
 			},
 			timeout: 2 * time.Second,
@@ -207,14 +226,13 @@ func TestStartTLS(t *testing.T) {
 			port: "3306",
 			serverMessages: []string{
 				string([]byte{
-					0x31, 0x00, 0x00, 0x00, // Packet length (49 bytes) and sequence number 0
+					0x3c, 0x00, 0x00, 0x00, // Packet length (60 bytes) and sequence number 0
 					0x0a,                          // Protocol version (10)
 					'5', '.', '7', '.', '0', 0x00, // Server version (null terminated)
 					0x01, 0x02, 0x03, 0x04, // Thread ID
 					'1', '2', '3', '4', '5', '6', '7', '8', // Salt part 1
-					0x00,       // null terminator
 					0x00,       // Filler
-					0x00, 0x08, // Capability flags lower (includes SERVER_SSL 0x800)
+					0x00, 0x0a, // Capability flags lower (SERVER_SSL 0x800 and PROTOCOL_41 0x200)
 					0x21,       // Character set
 					0x02, 0x00, // Status flags
 					0x00, 0x00, // Capability flags upper
@@ -230,12 +248,11 @@ func TestStartTLS(t *testing.T) {
 			port: "3306",
 			serverMessages: []string{
 				string([]byte{
-					0x31, 0x00, 0x00, 0x00, // Packet length (49 bytes) and sequence number 0
+					0x3c, 0x00, 0x00, 0x00, // Packet length (60 bytes) and sequence number 0
 					0x0a,                          // Protocol version (10)
 					'5', '.', '7', '.', '0', 0x00, // Server version (null terminated)
 					0x01, 0x02, 0x03, 0x04, // Thread ID
 					'1', '2', '3', '4', '5', '6', '7', '8', // Salt part 1
-					0x00,       // null terminator
 					0x00,       // Filler
 					0x00, 0x00, // Capability flags lower (no SERVER_SSL flag)
 					0x21,       // Character set
@@ -319,7 +336,7 @@ func TestStartTLS(t *testing.T) {
 }
 
 func TestDirectTLSPorts(t *testing.T) {
-	directTLSPorts := []string{"443", "465", "993", "995", "3389", "8443", "9443"}
+	directTLSPorts := []string{"443", "465", "990", "993", "995", "3389", "8443", "9443"}
 
 	for _, port := range directTLSPorts {
 		t.Run(fmt.Sprintf("port_%s", port), func(t *testing.T) {
@@ -329,8 +346,18 @@ func TestDirectTLSPorts(t *testing.T) {
 			if err != nil {
 				t.Errorf("Expected nil error for direct TLS port %s, got: %v", port, err)
 			}
+
+			result, err := Negotiate(ctx, nil, port)
+			if err != nil || !result.ImplicitTLS {
+				t.Errorf("Expected implicit TLS for port %s, got %+v, %v", port, result, err)
+			}
 		})
 	}
+
+	result, err := Negotiate(context.Background(), nil, "8080")
+	if err != nil || result.ImplicitTLS {
+		t.Errorf("Expected unknown port not to be implicit TLS, got %+v, %v", result, err)
+	}
 }
 
 func TestTimeout(t *testing.T) {
@@ -380,3 +407,1966 @@ func TestTimeout(t *testing.T) {
 		t.Errorf("Expected context deadline exceeded error, got: %v", err)
 	}
 }
+
+// negotiateWithServer runs Negotiate against a scripted test server.
+func negotiateWithServer(t *testing.T, port string, messages []string, opts ...Option) (*StartTLSResult, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	server, err := newTestServer(ctx, port, messages)
+	if err != nil {
+		t.Fatalf("Failed to create test server: %v", err)
+	}
+
+	t.Cleanup(func() { server.stop() })
+
+	server.start(ctx)
+
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "tcp", server.addr())
+	if err != nil {
+		t.Fatalf("Failed to connect to test server: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return Negotiate(ctx, conn, port, opts...)
+}
+
+func TestRejectionObservation(t *testing.T) {
+	rejected := []string{
+		serverMessagesStart,
+		serverMessagesSMTP,
+		"454 TLS not available due to temporary reason\r\n",
+	}
+
+	tests := []struct {
+		name     string
+		extra    []string
+		expected RejectionBehavior
+	}{
+		{name: "closed", expected: RejectionClosed},
+		{name: "open", extra: []string{"250 OK\r\n"}, expected: RejectionOpen},
+		{name: "hang", extra: []string{hangMessage}, expected: RejectionHang},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := append(append([]string{}, rejected...), tt.extra...)
+
+			result, err := negotiateWithServer(t, "25", messages, WithRejectionObservation(200*time.Millisecond))
+			if !errors.Is(err, ErrStartTLSNotSupported) {
+				t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+			}
+
+			if result.RejectionBehavior != tt.expected {
+				t.Errorf("Expected behavior %v, got %v", tt.expected, result.RejectionBehavior)
+			}
+		})
+	}
+}
+
+func TestRejectionNotObservedByDefault(t *testing.T) {
+	result, err := negotiateWithServer(t, "25", []string{
+		serverMessagesStart,
+		serverMessagesSMTP,
+		serverMessagesNotSupported,
+	})
+	if !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+	}
+
+	if result.RejectionBehavior != RejectionNotObserved {
+		t.Errorf("Expected no observation, got %v", result.RejectionBehavior)
+	}
+}
+
+func TestSanitizeResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "plain", input: "500 Not supported\r\n", expected: "500 Not supported"},
+		{name: "escape sequence", input: "500 \x1b[2Jcleared\r\n", expected: "500 [2Jcleared"},
+		{name: "invalid utf8", input: "500 bad\xff\xfe bytes", expected: "500 bad bytes"},
+		{name: "unicode kept", input: "500 caf\u00e9", expected: "500 caf\u00e9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeResponse(tt.input); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		got := sanitizeResponse(strings.Repeat("A", 10*maxResponseText))
+		if len(got) != maxResponseText+len("...") || !strings.HasSuffix(got, "...") {
+			t.Errorf("Expected truncated text, got %d bytes", len(got))
+		}
+	})
+}
+
+func TestStartTLSErrorIsSanitized(t *testing.T) {
+	_, err := negotiateWithServer(t, "110", []string{
+		serverMessagesPOP3,
+		"-ERR \x1b]0;owned\x07 no\r\n",
+	})
+	if !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+	}
+
+	if strings.ContainsAny(err.Error(), "\x1b\x07") {
+		t.Errorf("Error contains control characters: %q", err.Error())
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for localhost.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestStartTLSOverTLSConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"}
+
+	lc := net.ListenConfig{}
+
+	listener, err := lc.Listen(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+
+		// Outer TLS session terminated in front of the SMTP backend.
+		outer := tls.Server(conn, serverConfig)
+		reader := bufio.NewReader(outer)
+
+		for i, msg := range []string{serverMessagesStart, serverMessagesSMTP, "220 ready for TLS\r\n"} {
+			if i > 0 {
+				if _, err := reader.ReadString('\n'); err != nil {
+					serverErr <- err
+					return
+				}
+			}
+
+			if _, err := outer.Write([]byte(msg)); err != nil {
+				serverErr <- err
+				return
+			}
+		}
+
+		serverErr <- tls.Server(outer, serverConfig).HandshakeContext(ctx)
+	}()
+
+	dialer := &tls.Dialer{Config: clientConfig}
+
+	conn, err := dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial outer TLS: %v", err)
+	}
+	defer conn.Close()
+
+	err = StartTLS(ctx, conn, "25")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	inner := tls.Client(conn, clientConfig)
+
+	err = inner.HandshakeContext(ctx)
+	if err != nil {
+		t.Fatalf("Inner TLS handshake failed: %v", err)
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Errorf("Server error: %v", err)
+	}
+}
+
+func TestOpportunistic(t *testing.T) {
+	rejected := []string{
+		serverMessagesStart,
+		serverMessagesSMTPNoTLS,
+		serverMessagesNotSupported,
+	}
+
+	t.Run("falls back", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "25", rejected, WithOpportunistic())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if result.TLSEstablished {
+			t.Error("Expected TLSEstablished to be false")
+		}
+
+		if !errors.Is(result.FallbackReason, ErrStartTLSNotSupported) {
+			t.Errorf("Expected fallback reason ErrStartTLSNotSupported, got: %v", result.FallbackReason)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "25", []string{
+			serverMessagesStart,
+			serverMessagesSMTP,
+			"220 ready for TLS\r\n",
+		}, WithOpportunistic())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if !result.TLSEstablished || result.FallbackReason != nil {
+			t.Errorf("Expected TLS established without fallback, got %+v", result)
+		}
+	})
+
+	t.Run("not opted in", func(t *testing.T) {
+		result, err := negotiateWithServer(t, "25", rejected)
+		if !errors.Is(err, ErrStartTLSNotSupported) {
+			t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+		}
+
+		if result.TLSEstablished {
+			t.Error("Expected TLSEstablished to be false")
+		}
+	})
+}
+
+// negotiateWithHandler runs Negotiate against an in-memory server driven by
+// handler, which is useful for binary protocols. The handler has returned by
+// the time negotiateWithHandler does.
+func negotiateWithHandler(t *testing.T, port string, handler func(conn net.Conn), opts ...Option) (*StartTLSResult, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer server.Close()
+
+		handler(server)
+	}()
+
+	result, err := Negotiate(ctx, client, port, opts...)
+
+	client.Close()
+	<-done
+
+	return result, err
+}
+
+func TestLMTPUsesLHLO(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	server, err := newTestServer(ctx, "24", []string{
+		"220 lmtp.test LMTP ready\r\n",
+		"250-lmtp.test\r\n250-PIPELINING\r\n250 STARTTLS\r\n",
+		"220 ready for TLS\r\n",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test server: %v", err)
+	}
+	defer server.stop()
+
+	server.start(ctx)
+
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "tcp", server.addr())
+	if err != nil {
+		t.Fatalf("Failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+
+	result, err := Negotiate(ctx, conn, "24")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := <-server.errors; err != nil {
+		t.Fatalf("Server error: %v", err)
+	}
+
+	if result.Protocol != "lmtp" {
+		t.Errorf("Expected protocol lmtp, got %q", result.Protocol)
+	}
+
+	if len(server.received) == 0 || !strings.HasPrefix(server.received[0], "LHLO ") {
+		t.Errorf("Expected LHLO command, got %q", server.received)
+	}
+}
+
+// mysqlHandshakeBody builds a protocol 10 handshake packet body.
+func mysqlHandshakeBody(version string, capabilities, mariaDBCapabilities uint32) []byte {
+	body := []byte{mysqlProtocolVersion}
+	body = append(body, version...)
+	body = append(body, 0x00)
+	body = append(body, 0x01, 0x02, 0x03, 0x04) // Thread ID
+	body = append(body, "12345678"...)          // Auth plugin data part 1
+	body = append(body, 0x00)                   // Filler
+	body = binary.LittleEndian.AppendUint16(body, uint16(capabilities))
+	body = append(body, utf8GeneralCI, 0x02, 0x00) // Character set and status flags
+	body = binary.LittleEndian.AppendUint16(body, uint16(capabilities>>16))
+	body = append(body, 21)               // Auth plugin data length
+	body = append(body, 0, 0, 0, 0, 0, 0) // Reserved
+	body = binary.LittleEndian.AppendUint32(body, mariaDBCapabilities)
+	body = append(body, "123456789012\x00"...) // Auth plugin data part 2
+	body = append(body, "mysql_native_password\x00"...)
+
+	return body
+}
+
+func TestParseHandshakePacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		expected MySQLHandshakeInfo
+	}{
+		{
+			name: "mysql 8",
+			body: mysqlHandshakeBody("8.0.36", 0xdfffffff, 0),
+			expected: MySQLHandshakeInfo{
+				ProtocolVersion: mysqlProtocolVersion,
+				ServerVersion:   "8.0.36",
+				ThreadID:        0x04030201,
+				Capabilities:    0xdfffffff,
+				CharacterSet:    utf8GeneralCI,
+				StatusFlags:     2,
+				AuthPluginName:  "mysql_native_password",
+				scramble:        "12345678123456789012",
+			},
+		},
+		{
+			name: "mariadb 10",
+			body: mysqlHandshakeBody("5.5.5-10.6.12-MariaDB", 0xa1fff7fe, 0x1d),
+			expected: MySQLHandshakeInfo{
+				ProtocolVersion:     mysqlProtocolVersion,
+				ServerVersion:       "10.6.12-MariaDB",
+				ThreadID:            0x04030201,
+				Capabilities:        0xa1fff7fe,
+				MariaDB:             true,
+				MariaDBCapabilities: 0x1d,
+				CharacterSet:        utf8GeneralCI,
+				StatusFlags:         2,
+				AuthPluginName:      "mysql_native_password",
+				scramble:            "12345678123456789012",
+			},
+		},
+		{
+			name: "no plugin auth",
+			body: mysqlHandshakeBody("5.1.73", clientSSL|clientProtocol41|clientSecureConn, 0),
+			expected: MySQLHandshakeInfo{
+				ProtocolVersion: mysqlProtocolVersion,
+				ServerVersion:   "5.1.73",
+				ThreadID:        0x04030201,
+				Capabilities:    clientSSL | clientProtocol41 | clientSecureConn,
+				CharacterSet:    utf8GeneralCI,
+				StatusFlags:     2,
+				scramble:        "12345678123456789012",
+			},
+		},
+		{
+			name: "minimal packet",
+			body: mysqlHandshakeBody("5.0.96", clientSSL, 0)[:24],
+			expected: MySQLHandshakeInfo{
+				ProtocolVersion: mysqlProtocolVersion,
+				ServerVersion:   "5.0.96",
+				ThreadID:        0x04030201,
+				Capabilities:    clientSSL,
+				scramble:        "12345678",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := newMySQLProtocol().parseHandshakePacket(tt.body)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if *info != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, *info)
+			}
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		_, err := newMySQLProtocol().parseHandshakePacket(nil)
+		if err == nil {
+			t.Error("Expected error for empty packet")
+		}
+	})
+}
+
+func TestSMTPSubmissionPorts(t *testing.T) {
+	for _, port := range []string{"25", "26", "587", "2525"} {
+		factory, ok := lookupPort(port)
+		if !ok {
+			t.Errorf("Port %s is not registered", port)
+			continue
+		}
+
+		if name := factory().Name(); name != "smtp" {
+			t.Errorf("Port %s: expected smtp, got %s", port, name)
+		}
+	}
+}
+
+func TestIMAPPreauth(t *testing.T) {
+	_, err := negotiateWithServer(t, "143", []string{
+		"* PREAUTH [CAPABILITY IMAP4rev1] logged in as user\r\n",
+		serverMessagesIMAPSuccess,
+	})
+	if !errors.Is(err, ErrIMAPPreauth) {
+		t.Fatalf("Expected ErrIMAPPreauth, got: %v", err)
+	}
+
+	if !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Errorf("Expected ErrStartTLSNotSupported, got: %v", err)
+	}
+}
+
+func TestSMTPAnonymousTLS(t *testing.T) {
+	exchangeEHLO := "250-exchange.test Hello\r\n250-X-ANONYMOUSTLS\r\n250 STARTTLS\r\n"
+
+	tests := []struct {
+		name            string
+		ehlo            string
+		opts            []Option
+		expectedCommand string
+	}{
+		{name: "option enabled", ehlo: exchangeEHLO, opts: []Option{WithSMTPAnonymousTLS()}, expectedCommand: "X-ANONYMOUSTLS"},
+		{name: "option disabled", ehlo: exchangeEHLO, expectedCommand: "STARTTLS"},
+		{name: "not advertised", ehlo: serverMessagesSMTP, opts: []Option{WithSMTPAnonymousTLS()}, expectedCommand: "STARTTLS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "25", []string{
+				serverMessagesStart,
+				tt.ehlo,
+				"220 2.0.0 SMTP server ready\r\n",
+			}, tt.opts...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if result.UpgradeCommand != tt.expectedCommand {
+				t.Errorf("Expected %s, got %s", tt.expectedCommand, result.UpgradeCommand)
+			}
+
+			caps, _ := ResultDetails[*SMTPCapabilities](result)
+			if caps.AnonymousTLS != (tt.ehlo == exchangeEHLO) {
+				t.Errorf("Unexpected AnonymousTLS %v", caps.AnonymousTLS)
+			}
+		})
+	}
+}
+
+func TestSMTPMailAuditPipelining(t *testing.T) {
+	tests := []struct {
+		name          string
+		ehloReply     string
+		groups        [][]string
+		replies       []string
+		expectedError error
+		expectedFind  string
+	}{
+		{
+			name:         "audit pipelined with starttls",
+			ehloReply:    "250-mail.test\r\n250-PIPELINING\r\n250 STARTTLS\r\n",
+			groups:       [][]string{{"MAIL FROM:<>", "RSET", "STARTTLS"}},
+			replies:      []string{"530 5.7.0 Must issue a STARTTLS command first\r\n250 OK\r\n220 2.0.0 Ready to start TLS\r\n"},
+			expectedFind: FindingMailRequiresTLS,
+		},
+		{
+			name:         "pipelining not advertised",
+			ehloReply:    "250-mail.test\r\n250 STARTTLS\r\n",
+			groups:       [][]string{{"MAIL FROM:<>"}, {"STARTTLS"}},
+			replies:      []string{"530 5.7.0 Must issue a STARTTLS command first\r\n", "220 2.0.0 Ready to start TLS\r\n"},
+			expectedFind: FindingMailRequiresTLS,
+		},
+		{
+			name:          "starttls not advertised",
+			ehloReply:     "250-mail.test\r\n250 PIPELINING\r\n",
+			groups:        [][]string{{"MAIL FROM:<>"}},
+			replies:       []string{"530 5.7.0 Must issue a STARTTLS command first\r\n"},
+			expectedError: ErrStartTLSNotAdvertised,
+			expectedFind:  FindingMailRequiresTLS,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received [][]string
+
+			result, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+				_, _ = conn.Write([]byte(serverMessagesStart))
+
+				r := bufio.NewReader(conn)
+
+				// EHLO is answered before anything else is sent.
+				ehlo, err := r.ReadString('\n')
+				if err != nil || !strings.HasPrefix(ehlo, "EHLO ") {
+					return
+				}
+
+				_, _ = conn.Write([]byte(tt.ehloReply))
+
+				// Every command of a group must arrive before the server
+				// replies to any of them.
+				for i, group := range tt.groups {
+					var commands []string
+
+					for range group {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+
+						commands = append(commands, strings.TrimSpace(line))
+					}
+
+					received = append(received, commands)
+					_, _ = conn.Write([]byte(tt.replies[i]))
+				}
+			}, WithSMTPMailAuditPipelining(), WithSMTPMailAudit())
+
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Expected error %v, got %v", tt.expectedError, err)
+			}
+
+			if fmt.Sprint(received) != fmt.Sprint(tt.groups) {
+				t.Errorf("Expected command groups %q, got %q", tt.groups, received)
+			}
+
+			if !slices.ContainsFunc(result.Findings, func(f Finding) bool { return f.ID == tt.expectedFind }) {
+				t.Errorf("Expected finding %s, got %+v", tt.expectedFind, result.Findings)
+			}
+
+			if _, ok := ResultDetails[*SMTPCapabilities](result); !ok {
+				t.Errorf("Expected the EHLO capabilities in %+v", result)
+			}
+
+			if tt.expectedError == nil && (!result.TLSEstablished || result.UpgradeCommand != "STARTTLS") {
+				t.Errorf("Unexpected result %+v", result)
+			}
+		})
+	}
+}
+
+func TestMySQLServerError(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		expected MySQLServerError
+	}{
+		{
+			name:     "host not allowed",
+			body:     append([]byte{mysqlErrPacket, 0x6a, 0x04}, "Host '10.0.0.1' is not allowed to connect to this MySQL server"...),
+			expected: MySQLServerError{Code: 1130, Message: "Host '10.0.0.1' is not allowed to connect to this MySQL server"},
+		},
+		{
+			name:     "with sql state",
+			body:     append([]byte{mysqlErrPacket, 0x10, 0x04}, "#08004Too many connections"...),
+			expected: MySQLServerError{Code: 1040, SQLState: "08004", Message: "Too many connections"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithHandler(t, "3306", func(conn net.Conn) {
+				packet := []byte{byte(len(tt.body)), 0x00, 0x00, 0x00}
+				_, _ = conn.Write(append(packet, tt.body...))
+			})
+
+			var serverErr *MySQLServerError
+			if !errors.As(err, &serverErr) {
+				t.Fatalf("Expected MySQLServerError, got %v", err)
+			}
+
+			if *serverErr != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, *serverErr)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		err := parseMySQLErrPacket([]byte{mysqlErrPacket, 0x6a})
+		if !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("Expected ErrInvalidResponse, got %v", err)
+		}
+	})
+}
+
+func TestReadMySQLPacketContinuation(t *testing.T) {
+	mysqlPacket := func(seq byte, body []byte) []byte {
+		header := []byte{byte(len(body)), byte(len(body) >> 8), byte(len(body) >> 16), seq}
+
+		return append(header, body...)
+	}
+
+	first := make([]byte, maxMySQLPacketSize)
+	first[0] = mysqlProtocolVersion
+
+	tests := []struct {
+		name          string
+		data          []byte
+		expectedLen   int
+		expectedError error
+	}{
+		{
+			name:        "single packet",
+			data:        mysqlPacket(0, []byte("handshake")),
+			expectedLen: len("handshake"),
+		},
+		{
+			name:        "continued payload",
+			data:        append(mysqlPacket(0, first), mysqlPacket(1, []byte("rest"))...),
+			expectedLen: maxMySQLPacketSize + len("rest"),
+		},
+		{
+			name:        "empty terminating packet",
+			data:        append(mysqlPacket(0, first), mysqlPacket(1, nil)...),
+			expectedLen: maxMySQLPacketSize,
+		},
+		{
+			name:          "out of sequence",
+			data:          append(mysqlPacket(0, first), mysqlPacket(5, []byte("rest"))...),
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(tt.data)), bufio.NewWriter(io.Discard))
+
+			body, err := newMySQLProtocol().readMySQLPacket(rw, 0)
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Errorf("Expected %v, got %v", tt.expectedError, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(body) != tt.expectedLen {
+				t.Errorf("Expected %d bytes, got %d", tt.expectedLen, len(body))
+			}
+		})
+	}
+}
+
+func TestMySQLLegacyServer(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            []byte
+		expectedVersion string
+		expectedProto   uint8
+	}{
+		{
+			name:            "protocol 9",
+			body:            append([]byte{mysqlLegacyVersion}, "3.22.32\x00\x01\x02\x03\x0412345678\x00"...),
+			expectedVersion: "3.22.32",
+			expectedProto:   mysqlLegacyVersion,
+		},
+		{
+			name:            "protocol 10 without 4.1 support",
+			body:            mysqlHandshakeBody("4.0.27", clientSSL, 0),
+			expectedVersion: "4.0.27",
+			expectedProto:   mysqlProtocolVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithHandler(t, "3306", func(conn net.Conn) {
+				packet := []byte{byte(len(tt.body)), 0x00, 0x00, 0x00}
+				_, _ = conn.Write(append(packet, tt.body...))
+			})
+
+			var legacyErr *MySQLLegacyServerError
+			if !errors.As(err, &legacyErr) {
+				t.Fatalf("Expected MySQLLegacyServerError, got %v", err)
+			}
+
+			if !errors.Is(err, ErrStartTLSNotSupported) {
+				t.Errorf("Expected error to match ErrStartTLSNotSupported")
+			}
+
+			if legacyErr.ServerVersion != tt.expectedVersion || legacyErr.ProtocolVersion != tt.expectedProto {
+				t.Errorf("Unexpected error fields %+v", *legacyErr)
+			}
+
+			if info, ok := ResultDetails[*MySQLHandshakeInfo](result); !ok || info.ServerVersion != tt.expectedVersion {
+				t.Errorf("Expected handshake details, got %+v", result.Details)
+			}
+		})
+	}
+}
+
+func TestSMTPStartTLSNotAdvertised(t *testing.T) {
+	tests := []struct {
+		name             string
+		ehlo             string
+		expectAdvertised bool
+	}{
+		{name: "not advertised", ehlo: "250-mail.test\r\n250-PIPELINING\r\n250 SIZE 1000\r\n"},
+		{name: "advertised but rejected", ehlo: serverMessagesSMTP, expectAdvertised: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+
+			result, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+				_, _ = conn.Write([]byte(serverMessagesStart))
+
+				r := bufio.NewReader(conn)
+				for _, reply := range []string{tt.ehlo, serverMessagesNotSupported} {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+			})
+
+			if !errors.Is(err, ErrStartTLSNotSupported) {
+				t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+			}
+
+			if errors.Is(err, ErrStartTLSNotAdvertised) == tt.expectAdvertised {
+				t.Errorf("Unexpected ErrStartTLSNotAdvertised match for %v", err)
+			}
+
+			if sent := containsFold(commands, "STARTTLS"); sent != tt.expectAdvertised {
+				t.Errorf("Expected STARTTLS sent %v, got commands %q", tt.expectAdvertised, commands)
+			}
+
+			if caps, ok := ResultDetails[*SMTPCapabilities](result); !ok || len(caps.Extensions) == 0 {
+				t.Errorf("Expected EHLO extensions in result, got %+v", result.Details)
+			}
+		})
+	}
+}
+
+func TestSMTPMultilineEHLOAcrossSegments(t *testing.T) {
+	result, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+		_, _ = conn.Write([]byte(serverMessagesStart))
+
+		r := bufio.NewReader(conn)
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+
+		// Each line arrives in its own segment, leaving the client's
+		// buffer empty in the middle of the reply.
+		for _, segment := range []string{"250-mail.test\r\n", "250-SIZE 1000\r\n", "250-PIPEL", "INING\r\n", "250 STARTTLS\r\n"} {
+			_, _ = conn.Write([]byte(segment))
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+
+		_, _ = conn.Write([]byte("220 ready for TLS\r\n"))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	caps, _ := ResultDetails[*SMTPCapabilities](result)
+	if got := strings.Join(caps.Keywords(), ","); got != "SIZE,PIPELINING,STARTTLS" {
+		t.Errorf("Unexpected keywords %s", got)
+	}
+}
+
+func TestSMTPMultilineGreeting(t *testing.T) {
+	tests := []struct {
+		name          string
+		greeting      string
+		expectedError error
+	}{
+		{
+			name:     "multiline banner",
+			greeting: "220-mail.test ESMTP\r\n220-Unauthorized access prohibited\r\n220 mail.test ready\r\n",
+		},
+		{
+			name:          "service not available",
+			greeting:      "554-mail.test\r\n554 no SMTP service here\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "mixed reply codes",
+			greeting:      "220-mail.test ESMTP\r\n250 ready\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+
+			_, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+				_, _ = conn.Write([]byte(tt.greeting))
+
+				r := bufio.NewReader(conn)
+				for _, reply := range []string{serverMessagesSMTP, "220 ready for TLS\r\n"} {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+			})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected %v, got: %v", tt.expectedError, err)
+				}
+
+				if len(commands) != 0 {
+					t.Errorf("Expected no commands, got %q", commands)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(commands) != 2 || commands[1] != "STARTTLS" {
+				t.Errorf("Unexpected commands %q", commands)
+			}
+		})
+	}
+}
+
+func TestIMAPCapabilityCheck(t *testing.T) {
+	tests := []struct {
+		name             string
+		greeting         string
+		replies          []string
+		expectedCommands []string
+		expectedError    error
+	}{
+		{
+			name:             "capabilities requested",
+			greeting:         serverMessagesIMAP,
+			replies:          []string{serverMessagesIMAPCapability, "a002 OK Begin TLS negotiation now\r\n"},
+			expectedCommands: []string{"a001 CAPABILITY", "a002 STARTTLS"},
+		},
+		{
+			name:             "requested capabilities lack starttls",
+			greeting:         serverMessagesIMAP,
+			replies:          []string{"* CAPABILITY IMAP4rev1 LOGINDISABLED\r\na001 OK done\r\n"},
+			expectedCommands: []string{"a001 CAPABILITY"},
+			expectedError:    ErrStartTLSNotAdvertised,
+		},
+		{
+			name:          "greeting capabilities lack starttls",
+			greeting:      "* OK [CAPABILITY IMAP4rev1 AUTH=PLAIN] ready\r\n",
+			expectedError: ErrStartTLSNotAdvertised,
+		},
+		{
+			name:             "capability rejected",
+			greeting:         serverMessagesIMAP,
+			replies:          []string{"a001 BAD unknown command\r\n"},
+			expectedCommands: []string{"a001 CAPABILITY"},
+			expectedError:    ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+
+			_, err := negotiateWithHandler(t, "143", func(conn net.Conn) {
+				_, _ = conn.Write([]byte(tt.greeting))
+
+				r := bufio.NewReader(conn)
+				for _, reply := range tt.replies {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+
+				// Record anything else the client sends before closing.
+				line, err := r.ReadString('\n')
+				if err == nil {
+					commands = append(commands, strings.TrimSpace(line))
+				}
+			})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if strings.Join(commands, ",") != strings.Join(tt.expectedCommands, ",") {
+				t.Errorf("Expected commands %q, got %q", tt.expectedCommands, commands)
+			}
+		})
+	}
+}
+
+func TestIMAPTagPrefix(t *testing.T) {
+	tests := []struct {
+		name             string
+		prefix           string
+		startTLSReply    string
+		expectedCommands []string
+		expectError      bool
+	}{
+		{
+			name:             "custom prefix",
+			prefix:           "scan",
+			startTLSReply:    "scan002 OK Begin TLS negotiation now\r\n",
+			expectedCommands: []string{"scan001 CAPABILITY", "scan002 STARTTLS"},
+		},
+		{
+			name:             "reply to another tag",
+			prefix:           "scan",
+			startTLSReply:    "a002 OK Begin TLS negotiation now\r\n",
+			expectedCommands: []string{"scan001 CAPABILITY", "scan002 STARTTLS"},
+			expectError:      true,
+		},
+		{
+			name:        "invalid prefix",
+			prefix:      "a b",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+
+			_, err := negotiateWithHandler(t, "143", func(conn net.Conn) {
+				_, _ = conn.Write([]byte(serverMessagesIMAP))
+
+				r := bufio.NewReader(conn)
+				for _, reply := range []string{"* CAPABILITY IMAP4rev1 STARTTLS\r\n" + tt.prefix + "001 OK done\r\n", tt.startTLSReply} {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+			}, WithIMAPTagPrefix(tt.prefix))
+
+			if (err != nil) != tt.expectError {
+				t.Fatalf("Expected error %v, got: %v", tt.expectError, err)
+			}
+
+			if strings.Join(commands, ",") != strings.Join(tt.expectedCommands, ",") {
+				t.Errorf("Expected commands %q, got %q", tt.expectedCommands, commands)
+			}
+		})
+	}
+}
+
+func TestIMAPUntaggedResponses(t *testing.T) {
+	tests := []struct {
+		name          string
+		reply         string
+		expectedError error
+	}{
+		{
+			name:  "untagged lines before tagged ok",
+			reply: "* OK [ALERT] maintenance tonight\r\n* CAPABILITY IMAP4rev1 STARTTLS\r\na001 OK Begin TLS negotiation now\r\n",
+		},
+		{
+			name:          "tagged no",
+			reply:         "* OK [ALERT] TLS temporarily unavailable\r\na001 NO STARTTLS unavailable\r\n",
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "tagged bad",
+			reply:         "a001 BAD unknown command\r\n",
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "continuation request",
+			reply:         "+ go ahead\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := negotiateWithServer(t, "143", []string{
+				"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n",
+				tt.reply,
+			})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected %v, got: %v", tt.expectedError, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !result.TLSEstablished || result.UpgradeCommand != "STARTTLS" {
+				t.Errorf("Unexpected result %+v", result)
+			}
+		})
+	}
+}
+
+func TestPOP3CapaCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		capa          string
+		expectedError error
+		expectSTLS    bool
+	}{
+		{name: "stls advertised", capa: serverMessagesPOP3Capa, expectSTLS: true},
+		{name: "stls missing", capa: "+OK\r\nTOP\r\nUIDL\r\n.\r\n", expectedError: ErrStartTLSNotAdvertised},
+		{name: "capa unsupported", capa: "-ERR unknown command\r\n", expectedError: ErrStartTLSNotAdvertised},
+		{name: "byte-stuffed line", capa: "+OK\r\n..X-DOT\r\nSTLS\r\n.\r\n", expectSTLS: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+
+			_, err := negotiateWithHandler(t, "110", func(conn net.Conn) {
+				_, _ = conn.Write([]byte(serverMessagesPOP3))
+
+				r := bufio.NewReader(conn)
+				for _, reply := range []string{tt.capa, serverMessagesPOP3Success} {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+			})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) || !errors.Is(err, ErrStartTLSNotSupported) {
+					t.Fatalf("Expected %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if containsFold(commands, "STLS") != tt.expectSTLS {
+				t.Errorf("Unexpected commands %q", commands)
+			}
+		})
+	}
+}
+
+func TestFTPMultilineReplies(t *testing.T) {
+	tests := []struct {
+		name          string
+		greeting      string
+		authReply     string
+		expectedError error
+	}{
+		{
+			name:      "multiline banner",
+			greeting:  "220-Welcome to ftp.test\r\n220-\r\n 234 users online\r\n220 ready\r\n",
+			authReply: "234 AUTH TLS OK\r\n",
+		},
+		{
+			name:      "delayed service",
+			greeting:  "120 ready in 1 minute\r\n220 ready\r\n",
+			authReply: "234 AUTH TLS OK\r\n",
+		},
+		{
+			name:      "multiline auth reply",
+			greeting:  "220 ready\r\n",
+			authReply: "234-Using TLS\r\n234 proceed\r\n",
+		},
+		{
+			name:          "multiline rejection",
+			greeting:      "220 ready\r\n",
+			authReply:     "500-AUTH not understood\r\n234 is not the code\r\n500 end\r\n",
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "service not available",
+			greeting:      "421 too many connections\r\n",
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, "21", []string{tt.greeting, tt.authReply})
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected %v, got: %v", tt.expectedError, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMySQLSSLRequestOptions(t *testing.T) {
+	tests := []struct {
+		name            string
+		opts            []Option
+		expectedFlags   uint32
+		expectedCharset byte
+		expectedMaxSize uint32
+	}{
+		{
+			name:            "defaults",
+			expectedFlags:   clientSSL | clientProtocol41 | clientSecureConn,
+			expectedCharset: utf8GeneralCI,
+			expectedMaxSize: maxMySQLPacketSize,
+		},
+		{
+			name:            "custom",
+			opts:            []Option{WithMySQLClientFlags(0x00080000), WithMySQLCharset(45), WithMySQLMaxPacketSize(1 << 24)},
+			expectedFlags:   clientSSL | clientProtocol41 | 0x00080000,
+			expectedCharset: 45,
+			expectedMaxSize: 1 << 24,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := make([]byte, 36)
+
+			_, err := negotiateWithHandler(t, "3306", func(conn net.Conn) {
+				body := mysqlHandshakeBody("8.0.36", clientSSL|clientProtocol41|clientSecureConn, 0)
+				_, _ = conn.Write(append([]byte{byte(len(body)), 0x00, 0x00, 0x00}, body...))
+				_, _ = io.ReadFull(conn, request)
+			}, tt.opts...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if flags := binary.LittleEndian.Uint32(request[4:8]); flags != tt.expectedFlags {
+				t.Errorf("Expected flags 0x%08x, got 0x%08x", tt.expectedFlags, flags)
+			}
+
+			if maxSize := binary.LittleEndian.Uint32(request[8:12]); maxSize != tt.expectedMaxSize {
+				t.Errorf("Expected max packet size %d, got %d", tt.expectedMaxSize, maxSize)
+			}
+
+			if request[12] != tt.expectedCharset {
+				t.Errorf("Expected charset %d, got %d", tt.expectedCharset, request[12])
+			}
+		})
+	}
+}
+
+func TestMySQLFramingErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected MySQLFramingError
+	}{
+		{
+			name:     "short payload",
+			data:     append([]byte{0x3c, 0x00, 0x00, 0x00}, "5.7.0\x00"...),
+			expected: MySQLFramingError{Length: 0x3c, Read: 6},
+		},
+		{
+			name:     "missing payload",
+			data:     []byte{0x3c, 0x00, 0x00, 0x00},
+			expected: MySQLFramingError{Length: 0x3c},
+		},
+		{
+			name:     "wrong sequence",
+			data:     append([]byte{0x06, 0x00, 0x00, 0x03}, "5.7.0\x00"...),
+			expected: MySQLFramingError{Sequence: 3, Length: 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(tt.data)), bufio.NewWriter(io.Discard))
+
+			_, err := newMySQLProtocol().readMySQLPacket(rw, 0)
+
+			var framingErr *MySQLFramingError
+			if !errors.As(err, &framingErr) {
+				t.Fatalf("Expected MySQLFramingError, got %v", err)
+			}
+
+			if *framingErr != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, *framingErr)
+			}
+
+			if !errors.Is(err, ErrInvalidResponse) {
+				t.Errorf("Expected error to match ErrInvalidResponse")
+			}
+		})
+	}
+
+	t.Run("ssl request continues the sequence", func(t *testing.T) {
+		p := newMySQLProtocol()
+		first := make([]byte, maxMySQLPacketSize)
+		data := append([]byte{0xff, 0xff, 0xff, 0x00}, first...)
+		data = append(data, 0x00, 0x00, 0x00, 0x01)
+		rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(data)), bufio.NewWriter(io.Discard))
+
+		_, err := p.readMySQLPacket(rw, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if seq := p.createSSLRequestPacket(&config{})[3]; seq != 2 {
+			t.Errorf("Expected SSL request sequence 2, got %d", seq)
+		}
+	})
+}
+
+func TestMySQLConnectAttrs(t *testing.T) {
+	got := appendMySQLConnectAttrs(nil, map[string]string{"program_name": "scanner", "_client_name": "starttls-go"})
+
+	expected := []byte{46}
+	expected = append(expected, 12)
+	expected = append(expected, "_client_name"...)
+	expected = append(expected, 11)
+	expected = append(expected, "starttls-go"...)
+	expected = append(expected, 12)
+	expected = append(expected, "program_name"...)
+	expected = append(expected, 7)
+	expected = append(expected, "scanner"...)
+
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	for n, prefix := range map[uint64][]byte{
+		0xfa:    {0xfa},
+		0xfb:    {0xfc, 0xfb, 0x00},
+		0x10000: {0xfd, 0x00, 0x00, 0x01},
+		1 << 24: {0xfe, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+	} {
+		if got := appendMySQLLengthEncodedInt(nil, n); !bytes.Equal(got, prefix) {
+			t.Errorf("Length-encoded %d: expected %x, got %x", n, prefix, got)
+		}
+	}
+
+	flags := binary.LittleEndian.Uint32(newMySQLProtocol().createSSLRequestPacket(newConfig([]Option{
+		WithMySQLConnectAttrs(map[string]string{"program_name": "scanner"}),
+	}))[4:8])
+	if flags&clientConnectAttrs == 0 {
+		t.Errorf("Expected CLIENT_CONNECT_ATTRS in flags 0x%08x", flags)
+	}
+}
+
+func TestGracefulQuit(t *testing.T) {
+	tests := []struct {
+		name         string
+		port         string
+		greeting     string
+		replies      []string
+		opts         []Option
+		expectedLast string
+	}{
+		{
+			name:         "smtp quit",
+			port:         "25",
+			greeting:     serverMessagesStart,
+			replies:      []string{serverMessagesSMTPNoTLS, "221 bye\r\n"},
+			opts:         []Option{WithGracefulQuit()},
+			expectedLast: "QUIT",
+		},
+		{
+			name:         "imap logout",
+			port:         "143",
+			greeting:     "* OK [CAPABILITY IMAP4rev1] ready\r\n",
+			replies:      []string{"* BYE logging out\r\na001 OK LOGOUT completed\r\n"},
+			opts:         []Option{WithGracefulQuit()},
+			expectedLast: "a001 LOGOUT",
+		},
+		{
+			name:         "pop3 quit after rejection",
+			port:         "110",
+			greeting:     serverMessagesPOP3,
+			replies:      []string{serverMessagesPOP3Capa, "-ERR not now\r\n", "+OK bye\r\n"},
+			opts:         []Option{WithGracefulQuit()},
+			expectedLast: "QUIT",
+		},
+		{
+			name:         "disabled",
+			port:         "25",
+			greeting:     serverMessagesStart,
+			replies:      []string{serverMessagesSMTPNoTLS, "221 bye\r\n"},
+			expectedLast: "EHLO tlstools.com",
+		},
+		{
+			name:         "opportunistic",
+			port:         "25",
+			greeting:     serverMessagesStart,
+			replies:      []string{serverMessagesSMTPNoTLS, "221 bye\r\n"},
+			opts:         []Option{WithGracefulQuit(), WithOpportunistic()},
+			expectedLast: "EHLO tlstools.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+
+			_, _ = negotiateWithHandler(t, tt.port, func(conn net.Conn) {
+				_, _ = conn.Write([]byte(tt.greeting))
+
+				r := bufio.NewReader(conn)
+				for _, reply := range tt.replies {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+			}, tt.opts...)
+
+			if len(commands) == 0 || commands[len(commands)-1] != tt.expectedLast {
+				t.Errorf("Expected last command %q, got %q", tt.expectedLast, commands)
+			}
+		})
+	}
+}
+
+func TestProbeOnly(t *testing.T) {
+	tests := []struct {
+		name             string
+		port             string
+		greeting         string
+		replies          []string
+		confirm          bool
+		expectedCommands []string
+		expectProbed     bool
+	}{
+		{
+			name:             "smtp advertised",
+			port:             "25",
+			greeting:         serverMessagesStart,
+			replies:          []string{serverMessagesSMTP, "221 bye\r\n"},
+			expectedCommands: []string{"EHLO tlstools.com", "QUIT"},
+			expectProbed:     true,
+		},
+		{
+			name:             "smtp confirmed",
+			port:             "25",
+			greeting:         serverMessagesStart,
+			replies:          []string{serverMessagesSMTP, "220 ready for TLS\r\n"},
+			confirm:          true,
+			expectedCommands: []string{"EHLO tlstools.com", "STARTTLS"},
+			expectProbed:     true,
+		},
+		{
+			name:             "smtp not advertised",
+			port:             "25",
+			greeting:         serverMessagesStart,
+			replies:          []string{serverMessagesSMTPNoTLS, "221 bye\r\n"},
+			expectedCommands: []string{"EHLO tlstools.com", "QUIT"},
+		},
+		{
+			name:             "imap advertised",
+			port:             "143",
+			greeting:         "* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] ready\r\n",
+			replies:          []string{"* BYE logging out\r\na001 OK LOGOUT completed\r\n"},
+			expectedCommands: []string{"a001 LOGOUT"},
+			expectProbed:     true,
+		},
+		{
+			name:             "ftp without features",
+			port:             "21",
+			greeting:         "220 ftp.test ready\r\n",
+			replies:          []string{serverMessagesFTP},
+			expectedCommands: []string{"AUTH TLS"},
+			expectProbed:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+
+			result, err := negotiateWithHandler(t, tt.port, func(conn net.Conn) {
+				_, _ = conn.Write([]byte(tt.greeting))
+
+				r := bufio.NewReader(conn)
+				for _, reply := range tt.replies {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					commands = append(commands, strings.TrimSpace(line))
+					_, _ = conn.Write([]byte(reply))
+				}
+			}, WithProbeOnly(tt.confirm))
+
+			if tt.expectProbed && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !tt.expectProbed && !errors.Is(err, ErrStartTLSNotSupported) {
+				t.Fatalf("Expected ErrStartTLSNotSupported, got: %v", err)
+			}
+
+			if result.Probed != tt.expectProbed || result.TLSEstablished {
+				t.Errorf("Expected Probed %v without TLS, got %+v", tt.expectProbed, result)
+			}
+
+			if !slices.Equal(commands, tt.expectedCommands) {
+				t.Errorf("Expected commands %q, got %q", tt.expectedCommands, commands)
+			}
+		})
+	}
+}
+
+func TestStepTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		upgradeDelay time.Duration
+		opts         []Option
+		expectError  bool
+	}{
+		{
+			name: "slow greeting within its limit",
+			opts: []Option{WithStepTimeout(StepGreeting, time.Second), WithStepTimeout(StepUpgrade, 50*time.Millisecond)},
+		},
+		{
+			name:        "slow greeting",
+			opts:        []Option{WithStepTimeout(StepGreeting, 50*time.Millisecond)},
+			expectError: true,
+		},
+		{
+			name:         "slow upgrade reply",
+			upgradeDelay: 100 * time.Millisecond,
+			opts:         []Option{WithStepTimeout(StepUpgrade, 50*time.Millisecond)},
+			expectError:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithHandler(t, "25", func(conn net.Conn) {
+				r := bufio.NewReader(conn)
+
+				time.Sleep(100 * time.Millisecond)
+				_, _ = conn.Write([]byte(serverMessagesStart))
+				_, _ = r.ReadString('\n')
+				_, _ = conn.Write([]byte(serverMessagesSMTP))
+				_, _ = r.ReadString('\n')
+				time.Sleep(tt.upgradeDelay)
+				_, _ = conn.Write([]byte("220 ready for TLS\r\n"))
+			}, tt.opts...)
+
+			if tt.expectError != errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected deadline exceeded %v, got: %v", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestMalformedGreetings(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     string
+		greeting string
+	}{
+		{name: "imap untagged junk", port: "143", greeting: "hello\r\n"},
+		{name: "imap unknown status", port: "143", greeting: "* NO try later\r\n"},
+		{name: "imap bye", port: "143", greeting: "* BYE too many connections\r\n"},
+		{name: "pop3 junk", port: "110", greeting: "hello\r\n"},
+		{name: "pop3 lowercase status", port: "110", greeting: "+ok ready\r\n"},
+		{name: "pop3 err", port: "110", greeting: "-ERR too many connections\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, tt.port, []string{tt.greeting})
+
+			if !errors.Is(err, ErrInvalidResponse) {
+				t.Errorf("Expected ErrInvalidResponse, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestStrictCRLF(t *testing.T) {
+	tests := []struct {
+		name          string
+		port          string
+		messages      []string
+		opts          []Option
+		expectedError error
+	}{
+		{
+			name:     "smtp bare lf lenient",
+			port:     "25",
+			messages: []string{"220 test server\n", "250-test\n250 STARTTLS\n", "220 go ahead\n"},
+		},
+		{
+			name:          "smtp bare lf strict",
+			port:          "25",
+			messages:      []string{"220 test server\r\n", "250-test\n250 STARTTLS\r\n", "220 go ahead\r\n"},
+			opts:          []Option{WithStrictCRLF()},
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:     "smtp crlf strict",
+			port:     "25",
+			messages: []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart},
+			opts:     []Option{WithStrictCRLF()},
+		},
+		{
+			name:          "imap bare lf strict",
+			port:          "143",
+			messages:      []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\n"},
+			opts:          []Option{WithStrictCRLF()},
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "pop3 bare lf strict",
+			port:          "110",
+			messages:      []string{serverMessagesPOP3, "+OK\r\nSTLS\n.\r\n"},
+			opts:          []Option{WithStrictCRLF()},
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, tt.port, tt.messages, tt.opts...)
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStrictMatching(t *testing.T) {
+	tests := []struct {
+		name          string
+		port          string
+		messages      []string
+		opts          []Option
+		expectedError error
+	}{
+		{
+			name:          "smtp malformed code lenient",
+			port:          "25",
+			messages:      []string{"220 test server\r\n", "250-test\r\n250 STARTTLS\r\n", "2x0 go ahead\r\n"},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "smtp malformed code strict",
+			port:          "587",
+			messages:      []string{"220 test server\r\n", "250-test\r\n250 STARTTLS\r\n", "2x0 go ahead\r\n"},
+			opts:          []Option{WithStrictMatching()},
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "smtp code without separator strict",
+			port:          "2525",
+			messages:      []string{"220test server\r\n"},
+			opts:          []Option{WithStrictMatching()},
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "smtp positive reply to starttls lenient",
+			port:          "26",
+			messages:      []string{serverMessagesStart, serverMessagesSMTP, "250 ok\r\n"},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:          "lmtp positive reply to starttls strict",
+			port:          "24",
+			messages:      []string{serverMessagesStart, serverMessagesSMTP, "250 ok\r\n"},
+			opts:          []Option{WithStrictMatching()},
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:          "smtp refused strict",
+			port:          "465",
+			messages:      []string{serverMessagesStart, serverMessagesSMTP, "454 TLS not available\r\n"},
+			opts:          []Option{WithStrictMatching(), WithPortMap(map[string]ProtocolID{"465": "smtp"})},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:     "smtp established strict",
+			port:     "10025",
+			messages: []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart},
+			opts:     []Option{WithStrictMatching(), WithPortMap(map[string]ProtocolID{"10025": "smtp"})},
+		},
+		{
+			name:          "ftp positive reply to auth tls strict",
+			port:          "21",
+			messages:      []string{"220 ftp ready\r\n", "200 ok\r\n"},
+			opts:          []Option{WithStrictMatching()},
+			expectedError: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, tt.port, tt.messages, tt.opts...)
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		name          string
+		port          string
+		messages      []string
+		opts          []Option
+		expectedError error
+	}{
+		{
+			name:     "smtp lone continuation greeting matched",
+			port:     "587",
+			messages: []string{"220-appliance\r\n", serverMessagesSMTP, serverMessagesStart},
+			opts:     []Option{WithGreetingMatcher(regexp.MustCompile(`^220`).MatchString)},
+		},
+		{
+			name:     "smtp nonstandard reply matched",
+			port:     "2525",
+			messages: []string{serverMessagesStart, serverMessagesSMTP, "200 go ahead\r\n"},
+			opts:     []Option{WithResponseMatcher(regexp.MustCompile(`^2\d\d `).MatchString)},
+		},
+		{
+			name:          "pop3 nonstandard reply",
+			port:          "110",
+			messages:      []string{serverMessagesPOP3, "+OK\r\nSTLS\r\n.\r\n", "OK begin TLS\r\n"},
+			expectedError: ErrInvalidResponse,
+		},
+		{
+			name:     "pop3 nonstandard reply matched",
+			port:     "995",
+			messages: []string{serverMessagesPOP3, "+OK\r\nSTLS\r\n.\r\n", "OK begin TLS\r\n"},
+			opts: []Option{
+				WithPortMap(map[string]ProtocolID{"995": "pop3"}),
+				WithResponseMatcher(func(line string) bool { return strings.HasPrefix(line, "OK") }),
+			},
+		},
+		{
+			name:          "imap reply rejected by matcher",
+			port:          "143",
+			messages:      []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n", "a001 OK go ahead\r\n"},
+			opts:          []Option{WithResponseMatcher(regexp.MustCompile(`Begin TLS`).MatchString)},
+			expectedError: ErrStartTLSNotSupported,
+		},
+		{
+			name:     "ftp greeting and reply matched",
+			port:     "21",
+			messages: []string{"ready for you\r\n", "200 AUTH TLS OK\r\n"},
+			opts: []Option{
+				WithGreetingMatcher(regexp.MustCompile(`^ready`).MatchString),
+				WithResponseMatcher(regexp.MustCompile(`^2\d\d `).MatchString),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := negotiateWithServer(t, tt.port, tt.messages, tt.opts...)
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("Expected error %v, got: %v", tt.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// loggedProtocol wraps a protocol the way logging middleware would.
+type loggedProtocol struct {
+	StartTLSProtocol
+	calls int
+}
+
+func (p *loggedProtocol) Handshake(ctx context.Context, rw *bufio.ReadWriter) error {
+	p.calls++
+
+	return p.StartTLSProtocol.Handshake(ctx, rw)
+}
+
+func TestProtocolConstructors(t *testing.T) {
+	constructors := map[string]func() StartTLSProtocol{
+		"smtp":  NewSMTPProtocol,
+		"imap":  NewIMAPProtocol,
+		"pop3":  NewPOP3Protocol,
+		"ftp":   NewFTPProtocol,
+		"mysql": NewMySQLProtocol,
+	}
+
+	for name, constructor := range constructors {
+		if got := constructor().Name(); got != name {
+			t.Errorf("Expected protocol %s, got %s", name, got)
+		}
+	}
+
+	logged := &loggedProtocol{StartTLSProtocol: NewSMTPProtocol()}
+
+	Register("logged-smtp", []string{"10026"}, func() StartTLSProtocol { return logged })
+	t.Cleanup(func() { Unregister("logged-smtp") })
+
+	result, err := negotiateWithServer(t, "10026", []string{serverMessagesStart, serverMessagesSMTP, serverMessagesStart})
+	if err != nil || !result.TLSEstablished || logged.calls != 1 {
+		t.Errorf("Expected the wrapped protocol to negotiate once, got %+v, %d calls, %v", result, logged.calls, err)
+	}
+}
+
+func TestNegotiateWithProtocol(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	server, err := newTestServer(ctx, "10025", []string{
+		serverMessagesStart,
+		serverMessagesSMTP,
+		serverMessagesStart,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test server: %v", err)
+	}
+	defer server.stop()
+
+	server.start(ctx)
+
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "tcp", server.addr())
+	if err != nil {
+		t.Fatalf("Failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+
+	protocol, err := Protocol("SMTP")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	result, err := NegotiateWithProtocol(ctx, conn, protocol)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := <-server.errors; err != nil {
+		t.Fatalf("Server error: %v", err)
+	}
+
+	if result.Protocol != "smtp" || !result.TLSEstablished {
+		t.Errorf("Expected established smtp negotiation, got %+v", result)
+	}
+}
+
+func TestProtocolNames(t *testing.T) {
+	names := []ProtocolID{
+		ProtocolFTP, ProtocolIMAP, ProtocolLDAP, ProtocolLMTP, ProtocolMySQL,
+		ProtocolMySQLX, ProtocolNATS, ProtocolPOP3, ProtocolSMTP,
+	}
+
+	for _, name := range names {
+		protocol, err := Protocol(name)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", name, err)
+		}
+
+		if protocol.Name() != name.String() {
+			t.Errorf("Expected protocol %s, got %s", name, protocol.Name())
+		}
+
+		id, err := ParseProtocolID(strings.ToUpper(name.String()))
+		if err != nil || id != name {
+			t.Errorf("Expected ParseProtocolID to return %s, got %q, %v", name, id, err)
+		}
+	}
+
+	_, err := Protocol("gopher")
+	if !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol, got: %v", err)
+	}
+
+	_, err = ParseProtocolID("gopher")
+	if !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("Expected ErrUnknownProtocol, got: %v", err)
+	}
+}
+
+func TestNegotiateReadWriter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// A plain io.ReadWriter without the methods of net.Conn.
+	conn := &dryRunConn{respond: dryRunSMTPReply}
+	conn.replies.WriteString(serverMessagesStart)
+
+	result, err := Negotiate(ctx, conn, "25", WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !result.TLSEstablished || result.BytesSent == 0 || len(conn.sent) != 2 {
+		t.Errorf("Expected STARTTLS over the ReadWriter, got %+v after %q", result, conn.sent)
+	}
+
+	conn = &dryRunConn{}
+	conn.replies.WriteString(serverMessagesStart)
+
+	_, err = Negotiate(ctx, conn, "12225", WithAutoDetect(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "SetReadDeadline") {
+		t.Errorf("Expected auto-detect to require read deadlines, got %v", err)
+	}
+}
+
+func TestGreeting(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     string
+		greeting []string
+		replies  []string
+		banner   string
+	}{
+		{
+			name:     "smtp multiline",
+			port:     "25",
+			greeting: []string{"220-mail.test ESMTP", "220 ready\r\n"},
+			replies:  []string{serverMessagesSMTP, "220 ready for TLS\r\n"},
+			banner:   "220-mail.test ESMTP\n220 ready",
+		},
+		{
+			name:     "imap",
+			port:     "143",
+			greeting: []string{"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready"},
+			replies:  []string{"a001 OK begin TLS\r\n"},
+			banner:   "* OK [CAPABILITY IMAP4rev1 STARTTLS] ready",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server does not greet again; the caller already read it.
+			result, err := negotiateWithHandler(t, tt.port, func(conn net.Conn) {
+				r := bufio.NewReader(conn)
+				for _, reply := range tt.replies {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+
+					_, _ = conn.Write([]byte(reply))
+				}
+			}, WithGreeting(tt.greeting...))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !result.TLSEstablished || result.Banner != tt.banner {
+				t.Errorf("Expected TLS with banner %q, got %+v", tt.banner, result)
+			}
+
+			var replyBytes int64
+			for _, reply := range tt.replies {
+				replyBytes += int64(len(reply))
+			}
+
+			if result.BytesReceived != replyBytes {
+				t.Errorf("Expected %d bytes received from the server, got %d", replyBytes, result.BytesReceived)
+			}
+		})
+	}
+}
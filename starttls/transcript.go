@@ -0,0 +1,136 @@
+package starttls
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// maxTranscriptLines bounds the transcript kept with WithTranscript, so a
+// server that floods the connection cannot exhaust memory.
+const maxTranscriptLines = 1000
+
+// TranscriptLine is one line of a negotiation transcript.
+type TranscriptLine struct {
+	// Sent reports whether the client sent the line; otherwise the server
+	// did.
+	Sent bool `json:"sent"`
+	// Text is the line without its terminator. It is not sanitized.
+	Text string `json:"text"`
+}
+
+// String returns the line prefixed with "C: " or "S: ", sanitized for logs.
+func (l TranscriptLine) String() string {
+	if l.Sent {
+		return "C: " + sanitizeResponse(l.Text)
+	}
+
+	return "S: " + sanitizeResponse(l.Text)
+}
+
+// transcript splits the bytes exchanged during a negotiation into lines,
+// keeping them with WithTranscript and passing them to the OnSend and
+// OnReceive hooks. Reads abandoned by readContext may still record, hence
+// the mutex.
+type transcript struct {
+	mu    sync.Mutex
+	keep  bool
+	hooks *Hooks
+	lines []TranscriptLine
+	// command is the last line sent in the current step, for WithLogger.
+	command string
+	// partial holds the unterminated tail of each direction, indexed by
+	// sent.
+	partial map[bool][]byte
+}
+
+func (t *transcript) record(sent bool, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.partial == nil {
+		t.partial = make(map[bool][]byte)
+	}
+
+	data := append(t.partial[sent], b...)
+
+	for {
+		line, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			break
+		}
+
+		t.add(sent, string(line))
+		data = rest
+	}
+
+	t.partial[sent] = data
+}
+
+func (t *transcript) add(sent bool, line string) {
+	line = strings.TrimSuffix(line, "\r")
+
+	if sent {
+		t.command = line
+	}
+
+	if t.keep && len(t.lines) < maxTranscriptLines {
+		t.lines = append(t.lines, TranscriptLine{Sent: sent, Text: line})
+	}
+
+	switch {
+	case t.hooks == nil:
+	case sent && t.hooks.OnSend != nil:
+		t.hooks.OnSend(line)
+	case !sent && t.hooks.OnReceive != nil:
+		t.hooks.OnReceive(line)
+	}
+}
+
+// takeCommand returns the last line sent since the previous call.
+func (t *transcript) takeCommand() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	command := t.command
+	t.command = ""
+
+	return command
+}
+
+// snapshot returns the lines so far, including unterminated ones.
+func (t *transcript) snapshot() []TranscriptLine {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]TranscriptLine(nil), t.lines...)
+
+	for _, sent := range []bool{true, false} {
+		if len(t.partial[sent]) > 0 {
+			lines = append(lines, TranscriptLine{Sent: sent, Text: string(t.partial[sent])})
+		}
+	}
+
+	return lines
+}
+
+// transcriptReadWriter records what passes through it in a transcript.
+type transcriptReadWriter struct {
+	io.ReadWriter
+	t *transcript
+}
+
+func (rw *transcriptReadWriter) Read(b []byte) (int, error) {
+	n, err := rw.ReadWriter.Read(b)
+	rw.t.record(false, b[:n])
+
+	return n, err
+}
+
+func (rw *transcriptReadWriter) Write(b []byte) (int, error) {
+	n, err := rw.ReadWriter.Write(b)
+	rw.t.record(true, b[:n])
+
+	return n, err
+}
@@ -0,0 +1,98 @@
+package starttls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+)
+
+// UpgradeTLS negotiates STARTTLS on conn for the protocol registered for port
+// and then runs the TLS client handshake with config, returning the TLS
+// connection to use from then on. On direct TLS ports and ports without a
+// STARTTLS protocol the TLS handshake starts immediately, as StartTLS would
+// leave it to the caller.
+//
+// opts are passed to Negotiate. A negotiation that does not end with the
+// server accepting the upgrade, such as a fallback with WithOpportunistic or
+// a WithProbeOnly check, returns an error instead of a plaintext connection.
+// conn is not closed on error.
+func UpgradeTLS[P Port](ctx context.Context, conn net.Conn, port P, config *tls.Config, opts ...Option) (*tls.Conn, error) {
+	result, err := Negotiate(ctx, conn, port, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return handshakeTLS(ctx, conn, result, config)
+}
+
+// handshakeTLS runs the TLS client handshake on conn after the negotiation
+// that produced result, refusing to continue in plaintext.
+func handshakeTLS(ctx context.Context, conn net.Conn, result *StartTLSResult, config *tls.Config) (*tls.Conn, error) {
+	if result.FallbackReason != nil {
+		return nil, result.FallbackReason
+	}
+
+	if result.Protocol != "" && !result.TLSEstablished {
+		return nil, fmt.Errorf("%s: STARTTLS was not completed", result.Protocol)
+	}
+
+	tlsConn := tls.Client(result.Conn(conn), config)
+
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	return tlsConn, nil
+}
+
+// alpnProtocols holds the ALPN identifiers registered with IANA for the
+// built-in protocols that have one. SMTP and the others have none.
+var alpnProtocols = map[ProtocolID][]string{
+	ProtocolFTP:  {"ftp"},
+	ProtocolIMAP: {"imap"},
+	ProtocolPOP3: {"pop3"},
+}
+
+// RecommendedTLSConfig returns a tls.Config for the handshake after
+// negotiating the protocol registered under name, such as "smtp" or "imap".
+// It sets ServerName for SNI and certificate verification, which stays
+// enabled, requires TLS 1.2 or later, and offers the IANA registered ALPN
+// identifier of protocols that have one: "ftp", "imap" and "pop3". Unknown
+// names get the same config without ALPN. Callers can adjust the returned
+// config, for example to add RootCAs.
+func RecommendedTLSConfig(name ProtocolID, serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: slices.Clone(alpnProtocols[ProtocolID(strings.ToLower(string(name)))]),
+	}
+}
+
+// Conn returns the connection to run the TLS handshake on after a
+// successful negotiation on conn. The negotiation reads through a buffer,
+// and a server that sends data right after accepting the upgrade may have
+// had some of it read already; the returned connection yields those bytes
+// before reading from conn. Without such bytes conn itself is returned.
+func (r *StartTLSResult) Conn(conn net.Conn) net.Conn {
+	if len(r.pending) == 0 {
+		return conn
+	}
+
+	return &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(r.pending), conn)}
+}
+
+// bufferedConn is a net.Conn whose reads start with already buffered bytes.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,200 @@
+package starttls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUpgradeTLS(t *testing.T) {
+	tests := []struct {
+		name        string
+		port        string
+		replies     []string
+		opts        []Option
+		expectTLS   bool
+		expectedErr error
+	}{
+		{
+			name:      "smtp",
+			port:      "25",
+			replies:   []string{serverMessagesStart, serverMessagesSMTP, "220 ready for TLS\r\n"},
+			expectTLS: true,
+		},
+		{
+			name:      "direct tls",
+			port:      "465",
+			expectTLS: true,
+		},
+		{
+			name:        "rejected",
+			port:        "25",
+			replies:     []string{serverMessagesStart, serverMessagesSMTP, "454 4.7.0 TLS not available\r\n"},
+			expectedErr: ErrStartTLSNotSupported,
+		},
+		{
+			name:        "opportunistic fallback",
+			port:        "25",
+			replies:     []string{serverMessagesStart, serverMessagesSMTPNoTLS},
+			opts:        []Option{WithOpportunistic()},
+			expectedErr: ErrStartTLSNotAdvertised,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			client, server := net.Pipe()
+			defer client.Close()
+
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				defer server.Close()
+
+				r := bufio.NewReader(server)
+
+				for i, reply := range tt.replies {
+					if i > 0 {
+						if _, err := r.ReadString('\n'); err != nil {
+							return
+						}
+					}
+
+					_, _ = server.Write([]byte(reply))
+				}
+
+				if tt.expectTLS {
+					conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+					_ = conn.HandshakeContext(ctx)
+				}
+			}()
+
+			tlsConn, err := UpgradeTLS(ctx, client, tt.port, &tls.Config{InsecureSkipVerify: true}, tt.opts...)
+
+			client.Close()
+			<-done
+
+			if !tt.expectTLS {
+				if !errors.Is(err, tt.expectedErr) || tlsConn != nil {
+					t.Errorf("Expected %v, got %v, %v", tt.expectedErr, tlsConn, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !tlsConn.ConnectionState().HandshakeComplete {
+				t.Error("Expected a completed TLS handshake")
+			}
+		})
+	}
+}
+
+// serveEarlyData accepts STARTTLS and sends the first of data together with
+// the acceptance, the way a server that does not wait for the ClientHello
+// would.
+func serveEarlyData(conn net.Conn, data ...string) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	_, _ = conn.Write([]byte(serverMessagesStart))
+	_, _ = r.ReadString('\n')
+	_, _ = conn.Write([]byte(serverMessagesSMTP))
+	_, _ = r.ReadString('\n')
+	_, _ = conn.Write([]byte("220 ready for TLS\r\n" + data[0]))
+
+	for _, d := range data[1:] {
+		_, _ = conn.Write([]byte(d))
+	}
+}
+
+func TestStartTLSResultConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go serveEarlyData(server, "early", " late")
+
+	result, err := Negotiate(ctx, client, "25")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	buf := make([]byte, len("early late"))
+
+	_, err = io.ReadFull(result.Conn(client), buf)
+	if err != nil || string(buf) != "early late" {
+		t.Errorf("Expected the buffered bytes first, got %q, %v", buf, err)
+	}
+
+	if conn := (&StartTLSResult{}).Conn(client); conn != client {
+		t.Errorf("Expected the connection itself without buffered bytes, got %T", conn)
+	}
+}
+
+func TestStartTLSBufferedData(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go serveEarlyData(server, "early")
+
+	err := StartTLS(ctx, client, "25")
+	if !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("Expected ErrInvalidResponse, got: %v", err)
+	}
+}
+
+func TestRecommendedTLSConfig(t *testing.T) {
+	tests := []struct {
+		protocol     ProtocolID
+		expectedALPN []string
+	}{
+		{protocol: "smtp"},
+		{protocol: "LMTP"},
+		{protocol: "ftp", expectedALPN: []string{"ftp"}},
+		{protocol: "IMAP", expectedALPN: []string{"imap"}},
+		{protocol: "pop3", expectedALPN: []string{"pop3"}},
+		{protocol: "mysql"},
+		{protocol: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol.String(), func(t *testing.T) {
+			config := RecommendedTLSConfig(tt.protocol, "mail.example.com")
+
+			if config.ServerName != "mail.example.com" || config.MinVersion != tls.VersionTLS12 || config.InsecureSkipVerify {
+				t.Errorf("Unexpected config: %+v", config)
+			}
+
+			if !slices.Equal(config.NextProtos, tt.expectedALPN) {
+				t.Errorf("Expected ALPN %q, got %q", tt.expectedALPN, config.NextProtos)
+			}
+		})
+	}
+
+	config := RecommendedTLSConfig("ftp", "ftp.example.com")
+	config.NextProtos[0] = "changed"
+
+	if RecommendedTLSConfig("ftp", "ftp.example.com").NextProtos[0] != "ftp" {
+		t.Error("Expected each config to have its own ALPN list")
+	}
+}